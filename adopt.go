@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func runAdopt(args []string) error {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: datavault adopt [OPTIONS] <remote_folder>")
+	}
+
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+
+	bm := NewBackupManager(config)
+	_, err = bm.AdoptBackup(context.Background(), positional[0])
+	return err
+}
+
+// AdoptBackup turns an existing folder inside the DataVault root of every
+// provider into the baseline for incremental backups. Source files already
+// present remotely with the same size are recorded as unchanged, so the next
+// incremental run only uploads what differs.
+func (bm *BackupManager) AdoptBackup(ctx context.Context, folderName string) (*Manifest, error) {
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no cloud storage available")
+	}
+	if bm.gdrive != nil && bm.gdrive.limitedScope() {
+		log.Printf("Warning: With gdrive_scope %s, Google Drive only shows files DataVault uploaded; set gdrive_scope to %s to adopt a folder uploaded otherwise",
+			gdriveScopeFile, gdriveScopeFull)
+	}
+
+	// A file is only part of the baseline if every provider has it
+	remote := make([]map[string]RemoteFile, 0, len(providers))
+	for _, p := range providers {
+		files, err := p.ListBackupFiles(ctx, folderName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+
+		byPath := make(map[string]RemoteFile, len(files))
+		for _, file := range files {
+			byPath[file.Path] = file
+		}
+		remote = append(remote, byPath)
+		log.Printf("Found %d files in %s on %s", len(files), folderName, p.Name())
+	}
+
+	manifest := &Manifest{
+		BackupName: folderName,
+		CreatedAt:  bm.now(),
+	}
+
+	missing := 0
+	src := localSource(bm.config.StateDir, bm.sourceFolder(bm.now()))
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		for _, byPath := range remote {
+			if file, ok := byPath[relPath]; !ok || file.Size != info.Size() {
+				missing++
+				if bm.config.Verbose {
+					log.Printf("Not adopting %s: missing or different on a provider", relPath)
+				}
+				return nil
+			}
+		}
+
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Path:    relPath,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Backup:  folderName,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan source folder: %w", err)
+	}
+
+	if err := saveManifest(manifest, lastManifestPath(bm.config.StateDir)); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Adopted %s as baseline: %d files matched, %d will be uploaded by the next incremental backup",
+		folderName, len(manifest.Files), missing)
+	return manifest, nil
+}
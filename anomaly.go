@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Runs deviating from the recent history by more than anomalyFactor in
+// either direction are reported, once anomalyMinRuns runs are recorded
+const (
+	anomalyFactor  = 10
+	anomalyMinRuns = 5
+	anomalyWindow  = 20 // Recent runs the median is taken over
+)
+
+// checkAnomalies warns when a run is far smaller, larger or slower than the
+// recent runs of the job. A backup that shrank by 90% may mean the source is
+// no longer mounted; one that grew tenfold may pick up a runaway cache.
+func (bm *BackupManager) checkAnomalies(record runRecord, history []runRecord) {
+	var sizes []int64
+	var durations []time.Duration
+	for _, past := range history {
+		sizes = append(sizes, past.Size)
+		// Resumed runs include the time DataVault wasn't running
+		if !past.Resumed {
+			durations = append(durations, past.Duration)
+		}
+	}
+	if len(sizes) < anomalyMinRuns {
+		return
+	}
+	if len(sizes) > anomalyWindow {
+		sizes = sizes[len(sizes)-anomalyWindow:]
+	}
+	if len(durations) > anomalyWindow {
+		durations = durations[len(durations)-anomalyWindow:]
+	}
+
+	var warnings []string
+	if size := median(sizes); size > 0 {
+		switch {
+		case record.Size*anomalyFactor < size:
+			warnings = append(warnings, fmt.Sprintf("backup %s is %s, far smaller than the usual %s; is the source folder mounted?",
+				record.Backup, formatBytes(record.Size), formatBytes(size)))
+		case record.Size > size*anomalyFactor:
+			warnings = append(warnings, fmt.Sprintf("backup %s is %s, far larger than the usual %s; did a cache or temporary folder end up in the source?",
+				record.Backup, formatBytes(record.Size), formatBytes(size)))
+		}
+	}
+
+	// Short runs vary a lot, so durations count from a minute up
+	if len(durations) >= anomalyMinRuns && !record.Resumed {
+		usual := max(median(durations), time.Minute)
+		if record.Duration > usual*anomalyFactor {
+			warnings = append(warnings, fmt.Sprintf("backup %s took %v, far longer than the usual %v",
+				record.Backup, record.Duration, median(durations)))
+		}
+	}
+
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+		bm.alerts.Send("DataVault: "+bm.jobName()+" unusual backup", "DataVault: "+warning)
+	}
+}
+
+// median returns the middle value of values
+func median[T int64 | time.Duration](values []T) T {
+	sorted := append([]T(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// apiCacheTTL is how long the API keeps a downloaded manifest. Tags and
+// comments may change, the files of a complete backup never do.
+const apiCacheTTL = 5 * time.Minute
+
+// runServe serves a read-only JSON API over the backups on the providers, so
+// tools such as file-history plugins and search indexers can use the
+// manifests without reading the cloud folders themselves:
+//
+//	GET /v1/backups                  Backups on the provider, newest first
+//	GET /v1/backups/{name}           Full manifest of a backup
+//	GET /v1/backups/{name}/files     Files of a backup, below ?prefix=
+//	GET /v1/history?path=<path>      Versions of a file across backups
+//
+// Every request may pick the provider with ?provider=.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8420", "Address to serve the API on")
+	tokenFile := fs.String("token-file", "", "File with the token clients must send as \"Authorization: Bearer <token>\" (required off localhost)")
+
+	config, _, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var token string
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		if token = strings.TrimSpace(string(data)); token == "" {
+			return fmt.Errorf("%s is empty", *tokenFile)
+		}
+		addSecret(token)
+	}
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("serving on %s lists your files to the network, pass -token-file", *listen)
+	}
+
+	bm := NewBackupManager(config)
+	if len(bm.providers()) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	api := &snapshotAPI{bm: bm, token: token, manifests: make(map[string]cachedManifest), loading: make(map[string]*manifestLoad)}
+	server := &http.Server{Addr: *listen, Handler: api.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	log.Printf("Serving the backup API on http://%s/v1/", *listen)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// snapshotAPI answers the requests of runServe
+type snapshotAPI struct {
+	bm    *BackupManager
+	token string
+
+	mu        sync.Mutex
+	manifests map[string]cachedManifest // By provider and backup name
+	loading   map[string]*manifestLoad  // Downloads in progress, by the same key
+	swept     time.Time                 // When expired manifests were last dropped
+}
+
+type cachedManifest struct {
+	manifest *Manifest
+	fetched  time.Time
+}
+
+// manifestLoad is a manifest download that requests for the same backup wait
+// for instead of downloading it again
+type manifestLoad struct {
+	done     chan struct{} // Closed when manifest and err are set
+	manifest *Manifest
+	err      error
+}
+
+// apiBackup is a backup in the list of backups
+type apiBackup struct {
+	Provider string    `json:"provider"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+}
+
+// apiVersion is a version of a file in its history
+type apiVersion struct {
+	Backup   string    `json:"backup"` // Backup the version is part of first
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"` // The file is missing from this backup on
+}
+
+// apiError is an error with the HTTP status it is answered with
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (api *snapshotAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/backups", api.serve(api.backups))
+	mux.HandleFunc("GET /v1/backups/{name}", api.serve(api.manifest))
+	mux.HandleFunc("GET /v1/backups/{name}/files", api.serve(api.files))
+	mux.HandleFunc("GET /v1/history", api.serve(api.history))
+	return mux
+}
+
+// serve checks the token, runs handle and writes what it returns as JSON
+func (api *snapshotAPI) serve(handle func(r *http.Request, p Provider) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if api.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(api.token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "missing or wrong token"})
+			return
+		}
+
+		p, err := api.bm.provider(r.URL.Query().Get("provider"))
+		if err != nil {
+			err = &apiError{http.StatusBadRequest, err}
+		}
+		var result any
+		if err == nil {
+			result, err = handle(r, p)
+		}
+		if err != nil {
+			status := http.StatusBadGateway // The provider failed
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				status = apiErr.status
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": redact(err.Error())})
+			return
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil && api.bm.config.Verbose {
+			log.Printf("Warning: Failed to answer %s: %v", r.URL.Path, err)
+		}
+	}
+}
+
+func (api *snapshotAPI) backups(r *http.Request, p Provider) (any, error) {
+	backups, err := p.ListBackups(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+
+	list := make([]apiBackup, 0, len(backups))
+	for _, backup := range backups {
+		list = append(list, apiBackup{Provider: p.Name(), Name: backup.Name, Created: backup.Created})
+	}
+	return list, nil
+}
+
+func (api *snapshotAPI) manifest(r *http.Request, p Provider) (any, error) {
+	return api.load(r.Context(), p, r.PathValue("name"))
+}
+
+func (api *snapshotAPI) files(r *http.Request, p Provider) (any, error) {
+	manifest, err := api.load(r.Context(), p, r.PathValue("name"))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(r.URL.Query().Get("prefix"), "/")
+	files := make([]ManifestEntry, 0, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		if prefix == "" || entry.Path == prefix || strings.HasPrefix(entry.Path, prefix+"/") {
+			files = append(files, entry)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// history returns the versions of a file, oldest first: one for each backup
+// in which its content differs from the backup before
+func (api *snapshotAPI) history(r *http.Request, p Provider) (any, error) {
+	filePath := strings.Trim(r.URL.Query().Get("path"), "/")
+	if filePath == "" {
+		return nil, &apiError{http.StatusBadRequest, fmt.Errorf("path is required")}
+	}
+
+	backups, err := p.ListBackups(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.Before(backups[j].Created)
+	})
+
+	versions := []apiVersion{}
+	var last *apiVersion
+	for _, backup := range backups {
+		manifest, err := api.load(r.Context(), p, backup.Name)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+			// Folders without a manifest have no file metadata to offer
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := manifest.index()[filePath]
+		switch {
+		case !ok && last != nil && !last.Deleted:
+			versions = append(versions, apiVersion{Backup: backup.Name, Created: backup.Created, Deleted: true})
+		case ok && (last == nil || last.Deleted || entry.Size != last.Size || !entry.ModTime.Equal(last.ModTime) || entry.Checksum != last.Checksum):
+			versions = append(versions, apiVersion{Backup: backup.Name, Created: backup.Created, Size: entry.Size,
+				ModTime: entry.ModTime, Checksum: entry.Checksum})
+		default:
+			continue
+		}
+		last = &versions[len(versions)-1]
+	}
+	return versions, nil
+}
+
+// load returns the full manifest of a backup on p, downloading it unless it
+// was shortly before. The lock is only held to look at the maps, so one slow
+// download doesn't hold up the other requests, and concurrent requests for
+// the same backup share one download.
+func (api *snapshotAPI) load(ctx context.Context, p Provider, name string) (*Manifest, error) {
+	key := p.Name() + "/" + name
+
+	api.mu.Lock()
+	if time.Since(api.swept) >= apiCacheTTL {
+		for k, cached := range api.manifests {
+			if time.Since(cached.fetched) >= apiCacheTTL {
+				delete(api.manifests, k)
+			}
+		}
+		api.swept = time.Now()
+	}
+	if cached, ok := api.manifests[key]; ok && time.Since(cached.fetched) < apiCacheTTL {
+		api.mu.Unlock()
+		return cached.manifest, nil
+	}
+	l, ok := api.loading[key]
+	if !ok {
+		l = &manifestLoad{done: make(chan struct{})}
+		api.loading[key] = l
+		// The download outlives the request that started it, the others
+		// waiting for it shouldn't fail when that client goes away
+		go api.download(context.WithoutCancel(ctx), p, name, key, l)
+	}
+	api.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.manifest, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// download fetches the manifest of l and caches it
+func (api *snapshotAPI) download(ctx context.Context, p Provider, name, key string, l *manifestLoad) {
+	manifest, err := api.bm.remoteManifest(ctx, p, name, make(map[string]map[string]RemoteFile))
+	if err == nil && manifest == nil {
+		err = &apiError{http.StatusNotFound, fmt.Errorf("%s has no manifest on %s", name, providerLabel(p.Name()))}
+	}
+
+	api.mu.Lock()
+	if err == nil {
+		api.manifests[key] = cachedManifest{manifest: manifest, fetched: time.Now()}
+	}
+	delete(api.loading, key)
+	api.mu.Unlock()
+
+	l.manifest, l.err = manifest, err
+	close(l.done)
+}
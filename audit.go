@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// auditIssue is a divergence between the copies of a backup
+type auditIssue struct {
+	Backup   string
+	Provider string
+	Problem  string
+}
+
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+
+	config, _, names, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	bm := NewBackupManager(config)
+	if len(bm.providers()) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	issues, checked, err := bm.Audit(context.Background(), names)
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range issues {
+		fmt.Printf("%s on %s: %s\n", issue.Backup, providerLabel(issue.Provider), issue.Problem)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("found %d problems in %d backups", len(issues), checked)
+	}
+
+	fmt.Printf("All %d backups are consistent across providers\n", checked)
+	return nil
+}
+
+// Audit compares the manifests and files of each backup on every provider.
+// Without names it checks every backup found on any provider. It returns
+// the problems found and the number of backups checked.
+func (bm *BackupManager) Audit(ctx context.Context, names []string) ([]auditIssue, int, error) {
+	providers := bm.providers()
+
+	// Which providers hold which backups
+	present := make(map[string]map[string]bool)
+	for _, p := range providers {
+		backups, err := p.ListBackups(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list backups on %s: %w", p.Name(), err)
+		}
+		for _, backup := range backups {
+			if present[backup.Name] == nil {
+				present[backup.Name] = make(map[string]bool)
+			}
+			present[backup.Name][p.Name()] = true
+		}
+	}
+
+	if len(names) == 0 {
+		for name := range present {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var issues []auditIssue
+	listings := make(map[string]map[string]RemoteFile)
+	for _, name := range names {
+		issues = append(issues, bm.auditBackup(ctx, name, present[name], listings)...)
+	}
+
+	return issues, len(names), nil
+}
+
+// auditBackup checks the copies of one backup against their manifests and
+// each other
+func (bm *BackupManager) auditBackup(ctx context.Context, name string, present map[string]bool, listings map[string]map[string]RemoteFile) []auditIssue {
+	var issues []auditIssue
+	report := func(provider, format string, args ...any) {
+		issues = append(issues, auditIssue{Backup: name, Provider: provider, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	manifests := make(map[string]*Manifest)
+	var order, missing []string
+	for _, p := range bm.providers() {
+		if !present[p.Name()] {
+			missing = append(missing, p.Name())
+			continue
+		}
+
+		manifest, err := bm.remoteManifest(ctx, p, name, listings)
+		if err != nil {
+			report(p.Name(), "%v", err)
+			continue
+		}
+		if manifest == nil {
+			report(p.Name(), "no manifest")
+			continue
+		}
+		if manifest.Partial {
+			report(p.Name(), "only partially uploaded")
+		}
+		manifests[p.Name()] = manifest
+		order = append(order, p.Name())
+
+		files, err := bm.storedFiles(ctx, p, name, listings)
+		if err != nil {
+			report(p.Name(), "%v", err)
+			continue
+		}
+		for _, entry := range manifest.Files {
+			if entry.Backup != name || (entry.Provider != "" && entry.Provider != p.Name()) {
+				continue
+			}
+			remote, ok := files[entry.storedPath()]
+			switch {
+			case !ok:
+				report(p.Name(), "%s is in the manifest but missing", entry.Path)
+			case entry.Encoding == "" && remote.Size != entry.Size:
+				report(p.Name(), "%s is %d bytes, the manifest says %d", entry.Path, remote.Size, entry.Size)
+			}
+		}
+	}
+
+	// Under the any and fallback policies one copy is all there should be
+	single := false
+	for _, manifest := range manifests {
+		if info := manifest.Info; info != nil && (info.Config.FanOut == fanOutAny || info.Config.FanOut == fanOutFallback) {
+			single = true
+		}
+	}
+	if !single {
+		for _, provider := range missing {
+			report(provider, "missing")
+		}
+	}
+
+	// Every copy should list the same files with the same content
+	paths := make(map[string]map[string]ManifestEntry)
+	for provider, manifest := range manifests {
+		for _, entry := range manifest.Files {
+			if paths[entry.Path] == nil {
+				paths[entry.Path] = make(map[string]ManifestEntry)
+			}
+			paths[entry.Path][provider] = entry
+		}
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	for _, path := range sorted {
+		var checksum string
+		for _, provider := range order {
+			entry, ok := paths[path][provider]
+			if !ok {
+				report(provider, "%s is in other copies but not in this manifest", path)
+				continue
+			}
+			if checksum == "" {
+				checksum = entry.Checksum
+			} else if entry.Checksum != "" && entry.Checksum != checksum {
+				report(provider, "%s differs from other copies", path)
+			}
+		}
+	}
+
+	return issues
+}
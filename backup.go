@@ -2,133 +2,430 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
 	"time"
 )
 
 type BackupManager struct {
-	config  Config
-	gdrive  *GoogleDriveClient
-	pcloud  *PCloudClient
-	tempDir string
+	config    Config
+	gdrive    *GoogleDriveClient
+	pcloud    *PCloudClient
+	fake      *fakeProvider // Replaces the cloud clients with "-provider fake"
+	tempDir   string
+	stages    *stageSet // Shared by all jobs
+	windows   []activityWindow
+	blackouts []blackoutPeriod
+	limiter   chan struct{} // Shared by all jobs to limit concurrent runs
+	runMu     sync.Mutex    // Serializes backup runs and watch mode uploads
+
+	breakersMu sync.Mutex
+	breakers   map[string]*circuitBreaker // Keyed by provider name, shared by all jobs
+
+	handedOff      bool // Uploading as the run_as user; see uploadAs
+	loggedExcludes bool // The exclude rules were logged at the first run
+
+	alerts  *alerter // Shared by all jobs; nil without notifications
+	summary *template.Template
+	now     func() time.Time // Names and schedules backups; see clockEnv
+}
+
+// Outcomes of a backup run, as recorded in the run history
+const (
+	runSucceeded = "succeeded" // Every provider that should have the backup has it
+	runPartial   = "partial"   // Some providers have the backup, or the run was interrupted
+	runFailed    = "failed"    // No provider has the backup
+)
+
+// exitPartial is the exit code of commands whose backup is incomplete
+const exitPartial = 2
+
+// partialError is returned by a run that left a usable but incomplete backup
+type partialError struct {
+	reason string
+}
+
+func (e *partialError) Error() string {
+	return "backup incomplete: " + e.reason
+}
+
+// isPartial reports whether err is from a run that left an incomplete backup
+func isPartial(err error) bool {
+	var partial *partialError
+	return errors.As(err, &partial)
 }
 
 type BackupResult struct {
+	Provider  string
 	Success   bool
 	Message   string
 	Error     error
 	Timestamp time.Time
+	Rate      float64 // Bytes per second uploaded, zero if too little to tell
 }
 
 func NewBackupManager(config Config) *BackupManager {
 	// Create temporary directory for backups
-	tempDir := filepath.Join(os.TempDir(), "datavault_backups")
+	tempDir := stagingDir()
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		log.Printf("Warning: Failed to create temp directory: %v", err)
 	}
 
+	// Windows and blackouts are checked by ValidateConfig
+	windows, err := parseWindows(config.BackupWindows)
+	if err != nil {
+		log.Printf("Warning: Ignoring backup windows: %v", err)
+	}
+	blackouts, err := parseBlackouts(config.Blackouts)
+	if err != nil {
+		log.Printf("Warning: Ignoring blackouts: %v", err)
+	}
+
+	// Templates are checked by ValidateConfig
+	summary, err := loadTemplate(config.SummaryTemplate)
+	if err != nil {
+		log.Printf("Warning: Ignoring summary template: %v", err)
+	}
+
 	bm := &BackupManager{
-		config:  config,
-		tempDir: tempDir,
+		now:       loadClock(),
+		summary:   summary,
+		config:    config,
+		tempDir:   tempDir,
+		stages:    newStageSet(),
+		windows:   windows,
+		blackouts: blackouts,
+		breakers:  make(map[string]*circuitBreaker),
+		alerts:    newAlerter(config),
 	}
 
 	// Initialize cloud clients
-	if config.GoogleDriveAuth != "" {
-		bm.gdrive = NewGoogleDriveClient(config.GoogleDriveAuth)
-	}
-	if config.PCloudAuth != "" {
-		bm.pcloud = NewPCloudClient(config.PCloudAuth)
+	rootPath := expandTemplate(config.RemoteRoot, config.Job, bm.now())
+	if config.Provider == "fake" || config.Simulate {
+		bm.fake = newFakeProvider()
+	} else {
+		transport := networkTransport(config.Network)
+		if config.GoogleDriveAuth != "" && config.Provider != "pcloud" {
+			bm.gdrive = NewGoogleDriveClient(config.GoogleDriveAuth, rootPath, config.GoogleDriveScope, config.Endpoints["gdrive"], transport, config.DriveTimeouts)
+		}
+		if config.PCloudAuth != "" && config.Provider != "gdrive" {
+			bm.pcloud = NewPCloudClient(config.PCloudAuth, rootPath, config.Endpoints["pcloud"], transport, config.PCloudTimeouts)
+		}
 	}
 
 	return bm
 }
 
+// stagingDir is where backups are copied to before they are uploaded
+func stagingDir() string {
+	return filepath.Join(os.TempDir(), "datavault_backups")
+}
+
+// withConfig returns a manager for another job sharing this one's cloud clients
+func (bm *BackupManager) withConfig(config Config) *BackupManager {
+	windows, err := parseWindows(config.BackupWindows)
+	if err != nil {
+		log.Printf("Warning: Ignoring backup windows: %v", err)
+	}
+	blackouts, err := parseBlackouts(config.Blackouts)
+	if err != nil {
+		log.Printf("Warning: Ignoring blackouts: %v", err)
+	}
+
+	return &BackupManager{
+		config:    config,
+		gdrive:    bm.gdrive,
+		pcloud:    bm.pcloud,
+		fake:      bm.fake,
+		tempDir:   bm.tempDir,
+		stages:    bm.stages,
+		windows:   windows,
+		blackouts: blackouts,
+		breakers:  bm.breakers,
+		alerts:    bm.alerts,
+		summary:   bm.summary,
+		now:       bm.now,
+	}
+}
+
+// sourceFolder returns the absolute source folder, or the URL of a remote
+// one, with template variables expanded for a run at now
+func (bm *BackupManager) sourceFolder(now time.Time) string {
+	source := expandTemplate(bm.config.SourceFolder, bm.config.Job, now)
+	if _, ok := remoteSource(source); ok {
+		return source
+	}
+	if absPath, err := filepath.Abs(source); err == nil {
+		return absPath
+	}
+	return source
+}
+
+// backupName returns the folder name for a backup started at now
+func (bm *BackupManager) backupName(now time.Time) string {
+	template := bm.config.BackupName
+	if template == "" {
+		template = defaultBackupName
+		if bm.config.Job != "" {
+			template = defaultJobBackupName
+		}
+	}
+	return expandTemplate(template, bm.config.Job, now)
+}
+
+// Run performs the initial backup, then watches and schedules backups until
+// ctx is cancelled
+func (bm *BackupManager) Run(ctx context.Context) {
+	// Run initial backup; when backups aren't allowed the scheduler defers it
+	if bm.BackupAllowed(bm.now()) {
+		if err := bm.RunBackup(ctx); err != nil {
+			log.Printf("Initial backup failed: %v", err)
+		}
+	}
+
+	// Upload changes in the background between scheduled backups
+	if bm.config.Watch {
+		go func() {
+			if err := bm.Watch(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Watch mode stopped: %v", err)
+			}
+		}()
+	}
+
+	// Start scheduled backups
+	if err := bm.StartScheduler(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Scheduler failed: %v", err)
+	}
+}
+
 func (bm *BackupManager) RunBackup(ctx context.Context) error {
-	log.Printf("Starting backup of: %s", bm.config.SourceFolder)
+	bm.runMu.Lock()
+	defer bm.runMu.Unlock()
+
+	release, err := bm.acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// At max_runtime a run stops like at a shutdown, and what is left of its
+	// upload resumes with the next run
+	runCtx := ctx
+	if bm.config.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, bm.config.MaxRuntime)
+		defer cancel()
+	}
+
+	// Finish uploads interrupted by a shutdown or crash before starting anew
+	bm.resumeUploads(runCtx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if runCtx.Err() == nil {
+		err = bm.runBackup(runCtx)
+	}
+	if runCtx.Err() != nil && ctx.Err() == nil {
+		log.Printf("Backup stopped after max_runtime of %s", bm.config.MaxRuntime)
+		err = &partialError{fmt.Sprintf("stopped after max_runtime of %s, the upload resumes with the next run", bm.config.MaxRuntime)}
+	}
+	if ctx.Err() == nil {
+		bm.alerts.Record(bm.jobName(), err)
+	}
+	return err
+}
+
+func (bm *BackupManager) runBackup(ctx context.Context) error {
+	now := bm.now()
+	source := bm.sourceFolder(now)
+	log.Printf("Starting backup of: %s", source)
+	if !bm.loggedExcludes && len(bm.config.Excludes)+len(bm.config.ExcludePresets) > 0 {
+		log.Printf("Excluding from backups: %s", describeExcludes(bm.config.Excludes, bm.config.ExcludePresets))
+		bm.loggedExcludes = true
+	}
+
+	// Remote sources are backed up from their mirror once it is up to date
+	local := source
+	if u, ok := remoteSource(source); ok {
+		var err error
+		if local, err = bm.pullRemote(ctx, u); err != nil {
+			return fmt.Errorf("failed to pull %s: %w", source, err)
+		}
+	} else if err := bm.awaitSource(ctx, source); err != nil {
+		return err
+	}
 
-	// Create timestamp for this backup
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	backupName := fmt.Sprintf("backup_%s", timestamp)
+	if err := bm.checkSource(local); err != nil {
+		return err
+	}
+
+	// Name this backup from the template
+	backupName := bm.backupName(now)
 
 	// Create backup directory
 	backupPath := filepath.Join(bm.tempDir, backupName)
+	bm.stages.add(backupPath)
+	defer bm.stages.remove(backupPath)
+
+	limit, err := bm.reserveTemp()
+	if err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(backupPath, 0755); err != nil {
 		return fmt.Errorf("failed to create backup directory: %w", err)
 	}
-	defer bm.cleanup(backupPath)
+
+	// Once queued, the staged backup belongs to the upload queue
+	queued := false
+	defer func() {
+		if !queued {
+			bm.cleanup(backupPath)
+		}
+	}()
+
+	// Incremental backups only stage files changed since the last complete backup
+	var previous *Manifest
+	if bm.config.Incremental {
+		var err error
+		if previous, err = loadLastManifest(bm.config.StateDir); err != nil {
+			log.Printf("Warning: Failed to load last manifest, running full backup: %v", err)
+		}
+	}
 
 	// Copy source folder to backup directory
-	destPath := filepath.Join(backupPath, filepath.Base(bm.config.SourceFolder))
-	if err := bm.copyDirectory(bm.config.SourceFolder, destPath); err != nil {
+	destPath := filepath.Join(backupPath, filepath.Base(local))
+	manifest, err := bm.stageDirectory(local, destPath, backupName, previous, limit)
+	if err != nil {
 		return fmt.Errorf("failed to copy source directory: %w", err)
 	}
+	manifest.Info = bm.backupInfo(source, now)
+	manifest.Tags = bm.config.Tags
+	manifest.Comment = bm.config.Comment
+
+	if bm.config.FanOut == fanOutStripe {
+		if err := bm.stripe(manifest); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("Successfully copied %s to %s", bm.config.SourceFolder, destPath)
+	// The uploaded manifest may only list what changed since the previous one
+	if err := saveManifest(deltaManifest(manifest, previous), filepath.Join(destPath, manifestFileName)); err != nil {
+		return err
+	}
+	if err := writeReadme(manifest, filepath.Join(destPath, readmeFileName)); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully copied %s to %s", source, destPath)
 
 	if bm.config.DryRun {
 		log.Printf("Dry run: Would upload backup to cloud drives")
 		return nil
 	}
 
-	// Upload to cloud drives
-	results := make(chan BackupResult, 2)
+	queue, err := newUploadQueue(bm.config.StateDir, backupName, backupPath, destPath, manifest)
+	if err != nil {
+		return err
+	}
+	queued = true
 
-	// Google Drive upload
-	if bm.gdrive != nil {
-		go func() {
-			result := BackupResult{Timestamp: time.Now()}
-			err := bm.gdrive.UploadFolder(ctx, destPath, backupName)
-			if err != nil {
-				result.Error = err
-				result.Message = "Google Drive upload failed"
-				log.Printf("Google Drive upload failed: %v", err)
-			} else {
-				result.Success = true
-				result.Message = "Google Drive upload successful"
-				log.Printf("Successfully uploaded to Google Drive")
-			}
-			results <- result
-		}()
-	} else {
-		results <- BackupResult{
-			Success:   false,
-			Message:   "Google Drive not configured",
-			Timestamp: time.Now(),
+	return bm.upload(ctx, queue, manifest, false)
+}
+
+// uploadQueued uploads a staged backup to every provider that doesn't have it
+// yet. manifest is the full manifest of the backup, which becomes the
+// incremental baseline. When ctx is cancelled the queue and staged files are
+// kept, so the upload resumes on the next run; otherwise both are removed.
+func (bm *BackupManager) uploadQueued(ctx context.Context, queue *uploadQueue, manifest *Manifest, resuming bool) error {
+	bm.stages.add(queue.StagePath)
+	defer bm.stages.remove(queue.StagePath)
+
+	defer func() {
+		if ctx.Err() != nil {
+			log.Printf("Upload of %s interrupted, it will resume with the next backup", queue.BackupName)
+			return
 		}
+		if err := queue.remove(); err != nil {
+			log.Printf("Warning: Failed to remove upload queue: %v", err)
+		}
+		// The stage of an upload as the run_as user is root's to remove
+		if !bm.handedOff {
+			bm.cleanup(queue.StagePath)
+		}
+	}()
+
+	// Checkpoints follow the manifest being uploaded, which may be a delta
+	staged, err := loadManifest(filepath.Join(queue.UploadPath, manifestFileName))
+	if err != nil {
+		return fmt.Errorf("failed to load staged manifest: %w", err)
 	}
 
-	// pCloud upload
-	if bm.pcloud != nil {
-		go func() {
-			result := BackupResult{Timestamp: time.Now()}
-			err := bm.pcloud.UploadFolder(ctx, destPath, backupName)
-			if err != nil {
-				result.Error = err
-				result.Message = "pCloud upload failed"
-				log.Printf("pCloud upload failed: %v", err)
-			} else {
-				result.Success = true
-				result.Message = "pCloud upload successful"
-				log.Printf("Successfully uploaded to pCloud")
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	// Under the any and fallback policies one copy is a complete backup
+	var all []BackupResult
+	required := 1
+	switch bm.config.FanOut {
+	case fanOutAny:
+		// One healthy provider is enough; prefer one that already has it
+		providers = bm.fanOutOrder(providers)
+		target := providers[0]
+		for _, p := range providers {
+			if queue.complete(p.Name()) {
+				target = p
+				break
 			}
-			results <- result
-		}()
-	} else {
-		results <- BackupResult{
-			Success:   false,
-			Message:   "pCloud not configured",
-			Timestamp: time.Now(),
+		}
+		if !queue.complete(target.Name()) {
+			for _, p := range providers {
+				if state, _ := healthOf(p); state != healthDown && bm.breaker(p.Name()).Allow(time.Now()) {
+					target = p
+					break
+				}
+			}
+		}
+		all = append(all, bm.uploadTo(ctx, target, queue, staged, resuming))
+
+	case fanOutFallback:
+		// The next provider only gets the backup if the ones before it failed
+		providers = bm.fanOutOrder(providers)
+		for _, p := range providers {
+			result := bm.uploadTo(ctx, p, queue, staged, resuming)
+			all = append(all, result)
+			if result.Success || ctx.Err() != nil {
+				break
+			}
+		}
+
+	default:
+		// Upload to cloud drives in parallel; a striped backup is only
+		// complete with every provider's share
+		required = len(providers)
+		results := make(chan BackupResult, len(providers))
+		for _, p := range providers {
+			go func(p Provider) {
+				results <- bm.uploadTo(ctx, p, queue, staged, resuming)
+			}(p)
+		}
+		for range providers {
+			all = append(all, <-results)
 		}
 	}
 
-	// Wait for both uploads to complete
 	successCount := 0
-	for i := 0; i < 2; i++ {
-		result := <-results
+	for _, result := range all {
 		if result.Success {
 			successCount++
 		}
@@ -137,80 +434,534 @@ func (bm *BackupManager) RunBackup(ctx context.Context) error {
 		}
 	}
 
+	summary := bm.runSummary(manifest, all)
+	switch {
+	case successCount == 0:
+		summary.Status = runFailed
+	case successCount < required:
+		summary.Status = runPartial
+	}
+
+	// Interrupted runs are resumed and recorded later
+	if ctx.Err() == nil {
+		bm.recordRun(newRunRecord(summary, resuming))
+	}
+
+	// A summary template replaces the built-in completion message
+	if bm.summary != nil {
+		log.Printf("%s", renderTemplate(bm.summary, summary, ""))
+	}
+
+	if ctx.Err() != nil {
+		return &partialError{"interrupted, the upload resumes with the next run"}
+	}
 	if successCount == 0 {
 		return fmt.Errorf("all uploads failed")
 	}
 
-	log.Printf("Backup completed successfully (%d/2 uploads succeeded)", successCount)
+	// Only advance the incremental baseline once every provider has the backup
+	if successCount == required {
+		if err := saveManifest(manifest, lastManifestPath(bm.config.StateDir)); err != nil {
+			log.Printf("Warning: Failed to save manifest: %v", err)
+		}
+	}
+
+	if successCount < required {
+		if bm.summary == nil {
+			log.Printf("Backup incomplete (%d/%d uploads succeeded)", successCount, len(all))
+		}
+		return &partialError{fmt.Sprintf("%d of %d uploads succeeded", successCount, required)}
+	}
+
+	if bm.summary == nil {
+		log.Printf("Backup completed successfully (%d/%d uploads succeeded)", successCount, len(all))
+	}
 	return nil
 }
 
+// uploadTo uploads a queued backup to one provider unless it already has it
+// or its circuit breaker is open
+func (bm *BackupManager) uploadTo(ctx context.Context, p Provider, queue *uploadQueue, staged *Manifest, resuming bool) BackupResult {
+	if queue.complete(p.Name()) {
+		return BackupResult{
+			Provider:  p.Name(),
+			Success:   true,
+			Message:   providerLabel(p.Name()) + " upload already complete",
+			Timestamp: time.Now(),
+		}
+	}
+
+	cb := bm.breaker(p.Name())
+	if !cb.Allow(time.Now()) {
+		log.Printf("Skipping %s until %s after repeated failures", providerLabel(p.Name()), cb.OpenUntil().Format(time.RFC1123))
+		return BackupResult{
+			Provider:  p.Name(),
+			Message:   providerLabel(p.Name()) + " skipped by circuit breaker",
+			Timestamp: time.Now(),
+		}
+	}
+
+	// Another machine writing the same backup doesn't count as a failure of
+	// the provider
+	lock, err := bm.acquireLock(ctx, p, queue.BackupName)
+	if err != nil {
+		log.Printf("%s upload failed: %v", providerLabel(p.Name()), err)
+		return BackupResult{
+			Provider:  p.Name(),
+			Message:   providerLabel(p.Name()) + " upload failed",
+			Error:     err,
+			Timestamp: time.Now(),
+		}
+	}
+	defer lock.Release()
+
+	progress, err := queue.progress(p.Name(), resuming)
+	if err != nil {
+		log.Printf("%s upload failed: %v", providerLabel(p.Name()), err)
+		return BackupResult{
+			Provider:  p.Name(),
+			Message:   providerLabel(p.Name()) + " upload failed",
+			Error:     err,
+			Timestamp: time.Now(),
+		}
+	}
+	defer progress.Close()
+
+	// The manifest goes last, replacing any checkpoint, so a backup with a
+	// complete manifest is a complete backup. The readme describing it goes
+	// with it.
+	progress.exclude(manifestFileName)
+	progress.exclude(readmeFileName)
+	for _, entry := range staged.Files {
+		if entry.Provider != "" && entry.Provider != p.Name() {
+			progress.exclude(entry.storedPath())
+		}
+	}
+	progress.track(staged, p.Name())
+
+	// A provider stuck on one backup gives up on it after timeouts.run, so
+	// the others queued behind it still get their turn
+	uploadCtx := ctx
+	run := bm.config.runTimeout(p.Name())
+	if run > 0 {
+		var cancel context.CancelFunc
+		uploadCtx, cancel = context.WithTimeout(ctx, run)
+		defer cancel()
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		bm.checkpoints(uploadCtx, p, queue, staged, progress, stop)
+	}()
+
+	result := BackupResult{Provider: p.Name(), Timestamp: time.Now()}
+	if bm.config.UploadOrder != "" || len(bm.config.PriorityPaths) > 0 {
+		err = bm.uploadOrdered(uploadCtx, p, queue, staged, progress)
+	} else {
+		err = p.UploadFolder(uploadCtx, queue.UploadPath, queue.BackupName, progress)
+	}
+	close(stop)
+	<-stopped
+	if err == nil && uploadCtx.Err() == nil {
+		final := []string{manifestFileName}
+		// Queues of older versions have no readme
+		if _, statErr := os.Stat(filepath.Join(queue.UploadPath, readmeFileName)); statErr == nil {
+			final = []string{readmeFileName, manifestFileName}
+		}
+		err = p.UploadFiles(uploadCtx, queue.UploadPath, queue.BackupName, final)
+	}
+	if ctx.Err() == nil && uploadCtx.Err() != nil {
+		err = fmt.Errorf("upload exceeded timeouts.run of %s", run)
+		bm.finalCheckpoint(ctx, p, queue, staged, progress)
+	}
+	result.Rate = progress.rate()
+	if ctx.Err() != nil {
+		// A shutdown says nothing about the provider's health
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			bm.finalCheckpoint(ctx, p, queue, staged, progress)
+		}
+	} else {
+		cb.Record(err)
+	}
+	if err == nil {
+		if markErr := queue.markComplete(p.Name()); markErr != nil {
+			log.Printf("Warning: Failed to update upload queue: %v", markErr)
+		}
+	}
+	if err != nil {
+		result.Error = err
+		result.Message = providerLabel(p.Name()) + " upload failed"
+		log.Printf("%s upload failed: %v", providerLabel(p.Name()), err)
+	} else {
+		result.Success = true
+		result.Message = providerLabel(p.Name()) + " upload successful"
+		log.Printf("Successfully uploaded to %s", providerLabel(p.Name()))
+	}
+	return result
+}
+
+// resumeUploads continues the queued uploads of earlier runs, oldest first.
+// Queues whose staged files are gone, e.g. after a reboot cleared the temp
+// directory, are dropped.
+func (bm *BackupManager) resumeUploads(ctx context.Context) {
+	if bm.config.DryRun {
+		return
+	}
+
+	queues, err := loadUploadQueues(bm.config.StateDir)
+	if err != nil {
+		log.Printf("Warning: Failed to load upload queue: %v", err)
+		return
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].CreatedAt.Before(queues[j].CreatedAt)
+	})
+
+	for _, queue := range queues {
+		if ctx.Err() != nil {
+			return
+		}
+
+		manifest, err := queue.manifest()
+		if err == nil {
+			_, err = os.Stat(queue.UploadPath)
+		}
+		if err != nil {
+			log.Printf("Warning: Dropping interrupted upload of %s, staged files are gone: %v", queue.BackupName, err)
+			if err := queue.remove(); err != nil {
+				log.Printf("Warning: Failed to remove upload queue: %v", err)
+			}
+			bm.cleanup(queue.StagePath)
+			continue
+		}
+
+		log.Printf("Resuming interrupted upload of %s", queue.BackupName)
+		if err := bm.upload(ctx, queue, manifest, true); err != nil {
+			log.Printf("Resumed upload of %s failed: %v", queue.BackupName, err)
+		}
+	}
+}
+
 func (bm *BackupManager) StartScheduler(ctx context.Context) error {
 	log.Printf("Starting scheduler with interval: %v", bm.config.BackupInterval)
 
 	ticker := time.NewTicker(bm.config.BackupInterval)
 	defer ticker.Stop()
 
+	// Runs due outside the backup windows or during a blackout are deferred
+	// until backups are allowed again; any number of missed ticks collapse
+	// into one catch-up run
+	var deferred <-chan time.Time
+	deferRun := func(now time.Time) {
+		if b := activeBlackout(now, bm.blackouts); b != nil {
+			reason := b.reason
+			if reason == "" {
+				reason = "no reason given"
+			}
+			log.Printf("Skipping scheduled backup during blackout until %s (%s)", b.end.Format(time.RFC1123), reason)
+		}
+		if deferred != nil {
+			return
+		}
+		start := bm.NextBackupTime(now)
+		log.Printf("Backups not allowed now, deferring backup to %s", start.Format(time.RFC1123))
+		deferred = time.After(start.Sub(now))
+	}
+
+	if now := bm.now(); !bm.BackupAllowed(now) {
+		deferRun(now)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Scheduler stopped")
 			return ctx.Err()
 		case <-ticker.C:
+			if now := bm.now(); !bm.BackupAllowed(now) {
+				deferRun(now)
+				continue
+			}
 			if err := bm.RunBackup(ctx); err != nil {
 				log.Printf("Scheduled backup failed: %v", err)
 			}
+		case <-deferred:
+			deferred = nil
+			if now := bm.now(); !bm.BackupAllowed(now) {
+				deferRun(now)
+				continue
+			}
+			if err := bm.RunBackup(ctx); err != nil {
+				log.Printf("Deferred backup failed: %v", err)
+			}
 		}
 	}
 }
 
-// copyDirectory recursively copies a directory using standard library
-func (bm *BackupManager) copyDirectory(src, dst string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// BackupAllowed reports whether backups may run at t: inside a backup window
+// and outside any blackout
+func (bm *BackupManager) BackupAllowed(t time.Time) bool {
+	return inWindows(t, bm.windows) && activeBlackout(t, bm.blackouts) == nil
+}
+
+// NextBackupTime returns the earliest time from t on at which backups are
+// allowed
+func (bm *BackupManager) NextBackupTime(t time.Time) time.Time {
+	// Windows and blackouts can push each other out, but only a few times
+	for i := 0; i < len(bm.blackouts)+2; i++ {
+		t = nextWindowStart(t, bm.windows)
+		b := activeBlackout(t, bm.blackouts)
+		if b == nil {
+			return t
 		}
+		t = b.end
+	}
+	return t
+}
+
+// stageDirectory recursively copies a directory and returns the manifest of
+// the copied tree. Files unchanged since the previous manifest are recorded
+// but not copied, and directories are then only created as needed. Staging
+// fails once the copied files exceed limit bytes, unless limit is negative.
+func (bm *BackupManager) stageDirectory(src, dst, backupName string, previous *Manifest, limit int64) (*Manifest, error) {
+	manifest := &Manifest{
+		BackupName: backupName,
+		CreatedAt:  bm.now(),
+	}
+
+	var unchanged, messages map[string]ManifestEntry
+	if previous != nil {
+		unchanged = previous.index()
+		if bm.config.Maildir {
+			messages = maildirMessages(previous)
+		}
+	}
+
+	filter := bm.newSourceFilter(src)
+	var staged int64
 
+	// Stored paths by content, for dedup
+	contents := make(map[string]string)
+	var duplicates int
+	var saved int64
+
+	err := walkTree(src, bm.walkers(src), func(path string, info os.FileInfo, walkErr error) error {
 		// Calculate relative path
 		relPath, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
 
-		dstPath := filepath.Join(dst, relPath)
+		if walkErr != nil {
+			return bm.skipMovedMessage(filepath.ToSlash(relPath), walkErr)
+		}
+
+		// Files are staged under the names they are stored with
+		stored := escapePath(filepath.ToSlash(relPath))
+		dstPath := filepath.Join(dst, filepath.FromSlash(stored))
 
 		if info.IsDir() {
+			if filter.skipDir(path, info) {
+				return filepath.SkipDir
+			}
+			// Messages in a maildir's tmp are still being delivered
+			if bm.config.Maildir && info.Name() == "tmp" && isMaildir(filepath.Dir(path)) {
+				if previous == nil && !bm.config.Media {
+					if err := os.MkdirAll(dstPath, info.Mode()); err != nil {
+						return err
+					}
+				}
+				return filepath.SkipDir
+			}
+			// Media mode stores files in other folders than the source has
+			if previous != nil || bm.config.Media {
+				return nil
+			}
 			return os.MkdirAll(dstPath, info.Mode())
 		}
+		if filter.skipFile(path) {
+			return nil
+		}
+
+		if kind := specialFileKind(info.Mode()); kind != "" {
+			return bm.skipSpecialFile(filepath.ToSlash(relPath), kind)
+		}
+
+		entry := ManifestEntry{
+			Path:    filepath.ToSlash(relPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Backup:  backupName,
+		}
+		if stored != entry.Path {
+			entry.Stored = stored
+		}
+
+		if old, ok := unchanged[entry.Path]; ok && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+			entry.Backup = old.Backup
+			entry.Checksum = old.Checksum
+			entry.Encoding = old.Encoding
+			entry.Stored = old.Stored
+			entry.Copy = old.Copy
+			manifest.Files = append(manifest.Files, entry)
+			return nil
+		}
+
+		// A maildir message renamed by the mail client keeps its content
+		if key, ok := maildirKey(entry.Path); ok {
+			if old, ok := messages[key]; ok && old.Size == entry.Size {
+				entry.Backup = old.Backup
+				entry.Checksum = old.Checksum
+				entry.Encoding = old.Encoding
+				entry.Stored = old.storedPath()
+				entry.Copy = old.Copy
+				manifest.Files = append(manifest.Files, entry)
+				return nil
+			}
+		}
 
-		return bm.copyFile(path, dstPath, info.Mode())
+		if bm.config.Media {
+			if media := mediaStoredPath(path, stored, info.ModTime()); media != "" {
+				entry.Stored = media
+				dstPath = filepath.Join(dst, filepath.FromSlash(media))
+			}
+		}
+
+		if staged += info.Size(); limit >= 0 && staged > limit {
+			return fmt.Errorf("staging needs more than the %s left under temp_quota", formatBytes(limit))
+		}
+
+		stages := bm.pipeline(path, info.Size())
+		if entry.Checksum, err = bm.copyFile(path, dstPath, info.Mode(), stages, bm.config.Checksum); err != nil {
+			return bm.skipMovedMessage(entry.Path, err)
+		}
+		entry.Encoding = pipelineEncoding(stages)
+
+		// Identical files are uploaded once; the others point to the first
+		if bm.config.Dedup || bm.config.Media {
+			key := fmt.Sprintf("%s %d %s", entry.Checksum, entry.Size, entry.Encoding)
+			if stored, ok := contents[key]; ok {
+				if err := os.Remove(dstPath); err != nil {
+					return err
+				}
+				entry.Stored = stored
+				entry.Copy = true
+				duplicates++
+				saved += entry.Size
+			} else {
+				contents[key] = entry.storedPath()
+			}
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if duplicates > 0 {
+		log.Printf("Deduplicated %d files (%s)", duplicates, formatBytes(saved))
+	}
+
+	// The destination must exist even when nothing changed
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// specialFileKind describes files that have no content to back up, such as
+// named pipes and device nodes, and returns "" for anything else. Zero-byte
+// regular files are backed up like any other file.
+func specialFileKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
+// skipSpecialFile reports a special file and skips it, or fails the backup in
+// strict mode
+func (bm *BackupManager) skipSpecialFile(relPath, kind string) error {
+	if bm.config.Strict {
+		return fmt.Errorf("cannot back up %s %s", kind, relPath)
+	}
+
+	log.Printf("Warning: Skipping %s %s", kind, relPath)
+	return nil
+}
+
+// skipMovedMessage skips a maildir message that the mail client moved or
+// deleted while it was being staged, and returns any other error
+func (bm *BackupManager) skipMovedMessage(relPath string, err error) error {
+	if _, ok := maildirKey(relPath); !ok || !bm.config.Maildir || !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("Skipping message %s, it was moved during the backup", relPath)
+	return nil
 }
 
-// copyFile copies a single file using standard library
-func (bm *BackupManager) copyFile(src, dst string, mode os.FileMode) error {
+// copyFile copies a single file using standard library, passing it through
+// the transform stages, and returns the checksum of its original content with
+// the algorithm, computed on the way so the source is read once
+func (bm *BackupManager) copyFile(src, dst string, mode os.FileMode, stages []string, algorithm string) (string, error) {
 	srcFile, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer srcFile.Close()
 
 	// Create destination directory if needed
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
+		return "", err
+	}
+
+	// On copy-on-write filesystems an untransformed file is cloned, which
+	// takes no time or space. The checksum is taken from the clone, which
+	// can't change under us like the source can.
+	if len(stages) == 0 {
+		if err := cloneFile(src, dst); err == nil {
+			checksum, err := fileChecksum(dst, algorithm)
+			if err != nil {
+				return "", err
+			}
+			return checksum, os.Chmod(dst, mode)
+		}
 	}
 
 	dstFile, err := os.Create(dst)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return err
+	w, closeStages, err := encodeStages(dstFile, stages)
+	if err != nil {
+		return "", err
+	}
+	h := newChecksum(algorithm)
+	if _, err := io.Copy(io.MultiWriter(w, h), srcFile); err != nil {
+		closeStages()
+		return "", err
+	}
+	if err := closeStages(); err != nil {
+		return "", err
 	}
 
-	return os.Chmod(dst, mode)
+	return formatChecksum(algorithm, h), os.Chmod(dst, mode)
 }
 
 func (bm *BackupManager) cleanup(path string) {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// runBootstrap sets up a replacement machine from the providers: it pulls the
+// config if there is none, restores the most recent backup of every job into
+// its source folder and makes that backup the incremental baseline, so the
+// next run only uploads what changed since.
+func runBootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	var flags Config
+	fs.StringVar(&flags.ConfigFile, "config", "datavault.json", "Configuration file path, pulled from the providers if missing")
+	fs.StringVar(&flags.GoogleDriveAuth, "gdrive-auth", "", "Google Drive authentication JSON file path")
+	fs.StringVar(&flags.PCloudAuth, "pcloud-auth", "", "pCloud authentication token")
+	fs.StringVar(&flags.RemoteRoot, "remote-root", "", "Root folder on the providers (default: from the config, or DataVault)")
+	fs.BoolVar(&flags.Verbose, "verbose", false, "Enable verbose logging")
+	provider := fs.String("provider", "", "Download from this provider (gdrive or pcloud)")
+	job := fs.String("job", "", "Only bootstrap this job")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the config passphrase (default: $"+passphraseEnv+")")
+	force := fs.Bool("force", false, "Restore into source folders that are not empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if flags.PCloudAuth == "" {
+		flags.PCloudAuth = os.Getenv(pcloudAuthEnv)
+	}
+	flags.BackupInterval = time.Hour
+	ctx := context.Background()
+
+	if _, err := os.Stat(flags.ConfigFile); os.IsNotExist(err) {
+		passphrase, err := configPassphrase(*passphraseFile)
+		if err != nil {
+			return fmt.Errorf("%s does not exist and must be pulled: %w", flags.ConfigFile, err)
+		}
+
+		pull := flags
+		if pull.RemoteRoot == "" {
+			pull.RemoteRoot = defaultRemoteRoot
+		}
+		pull.Provider = *provider
+		data, from, err := pullConfig(ctx, NewBackupManager(pull).providers(), passphrase)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(flags.ConfigFile, data, 0600); err != nil {
+			return fmt.Errorf("failed to write config file: %w", err)
+		}
+		fmt.Printf("Pulled %s from %s\n", flags.ConfigFile, providerLabel(from))
+	}
+
+	configFile, err := LoadConfig(flags.ConfigFile)
+	if err != nil {
+		return err
+	}
+	config := MergeConfigWithFlags(configFile, flags)
+
+	configs := []Config{config}
+	switch {
+	case *job != "":
+		c, err := FindJobConfig(configFile, config, *job)
+		if err != nil {
+			return err
+		}
+		configs = []Config{c}
+	case len(configFile.Jobs) > 0:
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	managers := NewJobManagers(configs, 1)
+	failed := 0
+	for _, bm := range managers {
+		if err := bm.Bootstrap(ctx, *provider, *force); err != nil {
+			fmt.Printf("%s: %v\n", bm.jobName(), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed to bootstrap", failed, len(managers))
+	}
+	return nil
+}
+
+// Bootstrap restores the most recent complete backup of the job into its
+// source folder and saves its manifest as the incremental baseline
+func (bm *BackupManager) Bootstrap(ctx context.Context, providerName string, force bool) error {
+	p, err := bm.provider(providerName)
+	if err != nil {
+		return err
+	}
+
+	target := bm.sourceFolder(bm.now())
+	if _, ok := remoteSource(target); ok {
+		return fmt.Errorf("can't restore into the remote source folder %s", target)
+	}
+	if !force {
+		if entries, err := os.ReadDir(target); err == nil && len(entries) > 0 {
+			return fmt.Errorf("%s is not empty, use -force to restore into it", target)
+		}
+	}
+
+	manifest, err := bm.latestManifest(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	restored, err := bm.RestoreBackup(ctx, manifest.BackupName, p.Name(), target, collisionRename)
+	if err != nil {
+		return err
+	}
+
+	if err := saveManifest(manifest, lastManifestPath(bm.config.StateDir)); err != nil {
+		return err
+	}
+
+	log.Printf("Restored %d files of %s to %s; the next incremental backup continues from it", restored, manifest.BackupName, target)
+	return nil
+}
+
+// latestManifest returns the full manifest of the newest backup on p that was
+// made by this job and completely uploaded
+func (bm *BackupManager) latestManifest(ctx context.Context, p Provider) (*Manifest, error) {
+	backups, err := p.ListBackups(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+
+	listings := make(map[string]map[string]RemoteFile)
+	for _, backup := range backups {
+		manifest, err := bm.remoteManifest(ctx, p, backup.Name, listings)
+		if err != nil {
+			log.Printf("Warning: Skipping %s: %v", backup.Name, err)
+			continue
+		}
+		if manifest == nil || manifest.Partial {
+			continue
+		}
+		// Backups without info predate jobs and belong to the top-level job
+		job := ""
+		if manifest.Info != nil {
+			job = manifest.Info.Config.Job
+		}
+		if job != bm.config.Job {
+			continue
+		}
+		return manifest, nil
+	}
+
+	return nil, fmt.Errorf("no complete backup of this job on %s", providerLabel(p.Name()))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 3
+	defaultBreakerCooldown = time.Hour
+)
+
+// circuitBreaker skips a provider after repeated consecutive failures, so a
+// dead provider doesn't slow down every run with timeouts. After the
+// cool-down one attempt is let through; another failure trips it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	provider  string
+	threshold int
+	cooldown  time.Duration
+	alerts    *alerter // Told when the breaker opens and closes again
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(provider string, threshold int, cooldown time.Duration, alerts *alerter) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerFailures
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &circuitBreaker{
+		provider:  provider,
+		threshold: threshold,
+		cooldown:  cooldown,
+		alerts:    alerts,
+	}
+}
+
+// Allow reports whether the provider may be used at now
+func (cb *circuitBreaker) Allow(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return !now.Before(cb.openUntil)
+}
+
+// Record updates the breaker with the outcome of an operation
+func (cb *circuitBreaker) Record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		if cb.failures >= cb.threshold {
+			log.Printf("%s recovered, circuit breaker closed", providerLabel(cb.provider))
+			cb.alerts.Send("DataVault: "+providerLabel(cb.provider)+" recovered",
+				fmt.Sprintf("DataVault: %s is working again and no longer skipped", providerLabel(cb.provider)))
+		}
+		cb.failures = 0
+		cb.openUntil = time.Time{}
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		log.Printf("Warning: %s failed %d times in a row, skipping it until %s",
+			providerLabel(cb.provider), cb.failures, cb.openUntil.Format(time.RFC1123))
+		// Failed attempts after the cool-down keep it open, that is no news
+		if cb.failures == cb.threshold {
+			cb.alerts.Send("DataVault: "+providerLabel(cb.provider)+" skipped",
+				fmt.Sprintf("DataVault: %s failed %d times in a row and is skipped until it works again, next attempt after %s",
+					providerLabel(cb.provider), cb.failures, cb.openUntil.Format(time.RFC1123)))
+		}
+	}
+}
+
+// OpenUntil returns when the breaker lets attempts through again; the zero
+// time if it is closed
+func (cb *circuitBreaker) OpenUntil() time.Time {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.openUntil
+}
+
+// breaker returns the circuit breaker of a provider, shared by all jobs
+func (bm *BackupManager) breaker(provider string) *circuitBreaker {
+	bm.breakersMu.Lock()
+	defer bm.breakersMu.Unlock()
+
+	cb, ok := bm.breakers[provider]
+	if !ok {
+		cb = newCircuitBreaker(provider, bm.config.BreakerFailures, bm.config.BreakerCooldown, bm.alerts)
+		bm.breakers[provider] = cb
+	}
+	return cb
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+func runCatalog(args []string) error {
+	if len(args) == 0 || args[0] != "vacuum" {
+		return fmt.Errorf("usage: datavault catalog vacuum [OPTIONS]")
+	}
+
+	fs := flag.NewFlagSet("catalog vacuum", flag.ExitOnError)
+	config, configFile, _, err := loadCommandConfig(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	configs := []Config{config}
+	if config.Job == "" && len(configFile.Jobs) > 0 {
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range configs {
+		job := config.Job
+		if job == "" {
+			job = "default"
+		}
+		if err := vacuumState(job, config); err != nil {
+			return fmt.Errorf("job %s: %w", job, err)
+		}
+	}
+
+	return nil
+}
+
+// vacuumState applies the history retention to a job's run history and
+// removes upload queues whose staged files are gone
+func vacuumState(job string, config Config) error {
+	path := historyPath(config.StateDir)
+	var before int64
+	if info, err := os.Stat(path); err == nil {
+		before = info.Size()
+	}
+
+	records, err := loadHistory(config.StateDir, time.Time{})
+	if err != nil {
+		return err
+	}
+	kept := pruneHistory(records, time.Now(), config.HistoryRetention, config.HistoryMaxSize)
+	if len(records) > 0 {
+		if err := writeHistory(config.StateDir, kept); err != nil {
+			return err
+		}
+	}
+
+	var after int64
+	if info, err := os.Stat(path); err == nil {
+		after = info.Size()
+	}
+
+	queues, err := loadUploadQueues(config.StateDir)
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, queue := range queues {
+		if _, err := os.Stat(queue.UploadPath); err == nil {
+			continue
+		}
+		if err := queue.remove(); err != nil {
+			log.Printf("Warning: Failed to remove upload queue: %v", err)
+			continue
+		}
+		dropped++
+	}
+
+	fmt.Printf("%s: kept %d of %d runs (%s, was %s), removed %d stale upload queues\n",
+		job, len(kept), len(records), formatBytes(after), formatBytes(before), dropped)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosEnv names the environment variable that turns on fault injection in the
+// provider clients, e.g. DATAVAULT_CHAOS=latency=500ms,fail=0.1,truncate=0.05.
+// It is meant for exercising retries, resumed uploads and circuit breakers.
+const chaosEnv = "DATAVAULT_CHAOS"
+
+// chaosConfig describes the faults injected into provider requests
+type chaosConfig struct {
+	Latency  time.Duration // Added before every request, up to this long
+	Fail     float64       // Share of requests answered with HTTP 503
+	Drop     float64       // Share of requests failing with a connection error
+	Truncate float64       // Share of responses cut off partway through the body
+}
+
+// parseChaos parses a comma-separated list of key=value faults
+func parseChaos(spec string) (chaosConfig, error) {
+	var config chaosConfig
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return config, fmt.Errorf("invalid fault %q: must be key=value", field)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			config.Latency, err = time.ParseDuration(value)
+		case "fail":
+			config.Fail, err = parseShare(value)
+		case "drop":
+			config.Drop, err = parseShare(value)
+		case "truncate":
+			config.Truncate, err = parseShare(value)
+		default:
+			return config, fmt.Errorf("unknown fault %q: must be latency, fail, drop or truncate", key)
+		}
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return config, nil
+}
+
+// parseShare parses a probability between 0 and 1
+func parseShare(s string) (float64, error) {
+	share, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if share < 0 || share > 1 {
+		return 0, fmt.Errorf("%s is not between 0 and 1", s)
+	}
+	return share, nil
+}
+
+var (
+	chaosOnce   sync.Once
+	chaosFaults *chaosConfig // Nil without fault injection
+)
+
+// loadChaos reads the faults from the environment once
+func loadChaos() *chaosConfig {
+	chaosOnce.Do(func() {
+		spec := os.Getenv(chaosEnv)
+		if spec == "" {
+			return
+		}
+		config, err := parseChaos(spec)
+		if err != nil {
+			log.Printf("Warning: Ignoring %s: %v", chaosEnv, err)
+			return
+		}
+		log.Printf("Warning: Injecting faults into provider requests: %s", spec)
+		chaosFaults = &config
+	})
+	return chaosFaults
+}
+
+// chaosTransport returns base, or http.DefaultTransport if base is nil,
+// wrapped with the faults configured in the environment
+func chaosTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	config := loadChaos()
+	if config == nil {
+		return base
+	}
+	return &faultyTransport{base: base, config: *config}
+}
+
+// faultyTransport injects faults into the requests it sends
+type faultyTransport struct {
+	base   http.RoundTripper
+	config chaosConfig
+}
+
+func (t *faultyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.config.Latency > 0 {
+		select {
+		case <-time.After(rand.N(t.config.Latency)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if rand.Float64() < t.config.Drop {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("injected fault: connection reset")
+	}
+
+	if rand.Float64() < t.config.Fail {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("injected fault")),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || rand.Float64() >= t.config.Truncate {
+		return resp, err
+	}
+
+	// Cut the body somewhere in its first half, or its first 4 KiB if the
+	// length is unknown
+	limit := int64(4096)
+	if resp.ContentLength > 0 {
+		limit = resp.ContentLength / 2
+	}
+	resp.Body = &truncatedBody{ReadCloser: resp.Body, left: rand.Int64N(limit + 1)}
+	return resp, nil
+}
+
+// truncatedBody fails with io.ErrUnexpectedEOF after left bytes
+type truncatedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// checkTimeout bounds how long a provider may take to list its backups
+// before check counts it as unhealthy
+const checkTimeout = time.Minute
+
+// runCheck prints the health of every job and provider in the form of a
+// monitoring plugin and fails if the last complete backup of a job is older
+// than -max-age or a provider is unhealthy, e.g. "datavault check -max-age 26h"
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	maxAge := fs.Duration("max-age", 26*time.Hour, "Oldest acceptable age of a job's last complete backup")
+	offline := fs.Bool("offline", false, "Only check the run history, without contacting the providers")
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	configs := []Config{config}
+	if config.Job == "" && len(configFile.Jobs) > 0 {
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	problems := 0
+	report := func(ok bool, format string, args ...any) {
+		status := "OK"
+		if !ok {
+			status = "CRITICAL"
+			problems++
+		}
+		fmt.Printf("%s: %s\n", status, fmt.Sprintf(format, args...))
+	}
+
+	now := time.Now()
+	checked := make(map[string]bool)
+	for _, config := range configs {
+		job := config.Job
+		if job == "" {
+			job = "default"
+		}
+
+		records, err := loadHistory(config.StateDir, time.Time{})
+		if err != nil {
+			return fmt.Errorf("job %s: %w", job, err)
+		}
+
+		if last := lastCompleteRun(records); last != nil {
+			age := now.Sub(last.Time).Round(time.Minute)
+			report(age <= *maxAge, "job %s: last complete backup %s is %s old", job, last.Backup, age)
+		} else {
+			report(false, "job %s has no complete backup", job)
+		}
+
+		// The latest run shows whether uploads to each provider still work
+		if len(records) > 0 {
+			latest := records[len(records)-1]
+			for name, errText := range latest.Providers {
+				if errText != "" {
+					report(false, "job %s: last upload to %s failed: %s", job, providerLabel(name), errText)
+				}
+			}
+		}
+
+		if *offline {
+			continue
+		}
+		for _, p := range NewBackupManager(config).providers() {
+			if checked[p.Name()] {
+				continue
+			}
+			checked[p.Name()] = true
+
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			backups, err := p.ListBackups(ctx)
+			cancel()
+			if err != nil {
+				report(false, "%s is unreachable: %v", providerLabel(p.Name()), err)
+				continue
+			}
+			report(true, "%s holds %d backups", providerLabel(p.Name()), len(backups))
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	return nil
+}
+
+// lastCompleteRun returns the newest run that reached every provider it
+// should have, or nil. Records written before runs had a status count as
+// complete if no provider failed.
+func lastCompleteRun(records []runRecord) *runRecord {
+	for i := len(records) - 1; i >= 0; i-- {
+		record := &records[i]
+		switch record.Status {
+		case runSucceeded:
+			return record
+		case "":
+			complete := len(record.Providers) > 0
+			for _, errText := range record.Providers {
+				if errText != "" {
+					complete = false
+				}
+			}
+			if complete {
+				return record
+			}
+		}
+	}
+	return nil
+}
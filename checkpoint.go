@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// defaultCheckpointInterval is how often a long upload publishes the manifest
+// of the files that reached the provider so far
+const defaultCheckpointInterval = time.Hour
+
+// checkpoints uploads a partial manifest to p every checkpoint interval until
+// stop is closed. The partial manifest stands in for the final one, so a
+// backup whose machine never comes back still tells which files made it.
+func (bm *BackupManager) checkpoints(ctx context.Context, p Provider, queue *uploadQueue, manifest *Manifest, progress UploadProgress, stop <-chan struct{}) {
+	if bm.config.CheckpointInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(bm.config.CheckpointInterval)
+	defer ticker.Stop()
+
+	dir := filepath.Join(queue.dir, p.Name()+".checkpoint")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := bm.uploadCheckpoint(ctx, p, dir, manifest, progress); err != nil {
+				log.Printf("Warning: Failed to upload checkpoint to %s: %v", providerLabel(p.Name()), err)
+			}
+		}
+	}
+}
+
+// finalCheckpointTimeout bounds the checkpoint uploaded when max_runtime
+// stops an upload
+const finalCheckpointTimeout = 5 * time.Minute
+
+// finalCheckpoint uploads a partial manifest to p after max_runtime stopped
+// the upload, so the backup shows how far it got until the next run resumes
+// it
+func (bm *BackupManager) finalCheckpoint(ctx context.Context, p Provider, queue *uploadQueue, manifest *Manifest, progress UploadProgress) {
+	if bm.config.CheckpointInterval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalCheckpointTimeout)
+	defer cancel()
+
+	dir := filepath.Join(queue.dir, p.Name()+".checkpoint")
+	if err := bm.uploadCheckpoint(ctx, p, dir, manifest, progress); err != nil {
+		log.Printf("Warning: Failed to upload checkpoint to %s: %v", providerLabel(p.Name()), err)
+	}
+}
+
+func (bm *BackupManager) uploadCheckpoint(ctx context.Context, p Provider, dir string, manifest *Manifest, progress UploadProgress) error {
+	checkpoint := &Manifest{
+		BackupName: manifest.BackupName,
+		CreatedAt:  manifest.CreatedAt,
+		Partial:    true,
+		Base:       manifest.Base,
+		Chain:      manifest.Chain,
+		Removed:    manifest.Removed,
+		Tags:       manifest.Tags,
+		Comment:    manifest.Comment,
+		Info:       manifest.Info,
+	}
+
+	// Files kept in older backups are usable already
+	for _, entry := range manifest.Files {
+		if entry.Backup != manifest.BackupName || progress.Done(entry.storedPath()) {
+			checkpoint.Files = append(checkpoint.Files, entry)
+		}
+	}
+
+	if err := saveManifest(checkpoint, filepath.Join(dir, manifestFileName)); err != nil {
+		return err
+	}
+
+	if err := p.UploadFiles(ctx, dir, manifest.BackupName, []string{manifestFileName}); err != nil {
+		return err
+	}
+
+	log.Printf("Uploaded checkpoint of %s to %s (%d of %d files)",
+		manifest.BackupName, providerLabel(p.Name()), len(checkpoint.Files), len(manifest.Files))
+	return nil
+}
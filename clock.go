@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockEnv names the environment variable that replaces the clock backups
+// are named and scheduled by, e.g. DATAVAULT_CLOCK=2024-06-01T02:00:00Z,1m
+// starts at that time and advances a minute with each reading. Tests, replays
+// and simulations then get the same backup names on every run.
+const clockEnv = "DATAVAULT_CLOCK"
+
+// steppedClock returns start on its first reading and advances by step on
+// each following one, regardless of how much time passed
+type steppedClock struct {
+	mu   sync.Mutex
+	next time.Time
+	step time.Duration
+}
+
+func (c *steppedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.next
+	c.next = c.next.Add(c.step)
+	return now
+}
+
+// parseClockSpec parses a start time in RFC 3339 format, optionally followed by
+// a comma and the step
+func parseClockSpec(spec string) (*steppedClock, error) {
+	startText, stepText, hasStep := strings.Cut(spec, ",")
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(startText))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start time: %w", err)
+	}
+
+	clock := &steppedClock{next: start}
+	if hasStep {
+		if clock.step, err = time.ParseDuration(strings.TrimSpace(stepText)); err != nil || clock.step < 0 {
+			return nil, fmt.Errorf("invalid step %q", stepText)
+		}
+	}
+	return clock, nil
+}
+
+var (
+	clockOnce sync.Once
+	clockNow  = time.Now
+)
+
+// loadClock returns the clock configured in the environment, or time.Now.
+// The environment is read once, so all jobs share one clock.
+func loadClock() func() time.Time {
+	clockOnce.Do(func() {
+		spec := os.Getenv(clockEnv)
+		if spec == "" {
+			return
+		}
+		clock, err := parseClockSpec(spec)
+		if err != nil {
+			log.Printf("Warning: Ignoring %s: %v", clockEnv, err)
+			return
+		}
+		log.Printf("Warning: Using a simulated clock starting at %s", clock.next.Format(time.RFC3339))
+		clockNow = clock.Now
+	})
+	return clockNow
+}
@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// cloneFile makes dst a clone of src on APFS, so both share their blocks
+// until one is modified
+func cloneFile(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// cloneFile is not available on this platform, so staging always copies
+func cloneFile(src, dst string) error {
+	return errors.New("file cloning not supported")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// command is a subcommand invoked as "datavault <name> [args]"
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands = []command{
+	{"backup", "Make a named backup now, outside the schedule", runSnapshot},
+	{"usage", "Show backup storage usage and cost estimates", runUsage},
+	{"share", "Create a time-limited share link for a backup", runShare},
+	{"export", "Export a backup to a local zip or tar.zst archive", runExport},
+	{"restore", "Restore a backup into a local directory", runRestore},
+	{"restore-script", "Write a standalone restore script for a backup", runRestoreScript},
+	{"bootstrap", "Set up a new machine from its latest backups and config copy", runBootstrap},
+	{"list", "List backups on each cloud drive", runList},
+	{"inspect", "Show the transforms the files of a backup went through", runInspect},
+	{"serve", "Serve a read-only JSON API over backups and their files", runServe},
+	{"tag", "Add or remove tags of a backup", runTag},
+	{"comment", "Set the comment of a backup", runComment},
+	{"check", "Check backup age and provider health for monitoring", runCheck},
+	{"status", "Show the progress of pending and running uploads", runStatus},
+	{"audit", "Check that every provider has the same backups", runAudit},
+	{"report", "Summarize recent backups of every job", runReport},
+	{"support-bundle", "Collect diagnostics into an archive to attach to an issue", runSupportBundle},
+	{"catalog", "Compact the local run history (catalog vacuum)", runCatalog},
+	{"conformance", "Check that a provider behaves as backups expect", runConformance},
+	{"config", "Read or change config keys, or sync the config with a provider", runConfig},
+	{"repair", "Merge duplicate DataVault root folders", runRepair},
+	{"adopt", "Use an existing remote folder as the incremental baseline", runAdopt},
+	{"upgrade-backup", "Rewrite backups made by older versions in the current format", runUpgradeBackup},
+	{"upload-queued", "Upload a staged backup; started by backups as the run_as user", runUploadQueued},
+}
+
+// runCommand dispatches to a subcommand if args names one. It reports
+// whether a subcommand was found.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return true, cmd.run(args[1:])
+		}
+	}
+
+	return false, nil
+}
+
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.description)
+	}
+}
+
+// loadCommandConfig registers the flags shared by all subcommands, parses args
+// and returns the configuration merged from flags and the config file along
+// with the positional arguments. Flags may appear before or after positionals.
+func loadCommandConfig(fs *flag.FlagSet, args []string) (Config, *ConfigFile, []string, error) {
+	var config Config
+
+	fs.StringVar(&config.SourceFolder, "source", "", "Source folder to backup")
+	fs.StringVar(&config.ConfigFile, "config", "datavault.json", "Configuration file path")
+	fs.StringVar(&config.GoogleDriveAuth, "gdrive-auth", "", "Google Drive authentication JSON file path")
+	fs.StringVar(&config.PCloudAuth, "pcloud-auth", "", "pCloud authentication token")
+	fs.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
+	fs.BoolVar(&config.Restricted, "restricted", false, "Only write to the staging and state directories and writable_dirs")
+	job := fs.String("job", "", "Use the settings of this job from the config file")
+	config.BackupInterval = time.Hour
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return config, nil, nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if config.Restricted {
+		restrictWrites()
+	}
+
+	configFile, err := LoadConfig(config.ConfigFile)
+	if err != nil {
+		return config, nil, nil, err
+	}
+
+	config = MergeConfigWithFlags(configFile, config)
+	if *job != "" {
+		if config, err = FindJobConfig(configFile, config, *job); err != nil {
+			return config, nil, nil, err
+		}
+	}
+	if config.Restricted {
+		allowConfigWrites(config)
+	}
+
+	return config, configFile, positional, nil
+}
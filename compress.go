@@ -0,0 +1,39 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// encodingGzip marks manifest entries whose stored content is gzip-compressed
+const encodingGzip = "gzip"
+
+// minCompressSize keeps tiny files, which gzip can't shrink, uncompressed
+const minCompressSize = 1024
+
+// compressibleExtensions are text formats that shrink well with gzip
+var compressibleExtensions = map[string]bool{
+	".txt": true, ".log": true, ".md": true, ".csv": true, ".tsv": true,
+	".json": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true,
+	".ini": true, ".conf": true, ".sql": true, ".html": true, ".htm": true,
+	".css": true, ".js": true, ".ts": true, ".svg": true, ".go": true,
+	".py": true, ".rb": true, ".java": true, ".c": true, ".h": true,
+	".cpp": true, ".rs": true, ".sh": true,
+}
+
+// gzipTransform compresses text files, which are the files gzip shrinks
+type gzipTransform struct{}
+
+func (gzipTransform) applies(path string, size int64) bool {
+	return size >= minCompressSize && compressibleExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+func (gzipTransform) encode(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipTransform) decode(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
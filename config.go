@@ -3,19 +3,205 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"time"
 )
 
 type ConfigFile struct {
-	SourceFolder    string   `json:"source_folder"`
-	BackupInterval  string   `json:"backup_interval"` // e.g., "1h", "30m", "2h30m"
-	GoogleDriveAuth string   `json:"google_drive_auth"`
-	PCloudAuth      string   `json:"pcloud_auth"`
-	Excludes        []string `json:"excludes,omitempty"`
-	DryRun          bool     `json:"dry_run,omitempty"`
-	Verbose         bool     `json:"verbose,omitempty"`
-	MaxBackups      int      `json:"max_backups,omitempty"` // Max number of backups to keep
+	ConfigVersion      int                   `json:"config_version,omitempty"` // Schema version, older ones are migrated on load
+	Include            []string              `json:"include,omitempty"`        // Glob patterns of drop-in files, relative to this file
+	SourceFolder       string                `json:"source_folder"`
+	BackupInterval     string                `json:"backup_interval"` // e.g., "1h", "30m", "2h30m"
+	GoogleDriveAuth    string                `json:"google_drive_auth"`
+	GoogleDriveScope   string                `json:"gdrive_scope,omitempty"` // Google Drive access: file (default) or full
+	PCloudAuth         string                `json:"pcloud_auth"`
+	Excludes           []string              `json:"excludes,omitempty"`
+	ExcludePresets     []string              `json:"exclude_presets,omitempty"` // Built-in exclude lists, e.g. "os-junk"
+	DryRun             bool                  `json:"dry_run,omitempty"`
+	Verbose            bool                  `json:"verbose,omitempty"`
+	MaxBackups         int                   `json:"max_backups,omitempty"` // Max number of backups to keep
+	Incremental        bool                  `json:"incremental,omitempty"` // Only upload files changed since the last backup
+	StateDir           string                `json:"state_dir,omitempty"`   // Local state such as the last manifest (default: ~/.datavault)
+	Watch              bool                  `json:"watch,omitempty"`       // Upload changes as they happen between scheduled backups
+	WatchOptions       *WatchOptions         `json:"watch_options,omitempty"`
+	BackupWindows      []TimeWindow          `json:"backup_windows,omitempty"`      // When backups may run; any time if empty
+	Blackouts          []Blackout            `json:"blackouts,omitempty"`           // Periods during which scheduled backups are skipped
+	RemoteRoot         string                `json:"remote_root,omitempty"`         // Root folder on the providers (default: "DataVault")
+	FanOut             string                `json:"fan_out,omitempty"`             // all, any or fallback (default: "all")
+	PrimaryProvider    string                `json:"primary_provider,omitempty"`    // Tried first under the any and fallback policies
+	StripeWeights      map[string]float64    `json:"stripe_weights,omitempty"`      // Share of each provider under the stripe policy
+	UploadOrder        string                `json:"upload_order,omitempty"`        // smallest, largest or changed (default: directory order)
+	PriorityPaths      []string              `json:"priority_paths,omitempty"`      // Paths below the source uploaded first, e.g. "Documents"
+	BackupName         string                `json:"backup_name,omitempty"`         // Backup folder name template
+	Tags               []string              `json:"tags,omitempty"`                // Attached to every backup, for list and restore -tag
+	CompressText       bool                  `json:"compress_text,omitempty"`       // Store text files gzip-compressed to upload less
+	Transforms         []string              `json:"transforms,omitempty"`          // Stages each file goes through before upload, in order, e.g. ["gzip"]
+	Checksum           string                `json:"checksum,omitempty"`            // Manifest checksum algorithm: sha256, blake3 or xxh64 (default: "sha256")
+	Dedup              bool                  `json:"dedup,omitempty"`               // Upload identical files of a backup once
+	Media              bool                  `json:"media,omitempty"`               // Store photos and videos by year and month taken, deduplicated
+	Maildir            bool                  `json:"maildir,omitempty"`             // Handle maildir folders message by message
+	Gitignore          bool                  `json:"gitignore,omitempty"`           // Skip what .gitignore files in the source ignore
+	CheckpointInterval string                `json:"checkpoint_interval,omitempty"` // How often long uploads publish a partial manifest (default: "1h", "0" disables)
+	TempQuota          string                `json:"temp_quota,omitempty"`          // Size limit of the staging directory, e.g. "20GB"
+	UploadSpeed        string                `json:"upload_speed,omitempty"`        // Upstream bandwidth per second, e.g. "5MB", for upload estimates
+	TempMaxAge         string                `json:"temp_max_age,omitempty"`        // Age of leftovers removed from the staging directory on startup (default: "24h", "0" disables)
+	MaxRuntime         string                `json:"max_runtime,omitempty"`         // Longest a backup run may take before it stops and resumes with the next run, e.g. "6h"
+	HistoryRetention   string                `json:"history_retention,omitempty"`   // How long run records are kept (default: "2160h", "0" keeps all)
+	HistoryMaxSize     string                `json:"history_max_size,omitempty"`    // Size limit of the run history per job (default: "10MB", "0" is unlimited)
+	CircuitBreaker     *BreakerConfig        `json:"circuit_breaker,omitempty"`
+	Timeouts           *TimeoutsConfig       `json:"timeouts,omitempty"`
+	Network            *NetworkConfig        `json:"network,omitempty"`
+	SSH                *SSHConfig            `json:"ssh,omitempty"`
+	Endpoints          map[string]string     `json:"endpoints,omitempty"`           // API base URLs keyed by provider
+	MaxDepth           int                   `json:"max_depth,omitempty"`           // Deepest directory level below the source to back up (default: unlimited)
+	OneFileSystem      bool                  `json:"one_file_system,omitempty"`     // Don't descend into other mounted filesystems
+	Strict             bool                  `json:"strict,omitempty"`              // Fail on FIFOs, sockets and devices instead of skipping them
+	AllowEmptySource   bool                  `json:"allow_empty_source,omitempty"`  // Back up empty or unmounted source folders
+	ForceSource        bool                  `json:"force_source,omitempty"`        // Back up a filesystem root or the home directory
+	MountRetries       int                   `json:"mount_retries,omitempty"`       // Attempts to reach an unavailable network share (default: 3, -1 disables)
+	WalkParallelism    int                   `json:"walk_parallelism,omitempty"`    // Directories read at the same time (default: 1, 16 on network shares)
+	RunAs              string                `json:"run_as,omitempty"`              // User that uploads run as when started as root
+	WritableDirs       []string              `json:"writable_dirs,omitempty"`       // Writable in restricted mode besides staging and state
+	Jobs               map[string]*JobConfig `json:"jobs,omitempty"`                // Named jobs with their own source and schedule
+	MaxConcurrentJobs  int                   `json:"max_concurrent_jobs,omitempty"` // Jobs backing up at the same time (default: 1)
+	Templates          *TemplateConfig       `json:"templates,omitempty"`
+	Notifications      *NotifyConfig         `json:"notifications,omitempty"`
+	Cost               *CostConfig           `json:"cost,omitempty"`
+}
+
+// BreakerConfig controls when a failing provider is skipped
+type BreakerConfig struct {
+	Failures int    `json:"failures,omitempty"` // Consecutive failures that trip the breaker (default: 3)
+	Cooldown string `json:"cooldown,omitempty"` // How long the provider is skipped (default: "1h")
+}
+
+// TimeoutsConfig limits how long each provider may take
+type TimeoutsConfig struct {
+	GoogleDrive *TimeoutConfig `json:"gdrive,omitempty"`
+	PCloud      *TimeoutConfig `json:"pcloud,omitempty"`
+}
+
+// TimeoutConfig limits how long a provider may take, as durations such as
+// "2h"; "0" is unlimited
+type TimeoutConfig struct {
+	Request string `json:"request,omitempty"` // Each API call other than a file transfer (default: "30s")
+	File    string `json:"file,omitempty"`    // Each file upload or download (default: unlimited)
+	Run     string `json:"run,omitempty"`     // Uploading one backup (default: unlimited)
+
+	// A file transfer slower than min_speed, e.g. "16KB" a second, for the
+	// stall duration is aborted and retried on a new connection
+	MinSpeed string `json:"min_speed,omitempty"` // Default: no stall detection
+	Stall    string `json:"stall,omitempty"`     // Default: "60s"
+}
+
+// providerTimeouts parses the timeouts of one provider, falling back to the
+// defaults for missing or invalid values
+func (tc *TimeoutConfig) providerTimeouts(provider string) providerTimeouts {
+	timeouts := providerTimeouts{Request: defaultRequestTimeout, Stall: defaultStallWindow}
+	if tc == nil {
+		return timeouts
+	}
+
+	for _, field := range []struct {
+		key   string
+		value string
+		dst   *time.Duration
+	}{
+		{"request", tc.Request, &timeouts.Request},
+		{"file", tc.File, &timeouts.File},
+		{"run", tc.Run, &timeouts.Run},
+	} {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			log.Printf("Warning: Ignoring timeouts.%s.%s: %v", provider, field.key, err)
+			continue
+		}
+		*field.dst = d
+	}
+
+	if tc.MinSpeed != "" {
+		speed, err := parseBytes(tc.MinSpeed)
+		if err != nil {
+			log.Printf("Warning: Ignoring timeouts.%s.min_speed: %v", provider, err)
+		} else {
+			timeouts.MinSpeed = speed
+		}
+	}
+	if tc.Stall != "" {
+		if d, err := time.ParseDuration(tc.Stall); err != nil || d <= 0 {
+			log.Printf("Warning: Ignoring timeouts.%s.stall: invalid duration %q", provider, tc.Stall)
+		} else {
+			timeouts.Stall = d
+		}
+	}
+	return timeouts
+}
+
+// NetworkConfig changes how provider hosts are reached, for networks with
+// broken IPv6 or split-horizon DNS
+type NetworkConfig struct {
+	IPVersion string            `json:"ip_version,omitempty"` // "4" or "6" to only connect over that protocol
+	Hosts     map[string]string `json:"hosts,omitempty"`      // IP addresses to use for host names, e.g. "api.pcloud.com"
+	Resolver  string            `json:"resolver,omitempty"`   // DNS server to look up hosts with, e.g. "1.1.1.1"
+}
+
+// SSHConfig sets how remote sources ("sftp://user@host/path") are reached
+type SSHConfig struct {
+	KeyFile    string `json:"key_file,omitempty"`    // Private key to log in with (default: the SSH agent and ~/.ssh/id_*)
+	KnownHosts string `json:"known_hosts,omitempty"` // Host keys to trust (default: ~/.ssh/known_hosts)
+}
+
+// TemplateConfig names Go template files that replace built-in messages
+type TemplateConfig struct {
+	Notification string `json:"notification,omitempty"` // Text of each notification event
+	Summary      string `json:"summary,omitempty"`      // Message logged at the end of each backup run
+}
+
+// NotifyConfig controls notifications about failing backups
+type NotifyConfig struct {
+	DigestInterval string          `json:"digest_interval,omitempty"` // How often repeated failures are summed up (default: "24h")
+	RateLimit      string          `json:"rate_limit,omitempty"`      // Minimum time between messages per channel (default: "15m")
+	ReportInterval string          `json:"report_interval,omitempty"` // How often a summary report is sent, e.g. "168h" (default: never)
+	Channels       []ChannelConfig `json:"channels,omitempty"`
+}
+
+// ChannelConfig configures one notification channel
+type ChannelConfig struct {
+	Type      string   `json:"type"`                 // webhook, slack, email or desktop
+	RateLimit string   `json:"rate_limit,omitempty"` // Overrides the rate limit for this channel
+	URL       string   `json:"url,omitempty"`        // webhook and slack
+	SMTPHost  string   `json:"smtp_host,omitempty"`  // email
+	SMTPPort  int      `json:"smtp_port,omitempty"`  // email (default: 587)
+	Username  string   `json:"username,omitempty"`   // email
+	Password  string   `json:"password,omitempty"`   // email
+	From      string   `json:"from,omitempty"`       // email
+	To        []string `json:"to,omitempty"`         // email
+}
+
+// WatchOptions tunes how watch mode batches changes
+type WatchOptions struct {
+	Debounce    string `json:"debounce,omitempty"`     // Quiet period before uploading, e.g. "5s"
+	MinInterval string `json:"min_interval,omitempty"` // Minimum time between uploads, e.g. "15m"
+	MaxBatch    int    `json:"max_batch,omitempty"`    // Max paths per upload; a full batch skips the quiet period
+}
+
+// CostConfig holds the pricing tables used by "datavault usage --cost"
+type CostConfig struct {
+	RestoresPerMonth float64                    `json:"restores_per_month,omitempty"` // Full restores assumed per month for egress
+	Providers        map[string]ProviderPricing `json:"providers,omitempty"`          // Keyed by provider: "gdrive", "pcloud"
+}
+
+type ProviderPricing struct {
+	StoragePerGBMonth float64 `json:"storage_per_gb_month"`
+	EgressPerGB       float64 `json:"egress_per_gb"`
 }
 
 func LoadConfig(configPath string) (*ConfigFile, error) {
@@ -28,15 +214,83 @@ func LoadConfig(configPath string) (*ConfigFile, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	// Old files are only migrated in memory, so reading the config never
+	// changes it
+	data, version, err := migrateConfig(data, 1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	if version < currentConfigVersion {
+		log.Printf("Config file %s is version %d, run \"datavault config migrate\" to update it to version %d",
+			configPath, version, currentConfigVersion)
+	}
+
 	var config ConfigFile
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := loadIncludes(&config, filepath.Dir(configPath), version); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// loadIncludes decodes each included file over config, in pattern order and
+// then alphabetically. Fields set in an include override earlier values,
+// while maps such as jobs are merged key by key. Includes do not nest.
+// Includes are migrated in memory like the main file; those without
+// config_version are taken to be of version, the main file's.
+func loadIncludes(config *ConfigFile, baseDir string, version int) error {
+	patterns := config.Include
+
+	includes, err := includedFiles(patterns, baseDir)
+	if err != nil {
+		return err
+	}
+	for _, include := range includes {
+		data, err := os.ReadFile(include)
+		if err != nil {
+			return fmt.Errorf("failed to read included config %s: %w", include, err)
+		}
+		if data, _, err = migrateConfig(data, version); err != nil {
+			return fmt.Errorf("included config %s: %w", include, err)
+		}
+
+		if err := json.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("failed to parse included config %s: %w", include, err)
+		}
+	}
+
+	config.Include = patterns
+	return nil
+}
+
+// includedFiles returns the files matched by the include patterns, in the
+// order they are applied
+func includedFiles(patterns []string, baseDir string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %s: %w", pattern, err)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
 func SaveConfig(config *ConfigFile, configPath string) error {
+	if err := checkWritable(configPath); err != nil {
+		return err
+	}
+
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
@@ -51,20 +305,15 @@ func SaveConfig(config *ConfigFile, configPath string) error {
 
 func createDefaultConfig(configPath string) (*ConfigFile, error) {
 	config := &ConfigFile{
+		ConfigVersion:   currentConfigVersion,
 		SourceFolder:    "",
 		BackupInterval:  "1h",
 		GoogleDriveAuth: "",
 		PCloudAuth:      "",
-		Excludes: []string{
-			".git",
-			".DS_Store",
-			"Thumbs.db",
-			"*.tmp",
-			"*.log",
-		},
-		DryRun:     false,
-		Verbose:    false,
-		MaxBackups: 30, // Keep last 30 backups
+		ExcludePresets:  []string{"os-junk"},
+		DryRun:          false,
+		Verbose:         false,
+		MaxBackups:      30, // Keep last 30 backups
 	}
 
 	if err := SaveConfig(config, configPath); err != nil {
@@ -89,9 +338,19 @@ func MergeConfigWithFlags(config *ConfigFile, flags Config) Config {
 		result.GoogleDriveAuth = config.GoogleDriveAuth
 	}
 
+	if result.GoogleDriveScope == "" {
+		result.GoogleDriveScope = config.GoogleDriveScope
+	}
+	if result.GoogleDriveScope == "" {
+		result.GoogleDriveScope = gdriveScopeFile
+	}
+
 	if result.PCloudAuth == "" && config.PCloudAuth != "" {
 		result.PCloudAuth = config.PCloudAuth
 	}
+	if result.PCloudAuth == "" {
+		result.PCloudAuth = os.Getenv(pcloudAuthEnv)
+	}
 
 	// Parse backup interval from config if not set via flag
 	if result.BackupInterval == time.Hour && config.BackupInterval != "" {
@@ -109,6 +368,236 @@ func MergeConfigWithFlags(config *ConfigFile, flags Config) Config {
 		result.Verbose = config.Verbose
 	}
 
+	if result.MaxBackups == 0 {
+		result.MaxBackups = config.MaxBackups
+	}
+
+	if len(result.Excludes) == 0 {
+		result.Excludes = config.Excludes
+	}
+	if len(result.ExcludePresets) == 0 {
+		result.ExcludePresets = config.ExcludePresets
+	}
+
+	if !flags.Incremental && config.Incremental {
+		result.Incremental = config.Incremental
+	}
+
+	if !flags.Watch && config.Watch {
+		result.Watch = config.Watch
+	}
+
+	if config.WatchOptions != nil {
+		if debounce, err := time.ParseDuration(config.WatchOptions.Debounce); err == nil {
+			result.WatchDebounce = debounce
+		}
+		if interval, err := time.ParseDuration(config.WatchOptions.MinInterval); err == nil {
+			result.WatchMinInterval = interval
+		}
+		result.WatchMaxBatch = config.WatchOptions.MaxBatch
+	}
+	if result.WatchDebounce <= 0 {
+		result.WatchDebounce = defaultWatchDebounce
+	}
+
+	if len(result.BackupWindows) == 0 {
+		result.BackupWindows = config.BackupWindows
+	}
+
+	if len(result.Blackouts) == 0 {
+		result.Blackouts = config.Blackouts
+	}
+
+	if result.RemoteRoot == "" {
+		result.RemoteRoot = config.RemoteRoot
+	}
+	if result.RemoteRoot == "" {
+		result.RemoteRoot = defaultRemoteRoot
+	}
+
+	if result.FanOut == "" {
+		result.FanOut = config.FanOut
+	}
+	if result.FanOut == "" {
+		result.FanOut = fanOutAll
+	}
+	if result.PrimaryProvider == "" {
+		result.PrimaryProvider = config.PrimaryProvider
+	}
+	if len(result.StripeWeights) == 0 {
+		result.StripeWeights = config.StripeWeights
+	}
+
+	if result.UploadOrder == "" {
+		result.UploadOrder = config.UploadOrder
+	}
+	if len(result.PriorityPaths) == 0 {
+		result.PriorityPaths = config.PriorityPaths
+	}
+
+	if result.BackupName == "" {
+		result.BackupName = config.BackupName
+	}
+
+	if len(result.Tags) == 0 {
+		result.Tags = config.Tags
+	}
+
+	if quota, err := parseBytes(config.TempQuota); err == nil {
+		result.TempQuota = quota
+	} else if config.TempQuota != "" {
+		log.Printf("Warning: Ignoring temp_quota: %v", err)
+	}
+
+	if speed, err := parseBytes(config.UploadSpeed); err == nil {
+		result.UploadSpeed = speed
+	} else if config.UploadSpeed != "" {
+		log.Printf("Warning: Ignoring upload_speed: %v", err)
+	}
+
+	if runtime, err := time.ParseDuration(config.MaxRuntime); err == nil {
+		result.MaxRuntime = runtime
+	} else if config.MaxRuntime != "" {
+		log.Printf("Warning: Ignoring max_runtime: %v", err)
+	}
+
+	result.TempMaxAge = defaultTempMaxAge
+	if age, err := time.ParseDuration(config.TempMaxAge); err == nil {
+		result.TempMaxAge = age
+	}
+
+	result.HistoryRetention = defaultHistoryRetention
+	if retention, err := time.ParseDuration(config.HistoryRetention); err == nil {
+		result.HistoryRetention = retention
+	}
+	result.HistoryMaxSize = defaultHistoryMaxSize
+	if size, err := parseBytes(config.HistoryMaxSize); err == nil {
+		result.HistoryMaxSize = size
+	} else if config.HistoryMaxSize != "" {
+		log.Printf("Warning: Ignoring history_max_size: %v", err)
+	}
+
+	result.CheckpointInterval = defaultCheckpointInterval
+	if interval, err := time.ParseDuration(config.CheckpointInterval); err == nil {
+		result.CheckpointInterval = interval
+	}
+
+	if config.Network != nil {
+		result.Network = *config.Network
+	}
+	if config.SSH != nil {
+		result.SSH = *config.SSH
+	}
+	if len(config.Endpoints) > 0 {
+		result.Endpoints = config.Endpoints
+	}
+
+	var timeouts TimeoutsConfig
+	if config.Timeouts != nil {
+		timeouts = *config.Timeouts
+	}
+	result.DriveTimeouts = timeouts.GoogleDrive.providerTimeouts("gdrive")
+	result.PCloudTimeouts = timeouts.PCloud.providerTimeouts("pcloud")
+
+	if config.CircuitBreaker != nil {
+		result.BreakerFailures = config.CircuitBreaker.Failures
+		if cooldown, err := time.ParseDuration(config.CircuitBreaker.Cooldown); err == nil {
+			result.BreakerCooldown = cooldown
+		}
+	}
+
+	if result.MaxDepth == 0 {
+		result.MaxDepth = config.MaxDepth
+	}
+
+	if !flags.OneFileSystem && config.OneFileSystem {
+		result.OneFileSystem = config.OneFileSystem
+	}
+
+	if !flags.CompressText && config.CompressText {
+		result.CompressText = config.CompressText
+	}
+	if len(result.Transforms) == 0 {
+		result.Transforms = config.Transforms
+	}
+	if result.Checksum == "" {
+		result.Checksum = config.Checksum
+	}
+	if result.Checksum == "" {
+		result.Checksum = defaultChecksum
+	}
+	if !flags.Dedup && config.Dedup {
+		result.Dedup = config.Dedup
+	}
+	if !flags.Media && config.Media {
+		result.Media = config.Media
+	}
+	if !flags.Maildir && config.Maildir {
+		result.Maildir = config.Maildir
+	}
+	if !flags.Gitignore && config.Gitignore {
+		result.Gitignore = config.Gitignore
+	}
+
+	if !flags.Strict && config.Strict {
+		result.Strict = config.Strict
+	}
+
+	if !flags.AllowEmptySource && config.AllowEmptySource {
+		result.AllowEmptySource = config.AllowEmptySource
+	}
+
+	if !flags.ForceSource && config.ForceSource {
+		result.ForceSource = config.ForceSource
+	}
+	if result.MountRetries == 0 {
+		result.MountRetries = config.MountRetries
+	}
+	if result.WalkParallelism == 0 {
+		result.WalkParallelism = config.WalkParallelism
+	}
+	if result.RunAs == "" {
+		result.RunAs = config.RunAs
+	}
+	if len(result.WritableDirs) == 0 {
+		result.WritableDirs = config.WritableDirs
+	}
+
+	result.NotifyDigest = defaultDigestInterval
+	result.NotifyRateLimit = defaultNotifyRate
+	if config.Notifications != nil {
+		result.NotifyChannels = config.Notifications.Channels
+		if interval, err := time.ParseDuration(config.Notifications.DigestInterval); err == nil && interval > 0 {
+			result.NotifyDigest = interval
+		}
+		if limit, err := time.ParseDuration(config.Notifications.RateLimit); err == nil {
+			result.NotifyRateLimit = limit
+		}
+		if interval, err := time.ParseDuration(config.Notifications.ReportInterval); err == nil {
+			result.ReportInterval = interval
+		}
+	}
+
+	if config.Templates != nil {
+		result.NotifyTemplate = config.Templates.Notification
+		result.SummaryTemplate = config.Templates.Summary
+	}
+
+	if result.MaxConcurrentJobs == 0 {
+		result.MaxConcurrentJobs = config.MaxConcurrentJobs
+	}
+
+	if result.StateDir == "" {
+		result.StateDir = config.StateDir
+	}
+	if result.StateDir == "" {
+		result.StateDir = defaultStateDir()
+	}
+	// Trial runs must not become the baseline of real backups
+	if result.Provider == "fake" {
+		result.StateDir = filepath.Join(result.StateDir, "fake")
+	}
+
 	return result
 }
 
@@ -117,11 +606,68 @@ func ValidateConfig(config Config) error {
 		return fmt.Errorf("source folder must be specified")
 	}
 
-	if _, err := os.Stat(config.SourceFolder); os.IsNotExist(err) {
-		return fmt.Errorf("source folder does not exist: %s", config.SourceFolder)
+	if err := validateTemplate("source_folder", config.SourceFolder); err != nil {
+		return err
+	}
+
+	source := expandTemplate(config.SourceFolder, config.Job, time.Now())
+	if _, ok := remoteSource(source); ok {
+		// Watch mode needs change events of a local folder
+		if config.Watch {
+			return fmt.Errorf("watch mode can't be used with a remote source folder")
+		}
+	} else {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			return fmt.Errorf("source folder does not exist: %s", source)
+		}
+		if err := checkSourceRoot(source, config.ForceSource); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRemoteRootTemplate(config.RemoteRoot); err != nil {
+		return err
 	}
 
-	if config.GoogleDriveAuth == "" && config.PCloudAuth == "" {
+	if config.BackupName != "" {
+		if err := validateBackupNameTemplate(config.BackupName); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range config.Tags {
+		if err := validateTag(tag); err != nil {
+			return err
+		}
+	}
+
+	if err := validateNetwork(config.Network); err != nil {
+		return err
+	}
+	for name, endpoint := range config.Endpoints {
+		if name != "gdrive" && name != "pcloud" {
+			return fmt.Errorf("invalid endpoint provider %q: must be gdrive or pcloud", name)
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid %s endpoint %q: must be an http or https URL", name, endpoint)
+		}
+	}
+
+	switch config.Provider {
+	case "", "fake":
+	case "gdrive":
+		if config.GoogleDriveAuth == "" {
+			return fmt.Errorf("provider gdrive needs Google Drive authentication")
+		}
+	case "pcloud":
+		if config.PCloudAuth == "" {
+			return fmt.Errorf("provider pcloud needs pCloud authentication")
+		}
+	default:
+		return fmt.Errorf("invalid provider %q: must be gdrive, pcloud or fake", config.Provider)
+	}
+
+	if config.GoogleDriveAuth == "" && config.PCloudAuth == "" && config.Provider != "fake" && !config.Simulate {
 		return fmt.Errorf("at least one cloud storage authentication must be configured")
 	}
 
@@ -131,9 +677,124 @@ func ValidateConfig(config Config) error {
 		}
 	}
 
+	switch config.GoogleDriveScope {
+	case gdriveScopeFile, gdriveScopeFull:
+	default:
+		return fmt.Errorf("invalid gdrive_scope %q: must be %s or %s", config.GoogleDriveScope, gdriveScopeFile, gdriveScopeFull)
+	}
+
+	if config.RunAs != "" {
+		if _, err := lookupRunAs(config.RunAs); err != nil {
+			return fmt.Errorf("invalid run_as: %w", err)
+		}
+		// Watch mode uploads from the daemon itself
+		if config.Watch {
+			return fmt.Errorf("run_as can't be combined with watch mode")
+		}
+	}
+
+	switch config.FanOut {
+	case fanOutAll:
+	case fanOutAny, fanOutFallback, fanOutStripe:
+		// Incremental backups and watch mode refer to older backups, which
+		// may be on another provider
+		if config.Incremental || config.Watch {
+			return fmt.Errorf("fan_out %s can't be combined with incremental backups or watch mode", config.FanOut)
+		}
+	default:
+		return fmt.Errorf("invalid fan_out %q: must be all, any, fallback or stripe", config.FanOut)
+	}
+
+	for name, weight := range config.StripeWeights {
+		if name != "gdrive" && name != "pcloud" {
+			return fmt.Errorf("invalid stripe_weights provider %q: must be gdrive or pcloud", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("stripe_weights of %s must not be negative", name)
+		}
+	}
+
+	switch config.PrimaryProvider {
+	case "", "gdrive", "pcloud":
+	default:
+		return fmt.Errorf("invalid primary_provider %q: must be gdrive or pcloud", config.PrimaryProvider)
+	}
+
+	for _, name := range config.Providers {
+		switch {
+		case name != "gdrive" && name != "pcloud":
+			return fmt.Errorf("invalid providers entry %q: must be gdrive or pcloud", name)
+		case config.Provider == "fake" || config.Simulate:
+		case name == "gdrive" && config.GoogleDriveAuth == "", name == "pcloud" && config.PCloudAuth == "":
+			return fmt.Errorf("providers lists %s, which has no authentication configured", name)
+		}
+	}
+
+	switch config.UploadOrder {
+	case "", orderSmallest, orderLargest, orderChanged:
+	default:
+		return fmt.Errorf("invalid upload_order %q: must be smallest, largest or changed", config.UploadOrder)
+	}
+
+	if err := validateExcludePresets(config.ExcludePresets); err != nil {
+		return err
+	}
+
+	if err := validateTransforms(config.Transforms); err != nil {
+		return err
+	}
+
+	if _, ok := checksumAlgorithms[config.Checksum]; !ok {
+		return fmt.Errorf("invalid checksum %q: must be sha256, blake3 or xxh64", config.Checksum)
+	}
+	// Dedup stores one copy of files with the same checksum, which a 64-bit
+	// hash can't be trusted to tell apart
+	if config.Checksum == "xxh64" && (config.Dedup || config.Media) {
+		return fmt.Errorf("checksum xxh64 cannot be combined with dedup or media, use blake3")
+	}
+
+	// Watch mode replaces files of the last backup, which duplicates may
+	// point to
+	if (config.Dedup || config.Media) && config.Watch {
+		return fmt.Errorf("dedup and media cannot be combined with watch")
+	}
+
+	for _, pattern := range config.PriorityPaths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid priority_paths pattern %q: %w", pattern, err)
+		}
+	}
+
+	if config.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative")
+	}
+	if config.WalkParallelism < 0 {
+		return fmt.Errorf("walk_parallelism must not be negative")
+	}
+
 	if config.BackupInterval < time.Minute {
 		return fmt.Errorf("backup interval must be at least 1 minute")
 	}
 
+	if _, err := parseWindows(config.BackupWindows); err != nil {
+		return err
+	}
+
+	if _, err := parseBlackouts(config.Blackouts); err != nil {
+		return err
+	}
+
+	for _, path := range []string{config.NotifyTemplate, config.SummaryTemplate} {
+		if _, err := loadTemplate(path); err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+	}
+
+	for _, channel := range config.NotifyChannels {
+		if _, err := newNotifier(channel); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
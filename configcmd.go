@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// runConfig reads or changes one key of the config file, e.g.
+// "datavault config set jobs.docs.backup_interval 30m". Keys are the JSON
+// field names joined with dots; map entries such as jobs are addressed by
+// their key.
+func runConfig(args []string) error {
+	usage := fmt.Errorf("usage: datavault config get <key> | set <key> <value> | migrate | push | pull [OPTIONS]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "push":
+		return runConfigPush(args[1:])
+	case "pull":
+		return runConfigPull(args[1:])
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", "datavault.json", "Configuration file path")
+	force := fs.Bool("force", false, "Save the value even if the resulting configuration is invalid")
+
+	var positional []string
+	rest := args[1:]
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	switch {
+	case args[0] == "get" && len(positional) == 1:
+		return configGet(*configPath, positional[0])
+	case args[0] == "set" && len(positional) == 2:
+		return configSet(*configPath, positional[0], positional[1], *force)
+	case args[0] == "migrate" && len(positional) == 0:
+		return runConfigMigrate(*configPath)
+	}
+	return usage
+}
+
+// configGet prints the value of key with includes applied. Strings are
+// printed as-is, anything else as JSON.
+func configGet(configPath, key string) error {
+	path := strings.Split(key, ".")
+	if _, err := configKeyType(path); err != nil {
+		return err
+	}
+
+	configFile, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(configFile)
+	if err != nil {
+		return err
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	for _, name := range path {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s is not set", key)
+		}
+		if value, ok = m[name]; !ok {
+			return fmt.Errorf("%s is not set", key)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		fmt.Println(s)
+		return nil
+	}
+	out, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// configSet sets key in the config file to value and saves it unless the
+// resulting configuration is invalid. value is taken as JSON if it decodes
+// into the field's type, and as a plain string otherwise.
+func configSet(configPath, key, value string, force bool) error {
+	path := strings.Split(key, ".")
+	t, err := configKeyType(path)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := configValue(t, value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+
+	// The config is written anyway, so an old one is migrated first
+	if err := migrateConfigFiles(configPath); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// Create the maps along the way, e.g. for a new job
+	m := raw
+	for _, name := range path[:len(path)-1] {
+		next, ok := m[name].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			m[name] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = decoded
+
+	data, err = json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if !force {
+		if err := validateConfigData(configPath, data); err != nil {
+			return fmt.Errorf("not saved: %w (use -force to save anyway)", err)
+		}
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(configPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// configKeyType returns the type of the ConfigFile field named by path
+func configKeyType(path []string) (reflect.Type, error) {
+	t := reflect.TypeOf(ConfigFile{})
+	for i, name := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		parent := strings.Join(path[:i], ".")
+
+		switch t.Kind() {
+		case reflect.Struct:
+			field, ok := jsonField(t, name)
+			if !ok {
+				if parent == "" {
+					return nil, fmt.Errorf("unknown config key %s", name)
+				}
+				return nil, fmt.Errorf("%s has no key %s", parent, name)
+			}
+			t = field.Type
+		case reflect.Map:
+			if name == "" {
+				return nil, fmt.Errorf("empty key in %s", parent)
+			}
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("%s has no keys", parent)
+		}
+	}
+	return t, nil
+}
+
+// jsonField finds the field of struct type t with the JSON name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name && tag != "-" {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configValue decodes a command line value into type t and returns it in the
+// form json.Unmarshal produces for a generic value
+func configValue(t reflect.Type, value string) (any, error) {
+	target := reflect.New(t)
+	if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+		if t.Kind() != reflect.String {
+			return nil, err
+		}
+		// Strings don't need quotes
+		target.Elem().SetString(value)
+	}
+
+	data, err := json.Marshal(target.Interface())
+	if err != nil {
+		return nil, err
+	}
+	var decoded any
+	err = json.Unmarshal(data, &decoded)
+	return decoded, err
+}
+
+// validateConfigData checks a config file the way the daemon would at start.
+// It and its includes must be migrated.
+func validateConfigData(configPath string, data []byte) error {
+	var configFile ConfigFile
+	if err := json.Unmarshal(data, &configFile); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := loadIncludes(&configFile, filepath.Dir(configPath), currentConfigVersion); err != nil {
+		return err
+	}
+
+	config := MergeConfigWithFlags(&configFile, Config{ConfigFile: configPath, BackupInterval: time.Hour})
+	configs := []Config{config}
+	if len(configFile.Jobs) > 0 {
+		var err error
+		if configs, err = JobConfigs(&configFile, config); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range configs {
+		if err := ValidateConfig(config); err != nil {
+			if config.Job != "" {
+				err = fmt.Errorf("job %s: %w", config.Job, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
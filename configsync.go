@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// remoteConfigName is the encrypted config file kept in the DataVault root
+const remoteConfigName = ".datavault-config"
+
+// passphraseEnv names the environment variable holding the passphrase that
+// the remote config copy is encrypted with
+const passphraseEnv = "DATAVAULT_CONFIG_PASSPHRASE"
+
+// configKeyIterations is the PBKDF2 work factor of new remote config copies
+const configKeyIterations = 600000
+
+// rootFileStore is implemented by providers that can keep small files next to
+// the backups in the DataVault root
+type rootFileStore interface {
+	writeRootFile(ctx context.Context, name string, data []byte) error
+	// readRootFile returns os.ErrNotExist if there is no such file
+	readRootFile(ctx context.Context, name string) ([]byte, error)
+}
+
+// sealedConfig is the stored form of an encrypted config file
+type sealedConfig struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"` // pbkdf2-sha256
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"` // AES-256-GCM
+}
+
+// sealConfig encrypts config file data with a key derived from passphrase
+func sealConfig(data []byte, passphrase string) ([]byte, error) {
+	sealed := sealedConfig{
+		Version:    1,
+		KDF:        "pbkdf2-sha256",
+		Iterations: configKeyIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := configCipher(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, err
+	}
+	sealed.Data = gcm.Seal(nil, sealed.Nonce, data, nil)
+
+	return json.MarshalIndent(sealed, "", "  ")
+}
+
+// openConfig decrypts a config file sealed by sealConfig
+func openConfig(stored []byte, passphrase string) ([]byte, error) {
+	var sealed sealedConfig
+	if err := json.Unmarshal(stored, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to parse remote config: %w", err)
+	}
+	if sealed.Version != 1 || sealed.KDF != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("unsupported remote config version %d (%s)", sealed.Version, sealed.KDF)
+	}
+
+	gcm, err := configCipher(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid remote config nonce")
+	}
+	data, err := gcm.Open(nil, sealed.Nonce, sealed.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt remote config: wrong passphrase or damaged file")
+	}
+	return data, nil
+}
+
+func configCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// configPassphrase reads the passphrase from a file, or else from the
+// environment
+func configPassphrase(path string) (string, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", fmt.Errorf("a passphrase is needed: use -passphrase-file or set %s", passphraseEnv)
+}
+
+// runConfigPush uploads an encrypted copy of the config file to every
+// provider, or the one given with -provider
+func runConfigPush(args []string) error {
+	fs := flag.NewFlagSet("config push", flag.ExitOnError)
+	provider := fs.String("provider", "", "Only upload to this provider (gdrive or pcloud)")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the encryption passphrase (default: $"+passphraseEnv+")")
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(configFile.Include) > 0 {
+		fmt.Printf("Note: Included files are not pushed, only %s\n", config.ConfigFile)
+	}
+
+	passphrase, err := configPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(config.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	sealed, err := sealConfig(data, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt config: %w", err)
+	}
+
+	config.Provider = *provider
+	bm := NewBackupManager(config)
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, p := range providers {
+		store, ok := p.(rootFileStore)
+		if !ok {
+			continue
+		}
+		if err := store.writeRootFile(ctx, remoteConfigName, sealed); err != nil {
+			fmt.Printf("%s: %v\n", providerLabel(p.Name()), err)
+			failed++
+			continue
+		}
+		fmt.Printf("Pushed %s to %s\n", config.ConfigFile, providerLabel(p.Name()))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d providers failed", failed, len(providers))
+	}
+	return nil
+}
+
+// runConfigPull downloads the encrypted config copy from the first provider
+// that has one and writes it to the config file. Only the credentials are
+// needed, so a new machine can be set up from nothing.
+func runConfigPull(args []string) error {
+	fs := flag.NewFlagSet("config pull", flag.ExitOnError)
+	var flags Config
+	fs.StringVar(&flags.ConfigFile, "config", "datavault.json", "Configuration file path to write")
+	fs.StringVar(&flags.GoogleDriveAuth, "gdrive-auth", "", "Google Drive authentication JSON file path")
+	fs.StringVar(&flags.PCloudAuth, "pcloud-auth", "", "pCloud authentication token")
+	fs.StringVar(&flags.RemoteRoot, "remote-root", defaultRemoteRoot, "Root folder on the providers")
+	fs.StringVar(&flags.Provider, "provider", "", "Only download from this provider (gdrive or pcloud)")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the encryption passphrase (default: $"+passphraseEnv+")")
+	force := fs.Bool("force", false, "Replace an existing config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if flags.PCloudAuth == "" {
+		flags.PCloudAuth = os.Getenv(pcloudAuthEnv)
+	}
+
+	if _, err := os.Stat(flags.ConfigFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to replace it", flags.ConfigFile)
+	}
+	passphrase, err := configPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	bm := NewBackupManager(flags)
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	data, from, err := pullConfig(context.Background(), providers, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(flags.ConfigFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Printf("Pulled %s from %s\n", flags.ConfigFile, providerLabel(from))
+	return nil
+}
+
+// pullConfig downloads and decrypts the config copy of the first provider
+// that has one. It returns the config file data and the provider's name.
+func pullConfig(ctx context.Context, providers []Provider, passphrase string) ([]byte, string, error) {
+	for _, p := range providers {
+		store, ok := p.(rootFileStore)
+		if !ok {
+			continue
+		}
+		sealed, err := store.readRootFile(ctx, remoteConfigName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", providerLabel(p.Name()), err)
+			continue
+		}
+
+		data, err := openConfig(sealed, passphrase)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, p.Name(), nil
+	}
+
+	return nil, "", fmt.Errorf("no provider has a config copy, push one with \"datavault config push\"")
+}
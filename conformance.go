@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// conformanceFiles is the tree uploaded by the conformance checks
+var conformanceFiles = map[string]string{
+	"a.txt":         "alpha",
+	"dir/b.txt":     "bravo",
+	"dir/sub/c.txt": "charlie",
+}
+
+// runConformance checks that a provider behaves the way the backup pipeline
+// expects, using a scratch backup
+func runConformance(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	provider := fs.String("provider", "fake", "Provider to check: gdrive, pcloud or fake")
+
+	config, _, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	config.Provider = *provider
+
+	bm := NewBackupManager(config)
+	p, err := bm.provider(*provider)
+	if err != nil {
+		return err
+	}
+
+	local, err := os.MkdirTemp(bm.tempDir, "conformance-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(local)
+
+	c := newConformance(bm, p, local, "datavault-conformance-"+time.Now().Format("20060102-150405"))
+	failed := 0
+	for _, check := range conformanceChecks {
+		if err := check.run(c, context.Background()); err != nil {
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", check.name)
+	}
+
+	if p.Name() != "fake" {
+		fmt.Printf("The scratch backup %s was left on %s and can be deleted\n", c.backup, providerLabel(p.Name()))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s failed %d checks", providerLabel(p.Name()), failed)
+	}
+	fmt.Printf("%s passed all checks\n", providerLabel(p.Name()))
+	return nil
+}
+
+// conformance is the state shared by the checks, which build on each other
+type conformance struct {
+	bm     *BackupManager
+	p      Provider
+	local  string
+	backup string
+	want   map[string]string // Expected remote contents by path
+}
+
+// newConformance prepares the checks of p, uploading the files in local to
+// the backup folder backup
+func newConformance(bm *BackupManager, p Provider, local, backup string) *conformance {
+	return &conformance{bm: bm, p: p, local: local, backup: backup, want: make(map[string]string)}
+}
+
+// conformanceChecks are run in order against the same conformance state
+var conformanceChecks = []struct {
+	name string
+	run  func(*conformance, context.Context) error
+}{
+	{"upload a new backup", (*conformance).checkUpload},
+	{"list backups", (*conformance).checkListBackups},
+	{"list and download files", (*conformance).checkFiles},
+	{"replace files in a backup", (*conformance).checkReplace},
+	{"resume an upload", (*conformance).checkResume},
+	{"refuse to upload over a backup", (*conformance).checkExisting},
+	{"lock a backup", (*conformance).checkLock},
+}
+
+// write creates a local file and records it as expected on the provider
+func (c *conformance) write(relPath, content string) error {
+	path := filepath.Join(c.local, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+func (c *conformance) checkUpload(ctx context.Context) error {
+	for relPath, content := range conformanceFiles {
+		if err := c.write(relPath, content); err != nil {
+			return err
+		}
+		c.want[relPath] = content
+	}
+
+	progress := &memoryProgress{}
+	if err := c.p.UploadFolder(ctx, c.local, c.backup, progress); err != nil {
+		return err
+	}
+	for relPath := range conformanceFiles {
+		if !progress.Done(relPath) {
+			return fmt.Errorf("%s was not marked done", relPath)
+		}
+	}
+	return nil
+}
+
+func (c *conformance) checkListBackups(ctx context.Context) error {
+	backups, err := c.p.ListBackups(ctx)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if backup.Name == c.backup {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is missing", c.backup)
+}
+
+// checkFiles compares the remote files with the expected ones
+func (c *conformance) checkFiles(ctx context.Context) error {
+	files, err := c.p.ListBackupFiles(ctx, c.backup)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range files {
+		want, ok := c.want[file.Path]
+		if !ok {
+			return fmt.Errorf("unexpected file %s", file.Path)
+		}
+		if seen[file.Path] {
+			return fmt.Errorf("%s is listed twice", file.Path)
+		}
+		seen[file.Path] = true
+
+		if file.Size != int64(len(want)) {
+			return fmt.Errorf("%s has size %d, want %d", file.Path, file.Size, len(want))
+		}
+		var buf bytes.Buffer
+		if err := c.p.DownloadFile(ctx, file, &buf); err != nil {
+			return err
+		}
+		if buf.String() != want {
+			return fmt.Errorf("%s has content %q, want %q", file.Path, buf.String(), want)
+		}
+	}
+
+	for relPath := range c.want {
+		if !seen[relPath] {
+			return fmt.Errorf("%s is missing", relPath)
+		}
+	}
+	return nil
+}
+
+func (c *conformance) checkReplace(ctx context.Context) error {
+	if err := c.write("a.txt", "alpha, replaced"); err != nil {
+		return err
+	}
+	c.want["a.txt"] = "alpha, replaced"
+
+	if err := c.p.UploadFiles(ctx, c.local, c.backup, []string{"a.txt"}); err != nil {
+		return err
+	}
+	return c.checkFiles(ctx)
+}
+
+// checkResume uploads the folder again as a resumed upload. Files marked done
+// must be left alone even though they changed locally.
+func (c *conformance) checkResume(ctx context.Context) error {
+	if err := c.write("dir/b.txt", "bravo, changed"); err != nil {
+		return err
+	}
+	if err := c.write("dir/d.txt", "delta"); err != nil {
+		return err
+	}
+	c.want["dir/d.txt"] = "delta"
+
+	progress := &memoryProgress{resuming: true, done: make(map[string]bool)}
+	for relPath := range conformanceFiles {
+		progress.MarkDone(relPath)
+	}
+	if err := c.p.UploadFolder(ctx, c.local, c.backup, progress); err != nil {
+		return err
+	}
+	if !progress.Done("dir/d.txt") {
+		return fmt.Errorf("dir/d.txt was not marked done")
+	}
+	return c.checkFiles(ctx)
+}
+
+func (c *conformance) checkExisting(ctx context.Context) error {
+	if err := c.p.UploadFolder(ctx, c.local, c.backup, &memoryProgress{}); err == nil {
+		return fmt.Errorf("upload over %s succeeded", c.backup)
+	}
+	return c.checkFiles(ctx)
+}
+
+func (c *conformance) checkLock(ctx context.Context) error {
+	store, ok := c.p.(lockStore)
+	if !ok {
+		return fmt.Errorf("locks are not supported")
+	}
+
+	lock, err := c.bm.acquireLock(ctx, c.p, c.backup)
+	if err != nil {
+		return err
+	}
+	markers, err := store.readLocks(ctx, lockName(c.backup))
+	if err != nil {
+		lock.Release()
+		return err
+	}
+	if len(markers) != 1 || !markers[0].OK || markers[0].Info.Token != lock.info.Token {
+		lock.Release()
+		return fmt.Errorf("found %d lock markers, want the one just written", len(markers))
+	}
+
+	lock.Release()
+	if markers, err = store.readLocks(ctx, lockName(c.backup)); err != nil {
+		return err
+	}
+	if len(markers) != 0 {
+		return fmt.Errorf("%d lock markers are left after release", len(markers))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestFakeConformance runs the conformance checks against the fake provider
+// they are written against, so the two can't drift apart
+func TestFakeConformance(t *testing.T) {
+	bm := NewBackupManager(Config{Provider: "fake"})
+	c := newConformance(bm, newFakeProvider(), t.TempDir(), "datavault-conformance")
+
+	for _, check := range conformanceChecks {
+		// Each check builds on the ones before
+		if !t.Run(check.name, func(t *testing.T) {
+			if err := check.run(c, context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}) {
+			break
+		}
+	}
+}
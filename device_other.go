@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// deviceID is not available on this platform, so one_file_system has no effect
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileIdentity is not available on this platform, so directory cycles are
+// only bounded by max_depth
+func fileIdentity(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// escapeName makes a single file or folder name safe to store on every
+// provider. Control characters, backslashes, invalid UTF-8 and trailing dots
+// and spaces are written as %XX, which the providers or their sync clients
+// reject or mangle. Emoji and other valid Unicode are kept as they are. A "%"
+// is only escaped where it would otherwise read as an escape, so ordinary
+// names don't change.
+func escapeName(name string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+
+		escape := false
+		switch {
+		case r == utf8.RuneError && size == 1:
+			escape = true
+		case r < 0x20 || r == 0x7f || r == '\\':
+			escape = true
+		case r == '%':
+			escape = isEscape(name[i:])
+		case r == '.' || r == ' ':
+			escape = strings.TrimRight(name[i:], ". ") == ""
+		}
+
+		if escape {
+			for j := 0; j < size; j++ {
+				fmt.Fprintf(&b, "%%%02X", name[i+j])
+			}
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+
+	return b.String()
+}
+
+// unescapeName reverses escapeName
+func unescapeName(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if isEscape(name[i:]) {
+			c, _ := strconv.ParseUint(name[i+1:i+3], 16, 8)
+			b.WriteByte(byte(c))
+			i += 2
+			continue
+		}
+		b.WriteByte(name[i])
+	}
+
+	return b.String()
+}
+
+// isEscape reports whether s starts with a %XX escape
+func isEscape(s string) bool {
+	if len(s) < 3 || s[0] != '%' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:3], 16, 8)
+	return err == nil
+}
+
+// escapePath escapes every name of a slash-separated path
+func escapePath(relPath string) string {
+	if relPath == "." {
+		return relPath
+	}
+
+	names := strings.Split(relPath, "/")
+	for i, name := range names {
+		names[i] = escapeName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// unescapePath reverses escapePath
+func unescapePath(relPath string) string {
+	names := strings.Split(relPath, "/")
+	for i, name := range names {
+		names[i] = unescapeName(name)
+	}
+	return strings.Join(names, "/")
+}
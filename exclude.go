@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// excludePresets are ready-made exclude lists for exclude_presets, in the
+// pattern format of excludes. Patterns with a slash start with "**/" to match
+// at any depth.
+var excludePresets = map[string][]string{
+	// Files operating systems leave everywhere
+	"os-junk": {
+		".DS_Store", "._*", ".AppleDouble/", ".Spotlight-V100/", ".Trashes/", ".fseventsd/",
+		".TemporaryItems/", "Thumbs.db", "ehthumbs.db", "desktop.ini", "$RECYCLE.BIN/",
+		".Trash-*/", ".directory", "*~",
+	},
+	// Caches and lock files of browser profiles, which are rebuilt and
+	// only meaningful to the running browser
+	"browser-caches": {
+		"Cache/", "Code Cache/", "GPUCache/", "GrShaderCache/", "ShaderCache/",
+		"**/Service Worker/CacheStorage/", "cache2/", "startupCache/",
+		"SingletonLock", "SingletonCookie", "SingletonSocket", "parent.lock", ".parentlock",
+	},
+	// Package manager and build caches, which can be downloaded or built again
+	"dev-caches": {
+		"node_modules/", ".npm/", "**/.yarn/cache/", ".pnpm-store/", "bower_components/",
+		"__pycache__/", "*.pyc", ".venv/", "venv/", ".tox/", ".pytest_cache/", ".mypy_cache/",
+		"**/.cache/pip/", "**/.cache/go-build/", "**/go/pkg/mod/", "**/.cargo/registry/",
+		"**/.gradle/caches/", "**/.m2/repository/", ".next/", ".parcel-cache/", ".terraform/",
+	},
+	// Indexes and caches of IDEs, which they rebuild on their own
+	"ide-indexes": {
+		"DerivedData/", ".vscode-server/", "CachedData/", "workspaceStorage/",
+		"**/.idea/shelf/", "**/.idea/caches/", ".ccls-cache/", ".clangd/",
+	},
+}
+
+// presetNames returns the names of the exclude presets, sorted
+func presetNames() []string {
+	names := make([]string, 0, len(excludePresets))
+	for name := range excludePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateExcludePresets(presets []string) error {
+	for _, name := range presets {
+		if _, ok := excludePresets[name]; !ok {
+			return fmt.Errorf("unknown exclude preset %q: must be one of %s", name, strings.Join(presetNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// excludeRules returns the rules of excludes and the exclude presets, or nil
+// if there are none
+func excludeRules(excludes, presets []string) *gitignore {
+	lines := slices.Clone(excludes)
+	for _, name := range presets {
+		lines = append(lines, excludePresets[name]...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return newGitignore(lines)
+}
+
+// describeExcludes returns the exclude rules of a job for the log
+func describeExcludes(excludes, presets []string) string {
+	var parts []string
+	if len(excludes) > 0 {
+		parts = append(parts, strings.Join(excludes, ", "))
+	}
+	for _, name := range presets {
+		parts = append(parts, "preset "+name)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// excluded reports whether the file or directory at path matches excludes
+// or an exclude preset
+func (f *sourceFilter) excluded(path string, isDir bool) bool {
+	if f.excludes == nil {
+		return false
+	}
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return f.excludes.match(filepath.ToSlash(rel), isDir, false)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveWriter writes backup files into a single local archive
+type archiveWriter interface {
+	AddFile(name string, size int64, modTime time.Time, mode os.FileMode, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (za *zipArchive) AddFile(name string, size int64, modTime time.Time, mode os.FileMode, r io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	}
+	header.SetMode(mode)
+
+	w, err := za.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (za *zipArchive) Close() error {
+	return za.zw.Close()
+}
+
+type tarZstdArchive struct {
+	tw *tar.Writer
+	zw *zstd.Encoder
+}
+
+func (ta *tarZstdArchive) AddFile(name string, size int64, modTime time.Time, mode os.FileMode, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Size:    size,
+		Mode:    int64(mode.Perm()),
+		ModTime: modTime,
+	}
+
+	if err := ta.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(ta.tw, r)
+	return err
+}
+
+func (ta *tarZstdArchive) Close() error {
+	if err := ta.tw.Close(); err != nil {
+		return err
+	}
+	return ta.zw.Close()
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case "tar.zst":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		return &tarZstdArchive{tw: tar.NewWriter(zw), zw: zw}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s (use zip or tar.zst)", format)
+	}
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "zip", "Archive format: zip or tar.zst")
+	out := fs.String("out", "", "Output archive path (default: <backup_name>.<format>)")
+	provider := fs.String("provider", "", "Download from this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: datavault export [OPTIONS] <backup_name>")
+	}
+	backupName := positional[0]
+
+	if *out == "" {
+		*out = backupName + "." + *format
+	}
+
+	if err := checkWritable(*out); err != nil {
+		return err
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer file.Close()
+
+	archive, err := newArchiveWriter(*format, file)
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	bm := NewBackupManager(config)
+	if err := bm.ExportBackup(context.Background(), backupName, *provider, archive); err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finalize archive: %w", err)
+	}
+
+	log.Printf("Exported %s to %s", backupName, *out)
+	return nil
+}
+
+// ExportBackup writes all files of a backup into archive, including those an
+// incremental backup refers to in earlier backups. A staging copy left in the
+// temp directory is preferred over downloading from a provider if it holds
+// every file itself.
+func (bm *BackupManager) ExportBackup(ctx context.Context, backupName, providerName string, archive archiveWriter) error {
+	if providerName == "" {
+		if stagePath, manifest, ok := bm.stagedBackup(backupName); ok {
+			log.Printf("Exporting %s from staging directory %s", backupName, stagePath)
+			return bm.exportLocal(stagePath, backupName, manifest, archive)
+		}
+	}
+
+	p, err := bm.provider(providerName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exporting %s from %s", backupName, p.Name())
+
+	listings := make(map[string]map[string]RemoteFile)
+	manifest, err := bm.remoteManifest(ctx, p, backupName, listings)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		if manifest, err = bm.listingManifest(ctx, p, backupName, listings); err != nil {
+			return err
+		}
+	}
+	if unknown := unknownTransforms(manifest.Files); len(unknown) > 0 {
+		return fmt.Errorf("%s was stored with transforms this version can't undo (%s), export it with a newer version", backupName, strings.Join(unknown, ", "))
+	}
+
+	entries := append([]ManifestEntry(nil), manifest.Files...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	own := make(map[string]bool) // Stored paths of this backup's folder that were exported
+	for _, entry := range entries {
+		if err := checkRestorePath(entry.Path); err != nil {
+			return err
+		}
+
+		// Files of a striped backup are only on the provider they went to
+		src := p
+		if entry.Provider != "" && entry.Provider != p.Name() {
+			if src, err = bm.provider(entry.Provider); err != nil {
+				return fmt.Errorf("%s is striped across providers: %w", backupName, err)
+			}
+		}
+
+		// Unchanged files of incremental backups are in the backup that
+		// first had them
+		files, err := bm.storedFiles(ctx, src, entry.Backup, listings)
+		if err != nil {
+			return err
+		}
+		file, ok := files[entry.storedPath()]
+		if !ok {
+			return fmt.Errorf("failed to export %s: not found in %s", entry.Path, entry.Backup)
+		}
+		if entry.Backup == backupName {
+			own[file.Path] = true
+		}
+
+		if err := exportRemoteFile(ctx, src, file, entry, true, backupName+"/"+entry.Path, entry.ModTime, archive); err != nil {
+			return err
+		}
+		if bm.config.Verbose {
+			log.Printf("Exported file: %s", entry.Path)
+		}
+	}
+
+	// The rest of the backup folder, such as the manifest and readme
+	files, err := bm.storedFiles(ctx, p, backupName, listings)
+	if err != nil {
+		return err
+	}
+	var rest []string
+	for stored := range files {
+		if !own[stored] {
+			rest = append(rest, stored)
+		}
+	}
+	sort.Strings(rest)
+	for _, stored := range rest {
+		file := files[stored]
+		if err := exportRemoteFile(ctx, p, file, ManifestEntry{}, false, backupName+"/"+unescapePath(stored), file.ModTime, archive); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportRemoteFile streams a download straight into archive under name
+func exportRemoteFile(ctx context.Context, p Provider, file RemoteFile, entry ManifestEntry, ok bool, name string, modTime time.Time, archive archiveWriter) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(p.DownloadFile(ctx, file, pw))
+	}()
+	defer pr.Close()
+
+	r, size, err := decodeStored(pr, file.Size, entry, ok)
+	if err == nil {
+		err = archive.AddFile(name, size, modTime, 0644, r)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export %s: %w", name, err)
+	}
+	return nil
+}
+
+// stagedBackup returns the staged copy of a backup and its manifest if it is
+// still in the staging directory and holds every file of the backup itself,
+// which the staged copy of an incremental backup doesn't
+func (bm *BackupManager) stagedBackup(backupName string) (string, *Manifest, bool) {
+	dirs, err := os.ReadDir(filepath.Join(bm.tempDir, backupName))
+	if err != nil {
+		return "", nil, false
+	}
+
+	// The staged folder is named after the source folder at the time
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		stagePath := filepath.Join(bm.tempDir, backupName, dir.Name())
+		manifest, err := loadManifest(filepath.Join(stagePath, manifestFileName))
+		if err != nil {
+			continue
+		}
+		if manifest.Base != "" {
+			return "", nil, false
+		}
+		for _, entry := range manifest.Files {
+			if entry.Backup != backupName {
+				return "", nil, false
+			}
+		}
+		return stagePath, manifest, true
+	}
+	return "", nil, false
+}
+
+// originalPath returns the path a stored file had in the source, preferring
+// the manifest's record over reversing the escaping
+func originalPath(stored string, entry ManifestEntry, ok bool) string {
+	if ok {
+		return entry.Path
+	}
+	return unescapePath(stored)
+}
+
+// decodeStored returns the original content and size of a stored file,
+// undoing the transforms recorded in its manifest entry
+func decodeStored(r io.Reader, size int64, entry ManifestEntry, ok bool) (io.Reader, int64, error) {
+	if !ok || entry.Encoding == "" {
+		return r, size, nil
+	}
+
+	r, err := decodeStages(r, encodingStages(entry.Encoding))
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, entry.Size, nil
+}
+
+// exportLocal writes the staged copy of a backup at root with its manifest
+// into archive
+func (bm *BackupManager) exportLocal(root, backupName string, manifest *Manifest, archive archiveWriter) error {
+	entries := manifest.storedIndex()
+	duplicates := manifest.duplicates()
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		stored := filepath.ToSlash(relPath)
+		entry, ok := entries[stored]
+		for _, name := range append([]string{originalPath(stored, entry, ok)}, duplicates[stored]...) {
+			if err := exportLocalFile(path, info, entry, ok, backupName+"/"+name, archive); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// exportLocalFile adds a staged file to archive under name
+func exportLocalFile(path string, info os.FileInfo, entry ManifestEntry, ok bool, name string, archive archiveWriter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, size, err := decodeStored(file, info.Size(), entry, ok)
+	if err != nil {
+		return err
+	}
+	return archive.AddFile(name, size, info.ModTime(), info.Mode(), r)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memoryArchive keeps the files added to it by name
+type memoryArchive map[string]string
+
+func (a memoryArchive) AddFile(name string, size int64, modTime time.Time, mode os.FileMode, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	a[name] = string(data)
+	return err
+}
+
+func (a memoryArchive) Close() error {
+	return nil
+}
+
+// uploadBackup uploads files and a manifest as a backup to fp
+func uploadBackup(t *testing.T, fp *fakeProvider, manifest *Manifest, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveManifest(manifest, filepath.Join(dir, manifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.UploadFolder(context.Background(), dir, manifest.BackupName, &memoryProgress{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportIncremental(t *testing.T) {
+	entry := func(path, backup, content string) ManifestEntry {
+		return ManifestEntry{Path: path, Size: int64(len(content)), Backup: backup}
+	}
+
+	tests := []struct {
+		name     string
+		manifest *Manifest
+	}{
+		{
+			name: "full manifest",
+			manifest: &Manifest{BackupName: "second", Files: []ManifestEntry{
+				entry("a.txt", "first", "alpha"),
+				entry("b.txt", "second", "bravo, changed"),
+			}},
+		},
+		{
+			name: "delta manifest",
+			manifest: &Manifest{BackupName: "second", Base: "first", Chain: 1, Files: []ManifestEntry{
+				entry("b.txt", "second", "bravo, changed"),
+			}, Removed: []string{"c.txt"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bm := NewBackupManager(Config{Provider: "fake"})
+			bm.tempDir = t.TempDir()
+
+			uploadBackup(t, bm.fake, &Manifest{BackupName: "first", Files: []ManifestEntry{
+				entry("a.txt", "first", "alpha"),
+				entry("b.txt", "first", "bravo"),
+				entry("c.txt", "first", "charlie"),
+			}}, map[string]string{"a.txt": "alpha", "b.txt": "bravo", "c.txt": "charlie"})
+			uploadBackup(t, bm.fake, tt.manifest, map[string]string{"b.txt": "bravo, changed"})
+
+			archive := make(memoryArchive)
+			if err := bm.ExportBackup(context.Background(), "second", "", archive); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{"second/a.txt": "alpha", "second/b.txt": "bravo, changed"}
+			for name, content := range want {
+				if archive[name] != content {
+					t.Errorf("%s has %q, want %q", name, archive[name], content)
+				}
+			}
+			if _, ok := archive["second/c.txt"]; ok {
+				t.Error("second/c.txt was removed in the backup but exported")
+			}
+			if _, ok := archive["second/"+manifestFileName]; !ok {
+				t.Error("the manifest is missing from the export")
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeProvider keeps backups in memory. It stands in for a cloud drive in
+// trial runs with "-provider fake" and is the reference the conformance
+// checks are written against.
+type fakeProvider struct {
+	mu      sync.Mutex
+	backups map[string]*fakeBackup
+	markers map[string]*fakeFile // Lock markers by ID
+	files   map[string][]byte    // Files in the root folder by name
+	nextID  int
+}
+
+type fakeBackup struct {
+	created time.Time
+	files   map[string]*fakeFile // By slash-separated path
+}
+
+type fakeFile struct {
+	id      string
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		backups: make(map[string]*fakeBackup),
+		markers: make(map[string]*fakeFile),
+		files:   make(map[string][]byte),
+	}
+}
+
+func (fp *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (fp *fakeProvider) ListBackups(ctx context.Context) ([]RemoteBackup, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	var backups []RemoteBackup
+	for name, backup := range fp.backups {
+		backups = append(backups, RemoteBackup{Name: name, Created: backup.created, ID: name})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name < backups[j].Name
+	})
+	return backups, nil
+}
+
+// UploadFolder creates a backup from localPath. Like pCloud it refuses to
+// create a backup that exists, unless the upload is resumed.
+func (fp *fakeProvider) UploadFolder(ctx context.Context, localPath, backupName string, progress UploadProgress) error {
+	fp.mu.Lock()
+	backup, ok := fp.backups[backupName]
+	if ok && !progress.Resuming() {
+		fp.mu.Unlock()
+		return fmt.Errorf("backup %s already exists", backupName)
+	}
+	if !ok {
+		backup = &fakeBackup{created: time.Now(), files: make(map[string]*fakeFile)}
+		fp.backups[backupName] = backup
+	}
+	fp.mu.Unlock()
+
+	return filepath.WalkDir(localPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(localPath, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if progress.Done(relPath) {
+			return nil
+		}
+
+		if err := fp.store(backup, localPath, relPath); err != nil {
+			return err
+		}
+		progress.MarkDone(relPath)
+		return nil
+	})
+}
+
+func (fp *fakeProvider) UploadFiles(ctx context.Context, localPath, backupName string, relPaths []string) error {
+	fp.mu.Lock()
+	backup, ok := fp.backups[backupName]
+	fp.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("backup %s not found", backupName)
+	}
+
+	for _, relPath := range relPaths {
+		if err := fp.store(backup, localPath, relPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// store reads a local file into a backup, replacing the file at relPath
+func (fp *fakeProvider) store(backup *fakeBackup, localPath, relPath string) error {
+	path := filepath.Join(localPath, filepath.FromSlash(relPath))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", relPath, err)
+	}
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.nextID++
+	backup.files[relPath] = &fakeFile{id: strconv.Itoa(fp.nextID), name: relPath, data: data, modTime: time.Now()}
+	return nil
+}
+
+func (fp *fakeProvider) ListBackupFiles(ctx context.Context, backupName string) ([]RemoteFile, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	backup, ok := fp.backups[backupName]
+	if !ok {
+		return nil, fmt.Errorf("backup %s not found", backupName)
+	}
+
+	var files []RemoteFile
+	for path, file := range backup.files {
+		files = append(files, RemoteFile{Path: path, Size: int64(len(file.data)), ModTime: file.modTime, ID: file.id})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+func (fp *fakeProvider) DownloadFile(ctx context.Context, file RemoteFile, w io.Writer) error {
+	fp.mu.Lock()
+	var data []byte
+	for _, backup := range fp.backups {
+		for _, f := range backup.files {
+			if f.id == file.ID {
+				data = f.data
+			}
+		}
+	}
+	if marker, ok := fp.markers[file.ID]; ok {
+		data = marker.data
+	}
+	fp.mu.Unlock()
+
+	if data == nil {
+		return fmt.Errorf("failed to download %s: not found", file.Path)
+	}
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+func (fp *fakeProvider) writeLock(ctx context.Context, name, id string, data []byte) (string, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if marker, ok := fp.markers[id]; ok {
+		marker.data = data
+		return id, nil
+	}
+
+	fp.nextID++
+	id = strconv.Itoa(fp.nextID)
+	fp.markers[id] = &fakeFile{id: id, name: name, data: data, modTime: time.Now()}
+	return id, nil
+}
+
+func (fp *fakeProvider) readLocks(ctx context.Context, name string) ([]lockMarker, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	var files []*fakeFile
+	for _, marker := range fp.markers {
+		if marker.name == name {
+			files = append(files, marker)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var markers []lockMarker
+	for _, file := range files {
+		markers = append(markers, newLockMarker(file.id, file.data))
+	}
+	return markers, nil
+}
+
+func (fp *fakeProvider) deleteLock(ctx context.Context, id string) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	delete(fp.markers, id)
+	return nil
+}
+
+func (fp *fakeProvider) writeRootFile(ctx context.Context, name string, data []byte) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.files[name] = bytes.Clone(data)
+	return nil
+}
+
+func (fp *fakeProvider) readRootFile(ctx context.Context, name string) ([]byte, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	data, ok := fp.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.Clone(data), nil
+}
@@ -1,49 +1,83 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+// Google Drive access levels, from gdrive_scope
+const (
+	gdriveScopeFile = "file" // Only files DataVault created (drive.file)
+	gdriveScopeFull = "full" // Every file in the Drive (drive)
+)
+
 type GoogleDriveClient struct {
 	service      *drive.Service
 	authFile     string
+	scope        string // gdriveScopeFile or gdriveScopeFull
+	endpoint     string // API base URL; empty for Google's
+	transport    http.RoundTripper
+	timeouts     providerTimeouts
+	rootPath     string // Slash-separated path of the DataVault root folder
+	setup        lazyInit
 	rootFolderID string
 }
 
-func NewGoogleDriveClient(authFile string) *GoogleDriveClient {
-	client := &GoogleDriveClient{
-		authFile: authFile,
+func NewGoogleDriveClient(authFile, rootPath, scope, endpoint string, transport http.RoundTripper, timeouts providerTimeouts) *GoogleDriveClient {
+	return &GoogleDriveClient{
+		authFile:  authFile,
+		rootPath:  rootPath,
+		scope:     scope,
+		endpoint:  endpoint,
+		transport: transport,
+		timeouts:  timeouts,
 	}
+}
 
-	if err := client.initialize(); err != nil {
-		log.Printf("Failed to initialize Google Drive client: %v", err)
-		return nil
+// ready initializes the client unless that was done before. A failed
+// initialization is tried again by the next call.
+func (gdc *GoogleDriveClient) ready(ctx context.Context) error {
+	if err := gdc.setup.do(ctx, gdc.Name(), gdc.initialize); err != nil {
+		return fmt.Errorf("failed to initialize Google Drive client: %w", err)
 	}
+	return nil
+}
 
-	return client
+// health returns whether the client is initialized
+func (gdc *GoogleDriveClient) health() (string, error) {
+	return gdc.setup.health()
 }
 
-func (gdc *GoogleDriveClient) initialize() error {
+func (gdc *GoogleDriveClient) initialize(ctx context.Context) error {
 	// Read credentials file
 	credentials, err := os.ReadFile(gdc.authFile)
 	if err != nil {
 		return fmt.Errorf("failed to read credentials file: %w", err)
 	}
 
-	// Parse credentials and create config
-	config, err := google.ConfigFromJSON(credentials, drive.DriveFileScope)
+	// Parse credentials and create config with the narrowest scope asked for
+	oauthScope := drive.DriveFileScope
+	if gdc.scope == gdriveScopeFull {
+		oauthScope = drive.DriveScope
+	}
+	config, err := google.ConfigFromJSON(credentials, oauthScope)
 	if err != nil {
 		return fmt.Errorf("failed to parse credentials: %w", err)
 	}
@@ -52,8 +86,11 @@ func (gdc *GoogleDriveClient) initialize() error {
 	client := gdc.getClient(config)
 
 	// Create Drive service
-	ctx := context.Background()
-	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	options := []option.ClientOption{option.WithHTTPClient(client)}
+	if gdc.endpoint != "" {
+		options = append(options, option.WithEndpoint(driveBasePath(gdc.endpoint)))
+	}
+	srv, err := drive.NewService(ctx, options...)
 	if err != nil {
 		return fmt.Errorf("failed to create Drive service: %w", err)
 	}
@@ -61,18 +98,36 @@ func (gdc *GoogleDriveClient) initialize() error {
 	gdc.service = srv
 
 	// Create or find DataVault root folder
-	if err := gdc.ensureRootFolder(); err != nil {
+	if err := gdc.ensureRootFolder(ctx); err != nil {
 		return fmt.Errorf("failed to setup root folder: %w", err)
 	}
 
 	return nil
 }
 
+// driveBasePath returns the base URL of the Drive API at endpoint, which may
+// be given with or without the API path. Uploads go to /upload/ on its host.
+func driveBasePath(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/drive/v3") {
+		endpoint += "/drive/v3"
+	}
+	return endpoint + "/"
+}
+
+// gdriveTokenFile holds the Google Drive OAuth token
+const gdriveTokenFile = "token.json"
+
+// limitedScope reports whether the client only sees files DataVault created
+func (gdc *GoogleDriveClient) limitedScope() bool {
+	return gdc.scope != gdriveScopeFull
+}
+
 func (gdc *GoogleDriveClient) getClient(config *oauth2.Config) *http.Client {
 	// This is a simplified version - in a real application you would
 	// implement proper OAuth2 flow with token storage
 	tok := &oauth2.Token{}
-	tokFile := "token.json"
+	tokFile := gdriveTokenFile
 
 	file, err := os.Open(tokFile)
 	if err != nil {
@@ -86,67 +141,67 @@ func (gdc *GoogleDriveClient) getClient(config *oauth2.Config) *http.Client {
 		log.Printf("Failed to decode token: %v", err)
 		return nil
 	}
-
-	return config.Client(context.Background(), tok)
+	addSecret(tok.AccessToken)
+	addSecret(tok.RefreshToken)
+	addSecret(config.ClientSecret)
+
+	// Faults injected for testing apply below the token handling, and the
+	// timeouts to each request including token refreshes
+	transport := &timeoutTransport{base: gdc.transport, timeouts: gdc.timeouts, transfer: gdriveTransfer}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	return config.Client(ctx, tok)
 }
 
-func (gdc *GoogleDriveClient) ensureRootFolder() error {
-	// Search for existing DataVault folder
-	query := "name='DataVault' and mimeType='application/vnd.google-apps.folder' and trashed=false"
-	fileList, err := gdc.service.Files.List().Q(query).Do()
+func (gdc *GoogleDriveClient) ensureRootFolder(ctx context.Context) error {
+	// Find or create each folder of the root path, starting at My Drive
+	folderIDs := map[string]string{".": "root"}
+	folderID, err := gdc.ensureFolderPath(ctx, cleanRemotePath(gdc.rootPath), folderIDs)
 	if err != nil {
-		return fmt.Errorf("failed to search for root folder: %w", err)
+		return fmt.Errorf("failed to find or create root folder: %w", err)
 	}
 
-	if len(fileList.Files) > 0 {
-		gdc.rootFolderID = fileList.Files[0].Id
-		log.Printf("Found existing DataVault folder: %s", gdc.rootFolderID)
-		return nil
-	}
-
-	// Create DataVault folder
-	folder := &drive.File{
-		Name:     "DataVault",
-		MimeType: "application/vnd.google-apps.folder",
-	}
-
-	file, err := gdc.service.Files.Create(folder).Do()
-	if err != nil {
-		return fmt.Errorf("failed to create root folder: %w", err)
-	}
-
-	gdc.rootFolderID = file.Id
-	log.Printf("Created DataVault folder: %s", gdc.rootFolderID)
+	gdc.rootFolderID = folderID
+	log.Printf("Using DataVault folder %s: %s", gdc.rootPath, gdc.rootFolderID)
 	return nil
 }
 
-func (gdc *GoogleDriveClient) UploadFolder(ctx context.Context, localPath, backupName string) error {
-	if gdc.service == nil {
-		return fmt.Errorf("Google Drive service not initialized")
+func (gdc *GoogleDriveClient) UploadFolder(ctx context.Context, localPath, backupName string, progress UploadProgress) error {
+	if err := gdc.ready(ctx); err != nil {
+		return err
 	}
 
 	log.Printf("Uploading %s to Google Drive as %s", localPath, backupName)
 
-	// Create backup folder
-	backupFolder := &drive.File{
-		Name:     backupName,
-		MimeType: "application/vnd.google-apps.folder",
-		Parents:  []string{gdc.rootFolderID},
+	// Reuse the backup folder of an interrupted upload
+	var folder *drive.File
+	if progress.Resuming() {
+		var err error
+		if folder, err = gdc.findChild(ctx, gdc.rootFolderID, backupName, true); err != nil {
+			return fmt.Errorf("failed to search for backup folder: %w", err)
+		}
 	}
 
-	folder, err := gdc.service.Files.Create(backupFolder).Do()
-	if err != nil {
-		return fmt.Errorf("failed to create backup folder: %w", err)
-	}
+	if folder == nil {
+		// Create backup folder
+		backupFolder := &drive.File{
+			Name:     backupName,
+			MimeType: "application/vnd.google-apps.folder",
+			Parents:  []string{gdc.rootFolderID},
+		}
 
-	backupFolderID := folder.Id
-	log.Printf("Created backup folder: %s", backupFolderID)
+		var err error
+		folder, err = gdc.service.Files.Create(backupFolder).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("failed to create backup folder: %w", err)
+		}
+		log.Printf("Created backup folder: %s", folder.Id)
+	}
 
 	// Upload files recursively
-	return gdc.uploadDirectoryRecursive(ctx, localPath, backupFolderID, "")
+	return gdc.uploadDirectoryRecursive(ctx, localPath, folder.Id, "", progress)
 }
 
-func (gdc *GoogleDriveClient) uploadDirectoryRecursive(ctx context.Context, localPath, parentID, relativePath string) error {
+func (gdc *GoogleDriveClient) uploadDirectoryRecursive(ctx context.Context, localPath, parentID, relativePath string, progress UploadProgress) error {
 	entries, err := os.ReadDir(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
@@ -163,28 +218,49 @@ func (gdc *GoogleDriveClient) uploadDirectoryRecursive(ctx context.Context, loca
 		currentRelativePath := filepath.Join(relativePath, entry.Name())
 
 		if entry.IsDir() {
-			// Create subdirectory
-			subFolder := &drive.File{
-				Name:     entry.Name(),
-				MimeType: "application/vnd.google-apps.folder",
-				Parents:  []string{parentID},
+			var createdFolder *drive.File
+			if progress.Resuming() {
+				if createdFolder, err = gdc.findChild(ctx, parentID, entry.Name(), true); err != nil {
+					log.Printf("Failed to search for folder %s: %v", currentRelativePath, err)
+					continue
+				}
 			}
 
-			createdFolder, err := gdc.service.Files.Create(subFolder).Do()
-			if err != nil {
-				log.Printf("Failed to create folder %s: %v", currentRelativePath, err)
-				continue
+			if createdFolder == nil {
+				// Create subdirectory
+				subFolder := &drive.File{
+					Name:     entry.Name(),
+					MimeType: "application/vnd.google-apps.folder",
+					Parents:  []string{parentID},
+				}
+
+				createdFolder, err = gdc.service.Files.Create(subFolder).Context(ctx).Do()
+				if err != nil {
+					log.Printf("Failed to create folder %s: %v", currentRelativePath, err)
+					continue
+				}
 			}
 
 			// Recursively upload subdirectory
-			if err := gdc.uploadDirectoryRecursive(ctx, fullPath, createdFolder.Id, currentRelativePath); err != nil {
+			if err := gdc.uploadDirectoryRecursive(ctx, fullPath, createdFolder.Id, currentRelativePath, progress); err != nil {
 				log.Printf("Failed to upload subdirectory %s: %v", currentRelativePath, err)
 			}
 		} else {
-			// Upload file
-			if err := gdc.uploadFile(ctx, fullPath, entry.Name(), parentID); err != nil {
+			relPath := filepath.ToSlash(currentRelativePath)
+			if progress.Done(relPath) {
+				continue
+			}
+
+			// Upload file; a resumed upload may have sent it before stopping
+			upload := gdc.uploadFile
+			if progress.Resuming() {
+				upload = gdc.replaceFile
+			}
+			if err := upload(ctx, fullPath, entry.Name(), parentID); err != nil {
 				log.Printf("Failed to upload file %s: %v", currentRelativePath, err)
+				continue
 			}
+			progress.MarkDone(relPath)
 		}
 	}
 
@@ -203,7 +279,10 @@ func (gdc *GoogleDriveClient) uploadFile(ctx context.Context, localPath, fileNam
 		Parents: []string{parentID},
 	}
 
-	_, err = gdc.service.Files.Create(driveFile).Media(file).Context(ctx).Do()
+	mimeType := gdc.detectMimeType(file)
+	driveFile.MimeType = mimeType
+
+	_, err = gdc.service.Files.Create(driveFile).Media(file, googleapi.ContentType(mimeType)).Context(ctx).Do()
 	if err != nil {
 		return fmt.Errorf("failed to upload file: %w", err)
 	}
@@ -212,20 +291,488 @@ func (gdc *GoogleDriveClient) uploadFile(ctx context.Context, localPath, fileNam
 	return nil
 }
 
-func (gdc *GoogleDriveClient) detectMimeType(filePath string) string {
-	ext := strings.ToLower(filepath.Ext(filePath))
-	switch ext {
-	case ".txt":
-		return "text/plain"
-	case ".pdf":
-		return "application/pdf"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".json":
-		return "application/json"
-	default:
-		return "application/octet-stream"
+// detectMimeType sniffs the content type from the first 512 bytes of a file
+// and rewinds it. Sniffing can't tell text formats apart, so plain text and
+// unknown binary content fall back to the extension.
+func (gdc *GoogleDriveClient) detectMimeType(file *os.File) string {
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(file, buf)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Warning: Failed to rewind %s: %v", file.Name(), err)
+	}
+
+	sniffed := http.DetectContentType(buf[:n])
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(file.Name()))); byExt != "" {
+		return byExt
+	}
+	return sniffed
+}
+
+// findBackupFolder looks up the folder of a backup inside the DataVault root
+func (gdc *GoogleDriveClient) findBackupFolder(ctx context.Context, backupName string) (*drive.File, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return nil, err
+	}
+
+	folder, err := gdc.findChild(ctx, gdc.rootFolderID, backupName, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for backup folder: %w", err)
+	}
+
+	if folder == nil {
+		if gdc.scope != gdriveScopeFull {
+			return nil, fmt.Errorf("backup %s not found (with gdrive_scope %s, folders not created by DataVault are invisible; set it to %s if the backup was uploaded otherwise)",
+				backupName, gdriveScopeFile, gdriveScopeFull)
+		}
+		return nil, fmt.Errorf("backup %s not found", backupName)
+	}
+
+	return folder, nil
+}
+
+// findChild looks up a file or folder by name inside a parent folder. It
+// returns nil if there is no such child. Drive allows duplicate names, so the
+// oldest match is picked to stay deterministic.
+func (gdc *GoogleDriveClient) findChild(ctx context.Context, parentID, name string, isFolder bool) (*drive.File, error) {
+	children, err := gdc.findChildren(ctx, parentID, name, isFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(children) == 0 {
+		return nil, nil
+	}
+
+	if isFolder && len(children) > 1 {
+		log.Printf("Warning: Found %d Google Drive folders named %s, using the oldest; run \"datavault repair\" to merge them",
+			len(children), name)
+	}
+
+	return children[0], nil
+}
+
+// findChildren returns all children of a parent folder with the given name,
+// oldest first
+func (gdc *GoogleDriveClient) findChildren(ctx context.Context, parentID, name string, isFolder bool) ([]*drive.File, error) {
+	query := fmt.Sprintf("name='%s' and '%s' in parents and trashed=false", escapeQuery(name), parentID)
+	if isFolder {
+		query += " and mimeType='application/vnd.google-apps.folder'"
+	} else {
+		query += " and mimeType!='application/vnd.google-apps.folder'"
+	}
+
+	call := gdc.service.Files.List().Q(query).OrderBy("createdTime").PageSize(1000).
+		Fields("nextPageToken, files(id, name, mimeType, webViewLink)")
+
+	var children []*drive.File
+	err := call.Pages(ctx, func(fileList *drive.FileList) error {
+		children = append(children, fileList.Files...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
+
+// ShareBackup grants read access to a backup folder and returns its link.
+// Drive only supports expiring permissions for individual users, so without
+// an email the link is shared with anyone who has it and does not expire.
+func (gdc *GoogleDriveClient) ShareBackup(ctx context.Context, backupName, email string, expires time.Time) (string, error) {
+	folder, err := gdc.findBackupFolder(ctx, backupName)
+	if err != nil {
+		return "", err
+	}
+
+	permission := &drive.Permission{
+		Type: "anyone",
+		Role: "reader",
+	}
+	if email != "" {
+		permission.Type = "user"
+		permission.EmailAddress = email
+		permission.ExpirationTime = expires.UTC().Format(time.RFC3339)
+	} else {
+		log.Printf("Warning: Google Drive link sharing cannot expire, pass -email for a time-limited share")
+	}
+
+	if _, err := gdc.service.Permissions.Create(folder.Id, permission).Context(ctx).Do(); err != nil {
+		return "", fmt.Errorf("failed to create permission: %w", err)
+	}
+
+	return folder.WebViewLink, nil
+}
+
+func escapeQuery(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `'`, `\'`)
+}
+
+func (gdc *GoogleDriveClient) Name() string {
+	return "gdrive"
+}
+
+// ListBackups returns all backup folders in the DataVault root, following
+// page tokens so large accounts aren't truncated
+func (gdc *GoogleDriveClient) ListBackups(ctx context.Context) ([]RemoteBackup, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("'%s' in parents and mimeType='application/vnd.google-apps.folder' and trashed=false", gdc.rootFolderID)
+	call := gdc.service.Files.List().Q(query).PageSize(1000).Fields("nextPageToken, files(id, name, createdTime)")
+
+	var backups []RemoteBackup
+	err := call.Pages(ctx, func(fileList *drive.FileList) error {
+		for _, file := range fileList.Files {
+			created, _ := time.Parse(time.RFC3339, file.CreatedTime)
+			backups = append(backups, RemoteBackup{Name: file.Name, Created: created, ID: file.Id})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	return backups, nil
+}
+
+// ListBackupFiles returns all files of a backup, walking its folder tree
+func (gdc *GoogleDriveClient) ListBackupFiles(ctx context.Context, backupName string) ([]RemoteFile, error) {
+	folder, err := gdc.findBackupFolder(ctx, backupName)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []RemoteFile
+	if err := gdc.listFilesRecursive(ctx, folder.Id, "", &files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (gdc *GoogleDriveClient) listFilesRecursive(ctx context.Context, folderID, relativePath string, files *[]RemoteFile) error {
+	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+	call := gdc.service.Files.List().Q(query).PageSize(1000).Fields("nextPageToken, files(id, name, mimeType, size, modifiedTime)")
+
+	return call.Pages(ctx, func(fileList *drive.FileList) error {
+		for _, file := range fileList.Files {
+			path := file.Name
+			if relativePath != "" {
+				path = relativePath + "/" + file.Name
+			}
+
+			if file.MimeType == "application/vnd.google-apps.folder" {
+				if err := gdc.listFilesRecursive(ctx, file.Id, path, files); err != nil {
+					return err
+				}
+				continue
+			}
+
+			modTime, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+			*files = append(*files, RemoteFile{
+				Path:    path,
+				Size:    file.Size,
+				ModTime: modTime,
+				ID:      file.Id,
+			})
+		}
+		return nil
+	})
+}
+
+func (gdc *GoogleDriveClient) DownloadFile(ctx context.Context, file RemoteFile, w io.Writer) error {
+	if err := gdc.ready(ctx); err != nil {
+		return err
+	}
+	resp, err := gdc.service.Files.Get(file.ID).Context(ctx).Download()
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+
+	return nil
+}
+
+// UploadFiles uploads the given files below localPath into an existing
+// backup, replacing files that are already there
+func (gdc *GoogleDriveClient) UploadFiles(ctx context.Context, localPath, backupName string, relPaths []string) error {
+	folder, err := gdc.findBackupFolder(ctx, backupName)
+	if err != nil {
+		return err
+	}
+
+	folderIDs := map[string]string{".": folder.Id}
+	failed := 0
+	for _, relPath := range relPaths {
+		parentID, err := gdc.ensureFolderPath(ctx, path.Dir(relPath), folderIDs)
+		if err != nil {
+			log.Printf("Failed to create folder for %s: %v", relPath, err)
+			failed++
+			continue
+		}
+
+		if err := gdc.replaceFile(ctx, filepath.Join(localPath, filepath.FromSlash(relPath)), path.Base(relPath), parentID); err != nil {
+			log.Printf("Failed to upload file %s: %v", relPath, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to upload", failed, len(relPaths))
+	}
+
+	return nil
+}
+
+// ensureFolderPath returns the ID of a slash-separated folder path inside a
+// backup, creating missing folders. folderIDs caches known folders and must
+// contain "." for the backup folder itself.
+func (gdc *GoogleDriveClient) ensureFolderPath(ctx context.Context, dir string, folderIDs map[string]string) (string, error) {
+	if id, ok := folderIDs[dir]; ok {
+		return id, nil
+	}
+
+	parentID, err := gdc.ensureFolderPath(ctx, path.Dir(dir), folderIDs)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(dir)
+	folder, err := gdc.findChild(ctx, parentID, name, true)
+	if err != nil {
+		return "", err
+	}
+
+	if folder == nil {
+		folder, err = gdc.service.Files.Create(&drive.File{
+			Name:     name,
+			MimeType: "application/vnd.google-apps.folder",
+			Parents:  []string{parentID},
+		}).Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	folderIDs[dir] = folder.Id
+	return folder.Id, nil
+}
+
+// replaceFile uploads a file, updating the content of an existing file with
+// the same name instead of creating a duplicate
+func (gdc *GoogleDriveClient) replaceFile(ctx context.Context, localPath, fileName, parentID string) error {
+	existing, err := gdc.findChild(ctx, parentID, fileName, false)
+	if err != nil {
+		return fmt.Errorf("failed to search for file: %w", err)
+	}
+
+	if existing == nil {
+		return gdc.uploadFile(ctx, localPath, fileName, parentID)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	mimeType := gdc.detectMimeType(file)
+	if _, err := gdc.service.Files.Update(existing.Id, &drive.File{MimeType: mimeType}).Media(file, googleapi.ContentType(mimeType)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to update file: %w", err)
+	}
+
+	log.Printf("Updated file: %s", fileName)
+	return nil
+}
+
+// RepairRoot merges duplicate folders along the DataVault root path into the
+// oldest one, so backups are no longer scattered across them. Duplicates are
+// moved to the trash once empty. Files whose name already exists in the kept
+// folder are left in place and reported. With dryRun nothing is changed.
+func (gdc *GoogleDriveClient) RepairRoot(ctx context.Context, dryRun bool) (int, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return 0, err
+	}
+
+	merged := 0
+	parentID := "root"
+	rootPath := cleanRemotePath(gdc.rootPath)
+	if rootPath == "." {
+		return 0, nil
+	}
+
+	for _, name := range strings.Split(rootPath, "/") {
+		folders, err := gdc.findChildren(ctx, parentID, name, true)
+		if err != nil {
+			return merged, fmt.Errorf("failed to search for folder %s: %w", name, err)
+		}
+		if len(folders) == 0 {
+			return merged, fmt.Errorf("folder %s not found", name)
+		}
+
+		keep := folders[0]
+		for _, duplicate := range folders[1:] {
+			log.Printf("Merging duplicate folder %s (%s) into %s", name, duplicate.Id, keep.Id)
+			if err := gdc.mergeFolders(ctx, keep.Id, duplicate.Id, name, dryRun); err != nil {
+				return merged, err
+			}
+			merged++
+		}
+
+		parentID = keep.Id
+	}
+
+	return merged, nil
+}
+
+func (gdc *GoogleDriveClient) mergeFolders(ctx context.Context, keepID, duplicateID, relativePath string, dryRun bool) error {
+	query := fmt.Sprintf("'%s' in parents and trashed=false", duplicateID)
+	call := gdc.service.Files.List().Q(query).PageSize(1000).Fields("nextPageToken, files(id, name, mimeType)")
+
+	var children []*drive.File
+	if err := call.Pages(ctx, func(fileList *drive.FileList) error {
+		children = append(children, fileList.Files...)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to list %s: %w", relativePath, err)
+	}
+
+	leftOver := 0
+	for _, child := range children {
+		childPath := relativePath + "/" + child.Name
+		isFolder := child.MimeType == "application/vnd.google-apps.folder"
+
+		conflict, err := gdc.findChild(ctx, keepID, child.Name, isFolder)
+		if err != nil {
+			return fmt.Errorf("failed to search for %s: %w", childPath, err)
+		}
+
+		switch {
+		case conflict != nil && isFolder:
+			// Same folder in both copies, merge its contents too
+			if err := gdc.mergeFolders(ctx, conflict.Id, child.Id, childPath, dryRun); err != nil {
+				return err
+			}
+		case conflict != nil:
+			log.Printf("Not moving %s: a file with the same name already exists", childPath)
+			leftOver++
+		case dryRun:
+			log.Printf("Dry run: Would move %s", childPath)
+		default:
+			if _, err := gdc.service.Files.Update(child.Id, &drive.File{}).AddParents(keepID).RemoveParents(duplicateID).Context(ctx).Do(); err != nil {
+				return fmt.Errorf("failed to move %s: %w", childPath, err)
+			}
+			log.Printf("Moved %s", childPath)
+		}
+	}
+
+	if leftOver > 0 || dryRun {
+		return nil
+	}
+
+	if _, err := gdc.service.Files.Update(duplicateID, &drive.File{Trashed: true}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to trash duplicate folder %s: %w", relativePath, err)
+	}
+
+	return nil
+}
+
+// writeLock stores a lock marker in the root folder, replacing the marker
+// with the given id if there is one. Drive allows several files with the
+// same name, so concurrent writers each get their own marker.
+func (gdc *GoogleDriveClient) writeLock(ctx context.Context, name, id string, data []byte) (string, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return "", err
+	}
+	if id != "" {
+		if _, err := gdc.service.Files.Update(id, &drive.File{}).Media(bytes.NewReader(data)).Context(ctx).Do(); err != nil {
+			return "", fmt.Errorf("failed to update lock marker: %w", err)
+		}
+		return id, nil
+	}
+
+	file, err := gdc.service.Files.Create(&drive.File{Name: name, Parents: []string{gdc.rootFolderID}}).
+		Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to create lock marker: %w", err)
+	}
+	return file.Id, nil
+}
+
+// readLocks returns the lock markers with the given name, oldest first
+func (gdc *GoogleDriveClient) readLocks(ctx context.Context, name string) ([]lockMarker, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return nil, err
+	}
+	files, err := gdc.findChildren(ctx, gdc.rootFolderID, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []lockMarker
+	for _, file := range files {
+		var buf bytes.Buffer
+		if err := gdc.DownloadFile(ctx, RemoteFile{Path: name, ID: file.Id}, &buf); err != nil {
+			return nil, err
+		}
+		markers = append(markers, newLockMarker(file.Id, buf.Bytes()))
+	}
+
+	return markers, nil
+}
+
+func (gdc *GoogleDriveClient) deleteLock(ctx context.Context, id string) error {
+	if err := gdc.ready(ctx); err != nil {
+		return err
+	}
+	return gdc.service.Files.Delete(id).Context(ctx).Do()
+}
+
+// writeRootFile stores a file in the root folder, replacing the oldest file
+// with that name
+func (gdc *GoogleDriveClient) writeRootFile(ctx context.Context, name string, data []byte) error {
+	if err := gdc.ready(ctx); err != nil {
+		return err
+	}
+	files, err := gdc.findChildren(ctx, gdc.rootFolderID, name, false)
+	if err != nil {
+		return err
+	}
+
+	id := ""
+	if len(files) > 0 {
+		id = files[0].Id
+	}
+	_, err = gdc.writeLock(ctx, name, id, data)
+	return err
+}
+
+// readRootFile returns the oldest file with the given name in the root folder
+func (gdc *GoogleDriveClient) readRootFile(ctx context.Context, name string) ([]byte, error) {
+	if err := gdc.ready(ctx); err != nil {
+		return nil, err
+	}
+	files, err := gdc.findChildren(ctx, gdc.rootFolderID, name, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	var buf bytes.Buffer
+	if err := gdc.DownloadFile(ctx, RemoteFile{Path: name, ID: files[0].Id}, &buf); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// gitignore holds the rules of one .gitignore file, which apply to paths
+// below the directory it is in
+type gitignore struct {
+	rules []ignoreRule
+}
+
+// ignoreRule is one pattern line of a .gitignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp // Matches slash-separated paths relative to the file's directory
+	negate  bool           // "!pattern" includes what earlier rules excluded
+	dirOnly bool           // "pattern/" only matches directories
+}
+
+// loadGitignore reads the .gitignore file in dir, or returns nil if there is
+// none or it can't be read
+func loadGitignore(dir string) *gitignore {
+	file, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return newGitignore(lines)
+}
+
+// newGitignore parses lines in the .gitignore format
+func newGitignore(lines []string) *gitignore {
+	g := &gitignore{}
+	for _, line := range lines {
+		if rule, ok := parseIgnoreRule(line); ok {
+			g.rules = append(g.rules, rule)
+		}
+	}
+	return g
+}
+
+// match applies the rules to a slash-separated path relative to the
+// directory they are for, given whether earlier rules ignore it
+func (g *gitignore) match(rel string, isDir, ignored bool) bool {
+	for _, rule := range g.rules {
+		if (!rule.dirOnly || isDir) && rule.pattern.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// parseIgnoreRule parses a .gitignore line, following the pattern format of
+// git: a pattern without a slash before its end matches at any depth, one
+// with a slash is anchored to the file's directory
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		rule.negate, line = true, rest
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if rest, ok := strings.CutSuffix(line, "/"); ok {
+		rule.dirOnly, line = true, rest
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	expr := globRegexp(line)
+	if !anchored {
+		expr = "(.*/)?" + expr
+	}
+	pattern, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.pattern = pattern
+	return rule, true
+}
+
+// globRegexp translates a gitignore glob into a regular expression, where
+// "**" matches any number of directories
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if rest, ok := strings.CutPrefix(class, "!"); ok {
+				class = "^" + rest
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// ignored reports whether git would ignore the file or directory at path by
+// the .gitignore files of the source tree. Rules of deeper files, and later
+// rules within a file, take precedence.
+func (f *sourceFilter) ignored(path string, isDir bool) bool {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	ignored := false
+	dir, below := f.root, rel
+	for {
+		g, ok := f.gitignores[dir]
+		if !ok {
+			g = loadGitignore(dir)
+			f.gitignores[dir] = g
+		}
+		if g != nil {
+			ignored = g.match(below, isDir, ignored)
+		}
+
+		name, rest, ok := strings.Cut(below, "/")
+		if !ok {
+			return ignored
+		}
+		dir, below = filepath.Join(dir, name), rest
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// HealBackup copies the files of a backup that some providers lack from a
+// provider that has them, or from the source folder if the file is
+// unchanged there, and gives every copy the complete manifest. It returns
+// the number of files copied.
+func (bm *BackupManager) HealBackup(ctx context.Context, name string, dryRun bool) (int, error) {
+	listings := make(map[string]map[string]RemoteFile)
+
+	// The first complete manifest defines what the backup holds
+	var reference Provider
+	var manifest *Manifest
+	manifests := make(map[string]*Manifest)
+	for _, p := range bm.providers() {
+		m, err := bm.remoteManifest(ctx, p, name, listings)
+		if err != nil {
+			log.Printf("%s: %v", providerLabel(p.Name()), err)
+			continue
+		}
+		manifests[p.Name()] = m
+		if m != nil && !m.Partial && manifest == nil {
+			reference, manifest = p, m
+		}
+	}
+	if manifest == nil {
+		return 0, fmt.Errorf("no provider has a complete manifest of %s", name)
+	}
+
+	for _, entry := range manifest.Files {
+		if entry.Provider != "" {
+			return 0, fmt.Errorf("%s is striped, so each file has only one copy", name)
+		}
+	}
+
+	source := ""
+	if manifest.Info != nil {
+		source = manifest.Info.Source
+	}
+
+	copied, failed := 0, 0
+	for _, p := range bm.providers() {
+		files, err := bm.storedFiles(ctx, p, name, listings)
+		if err != nil {
+			// A provider without the backup gets all of it
+			files = nil
+		}
+
+		var missing []ManifestEntry
+		for _, entry := range manifest.Files {
+			if entry.Backup != name || entry.isDuplicate() {
+				continue
+			}
+			remote, ok := files[entry.storedPath()]
+			if !ok || (entry.Encoding == "" && remote.Size != entry.Size) {
+				missing = append(missing, entry)
+			}
+		}
+
+		current := manifests[p.Name()]
+		if len(missing) == 0 && current != nil && !current.Partial {
+			continue
+		}
+
+		log.Printf("%s: %d files of %s missing", providerLabel(p.Name()), len(missing), name)
+		if dryRun {
+			for _, entry := range missing {
+				log.Printf("Dry run: Would copy %s to %s", entry.Path, providerLabel(p.Name()))
+			}
+			continue
+		}
+
+		n, err := bm.healProvider(ctx, p, reference, name, source, missing, listings)
+		copied += n
+		if err != nil {
+			log.Printf("Failed to repair %s on %s: %v", name, providerLabel(p.Name()), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return copied, fmt.Errorf("%d providers could not be repaired", failed)
+	}
+	return copied, nil
+}
+
+// healProvider stages the missing files and the reference manifest of a
+// backup and uploads them to p, the manifest last. Files come from the
+// source folder or any other provider that has them.
+func (bm *BackupManager) healProvider(ctx context.Context, p, reference Provider, name, source string, missing []ManifestEntry, listings map[string]map[string]RemoteFile) (int, error) {
+	lock, err := bm.acquireLock(ctx, p, name)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Release()
+
+	stagePath := filepath.Join(bm.tempDir, name+"_repair_"+p.Name())
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer bm.cleanup(stagePath)
+
+	files, err := bm.storedFiles(ctx, reference, name, listings)
+	if err != nil {
+		return 0, err
+	}
+
+	// The raw manifest is copied, since it may be a delta of an older backup
+	var buf bytes.Buffer
+	if err := reference.DownloadFile(ctx, files[manifestFileName], &buf); err != nil {
+		return 0, fmt.Errorf("failed to download manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(stagePath, manifestFileName), buf.Bytes(), 0644); err != nil {
+		return 0, err
+	}
+
+	staged, failed := 0, 0
+	for _, entry := range missing {
+		dst := filepath.Join(stagePath, filepath.FromSlash(entry.storedPath()))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return staged, err
+		}
+
+		if bm.stageFromSource(source, entry, dst) {
+			staged++
+			continue
+		}
+
+		if err := bm.stageFromProviders(ctx, p, name, entry, dst, listings); err != nil {
+			log.Printf("Cannot repair %s: %v", entry.Path, err)
+			os.Remove(dst)
+			failed++
+			continue
+		}
+		staged++
+	}
+
+	// Resuming reuses the folders and replaces the files already there
+	progress := &memoryProgress{resuming: true, done: map[string]bool{manifestFileName: true}}
+	if err := p.UploadFolder(ctx, stagePath, name, progress); err != nil {
+		return 0, err
+	}
+	if err := p.UploadFiles(ctx, stagePath, name, []string{manifestFileName}); err != nil {
+		return staged, err
+	}
+
+	log.Printf("Copied %d files of %s to %s", staged, name, providerLabel(p.Name()))
+	if failed > 0 {
+		return staged, fmt.Errorf("%d files could not be copied", failed)
+	}
+	return staged, nil
+}
+
+// stageFromProviders downloads a file of a backup from the first provider
+// other than target that has it
+func (bm *BackupManager) stageFromProviders(ctx context.Context, target Provider, name string, entry ManifestEntry, dst string, listings map[string]map[string]RemoteFile) error {
+	for _, p := range bm.providers() {
+		if p == target {
+			continue
+		}
+		files, err := bm.storedFiles(ctx, p, name, listings)
+		if err != nil {
+			continue
+		}
+		remote, ok := files[entry.storedPath()]
+		if !ok || (entry.Encoding == "" && remote.Size != entry.Size) {
+			continue
+		}
+
+		file, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		err = p.DownloadFile(ctx, remote, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download from %s: %w", providerLabel(p.Name()), err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no provider has it and the source changed")
+}
+
+// stageFromSource stages a file from the source folder if it still has the
+// content recorded in the manifest, which saves downloading it
+func (bm *BackupManager) stageFromSource(source string, entry ManifestEntry, dst string) bool {
+	algorithm := checksumAlgorithm(entry.Checksum)
+	if source == "" || algorithm == "" {
+		return false
+	}
+
+	path := filepath.Join(source, filepath.FromSlash(entry.Path))
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		return false
+	}
+
+	checksum, err := bm.copyFile(path, dst, info.Mode(), encodingStages(entry.Encoding), algorithm)
+	if err != nil || checksum != entry.Checksum {
+		os.Remove(dst)
+		return false
+	}
+	return true
+}
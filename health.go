@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Health states of a provider client
+const (
+	healthPending = "pending" // Not initialized yet
+	healthReady   = "ready"   // Initialized; later calls may still fail
+	healthDown    = "down"    // The last initialization failed and is retried by the next call
+)
+
+// lazyInit initializes a provider client on first use instead of when it is
+// created, so startup doesn't wait for a slow or unreachable provider. Calls
+// made while it is down try again.
+type lazyInit struct {
+	mu sync.Mutex // Held while initializing
+
+	stateMu sync.Mutex
+	state   string
+	err     error
+}
+
+// do runs init unless it succeeded before. Concurrent callers wait for the
+// one initializing.
+func (li *lazyInit) do(ctx context.Context, provider string, init func(context.Context) error) error {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if state, _ := li.health(); state == healthReady {
+		return nil
+	}
+
+	err := init(ctx)
+
+	li.stateMu.Lock()
+	defer li.stateMu.Unlock()
+	switch {
+	case err == nil && li.state == healthDown:
+		log.Printf("%s is available again", providerLabel(provider))
+	case err != nil && li.state != healthDown && ctx.Err() == nil:
+		log.Printf("Warning: %s is unavailable, retrying with its next use: %v", providerLabel(provider), err)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down says nothing about the provider
+		return err
+	}
+
+	li.state, li.err = healthReady, err
+	if err != nil {
+		li.state = healthDown
+	}
+	return err
+}
+
+// health returns the state of the client and, if it is down, why
+func (li *lazyInit) health() (string, error) {
+	li.stateMu.Lock()
+	defer li.stateMu.Unlock()
+
+	if li.state == "" {
+		return healthPending, nil
+	}
+	return li.state, li.err
+}
+
+// lazyProvider is a provider client that initializes on first use
+type lazyProvider interface {
+	ready(ctx context.Context) error
+	health() (string, error)
+}
+
+// healthOf returns the health state of a provider; providers without
+// initialization are always ready
+func healthOf(p Provider) (string, error) {
+	if lp, ok := p.(lazyProvider); ok {
+		return lp.health()
+	}
+	return healthReady, nil
+}
+
+// warmUp initializes the job's providers in the background, so the first
+// backup usually finds them ready and an unreachable one is reported early
+func (bm *BackupManager) warmUp(ctx context.Context) {
+	// Without root only the upload processes contact the providers
+	if bm.dropsPrivileges() {
+		return
+	}
+
+	for _, p := range bm.providers() {
+		if lp, ok := p.(lazyProvider); ok {
+			go lp.ready(ctx)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Run records are kept for reports this long, and within this size
+const (
+	defaultHistoryRetention = 90 * 24 * time.Hour
+	defaultHistoryMaxSize   = 10 << 20
+)
+
+// runRecord is the outcome of one backup run in the run history
+type runRecord struct {
+	Time          time.Time         `json:"time"`
+	Job           string            `json:"job"`
+	Backup        string            `json:"backup"`
+	Files         int               `json:"files"`
+	Size          int64             `json:"size"` // Size of all files in the backup
+	UploadedFiles int               `json:"uploaded_files"`
+	Uploaded      int64             `json:"uploaded"`
+	Largest       []largeFile       `json:"largest,omitempty"`
+	Duration      time.Duration     `json:"duration"`
+	Resumed       bool              `json:"resumed,omitempty"` // Finished after a restart
+	Status        string            `json:"status,omitempty"`  // succeeded, partial or failed; empty in old records
+	Providers     map[string]string `json:"providers"`         // Error per provider; empty if it succeeded
+	Rates         map[string]int64  `json:"rates,omitempty"`   // Upload speed per provider in bytes per second
+}
+
+// largeFile is one of the largest files uploaded by a run
+type largeFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+func historyPath(stateDir string) string {
+	return filepath.Join(stateDir, "history.jsonl")
+}
+
+// newRunRecord describes a finished run for the history
+func newRunRecord(summary RunSummary, resumed bool) runRecord {
+	record := runRecord{
+		Time:          time.Now(),
+		Job:           summary.Job,
+		Backup:        summary.Backup,
+		Files:         summary.Files,
+		Size:          summary.Size,
+		UploadedFiles: summary.Uploaded,
+		Uploaded:      summary.Bytes,
+		Duration:      summary.Duration,
+		Resumed:       resumed,
+		Status:        summary.Status,
+		Providers:     make(map[string]string),
+	}
+
+	for _, entry := range summary.Largest {
+		record.Largest = append(record.Largest, largeFile{Path: entry.Path, Size: entry.Size})
+	}
+	for _, result := range summary.Results {
+		if result.Rate > 0 {
+			if record.Rates == nil {
+				record.Rates = make(map[string]int64)
+			}
+			record.Rates[result.Provider] = int64(result.Rate)
+		}
+		switch {
+		case result.Success:
+			record.Providers[result.Provider] = ""
+		case result.Error != nil:
+			record.Providers[result.Provider] = result.Error.Error()
+		default:
+			record.Providers[result.Provider] = result.Message
+		}
+	}
+
+	return record
+}
+
+// writeHistory replaces the run history with records
+func writeHistory(stateDir string, records []runRecord) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	path := historyPath(stateDir)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write history: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadHistory returns the recorded runs since the given time, oldest first
+func loadHistory(stateDir string, since time.Time) ([]runRecord, error) {
+	file, err := os.Open(historyPath(stateDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	defer file.Close()
+
+	var records []runRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record runRecord
+		// Records written by another version may not parse; skip them
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if !record.Time.Before(since) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// recordRun adds a finished run to the history after checking it against
+// the earlier runs, dropping records beyond the history retention
+func (bm *BackupManager) recordRun(record runRecord) {
+	history, err := loadHistory(bm.config.StateDir, time.Time{})
+	if err != nil {
+		log.Printf("Warning: Failed to record run: %v", err)
+		return
+	}
+
+	bm.checkAnomalies(record, history)
+
+	history = pruneHistory(append(history, record), record.Time, bm.config.HistoryRetention, bm.config.HistoryMaxSize)
+	if err := writeHistory(bm.config.StateDir, history); err != nil {
+		log.Printf("Warning: Failed to record run: %v", err)
+	}
+}
+
+// pruneHistory drops records older than retention, then the oldest records
+// until the rest fit in maxSize bytes. Zero disables either limit.
+func pruneHistory(records []runRecord, now time.Time, retention time.Duration, maxSize int64) []runRecord {
+	start := 0
+	if retention > 0 {
+		for start < len(records) && records[start].Time.Before(now.Add(-retention)) {
+			start++
+		}
+	}
+
+	if maxSize > 0 {
+		var size int64
+		for i := len(records) - 1; i >= start; i-- {
+			data, _ := json.Marshal(records[i])
+			if size += int64(len(data)) + 1; size > maxSize {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	return records[start:]
+}
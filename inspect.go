@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// runInspect shows the transforms the files of a backup went through,
+// grouped by the backup folder holding them, and whether this version can
+// undo them
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	provider := fs.String("provider", "", "Read the manifest from this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: datavault inspect [OPTIONS] <backup_name>")
+	}
+	backupName := positional[0]
+
+	ctx := context.Background()
+	bm := NewBackupManager(config)
+	p, err := bm.provider(*provider)
+	if err != nil {
+		return err
+	}
+	manifest, err := bm.remoteManifest(ctx, p, backupName, make(map[string]map[string]RemoteFile))
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("%s has no manifest on %s, its files are stored as they are", backupName, providerLabel(p.Name()))
+	}
+
+	fmt.Printf("Backup %s on %s\n", backupName, providerLabel(p.Name()))
+	if info := manifest.Info; info != nil {
+		configured := configuredTransforms(info.Config.Transforms, info.Config.CompressText)
+		if len(configured) == 0 {
+			configured = []string{"none"}
+		}
+		fmt.Printf("Made by DataVault %s with transforms: %s\n", info.Version, strings.Join(configured, ", "))
+	}
+	fmt.Println()
+
+	type group struct {
+		backup, encoding string
+	}
+	files := make(map[group]int)
+	sizes := make(map[group]int64)
+	for _, entry := range manifest.Files {
+		g := group{entry.Backup, entry.Encoding}
+		files[g]++
+		sizes[g] += entry.Size
+	}
+	groups := make([]group, 0, len(files))
+	for g := range files {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].backup != groups[j].backup {
+			return groups[i].backup < groups[j].backup
+		}
+		return groups[i].encoding < groups[j].encoding
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "STORED IN\tTRANSFORMS\tFILES\tSIZE\t\n")
+	for _, g := range groups {
+		encoding, note := g.encoding, ""
+		if encoding == "" {
+			encoding = "none"
+		}
+		if unknown := unknownTransforms([]ManifestEntry{{Encoding: g.encoding}}); len(unknown) > 0 {
+			note = "unknown to this version: " + strings.Join(unknown, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", g.backup, encoding, files[g], formatBytes(sizes[g]), note)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobConfig is a backup job in the "jobs" section of the config file. Unset
+// fields are inherited from the top-level settings.
+type JobConfig struct {
+	SourceFolder    string       `json:"source_folder"`
+	BackupName      string       `json:"backup_name,omitempty"`
+	BackupInterval  string       `json:"backup_interval,omitempty"`
+	MaxBackups      int          `json:"max_backups,omitempty"`
+	Incremental     *bool        `json:"incremental,omitempty"`
+	Watch           *bool        `json:"watch,omitempty"`
+	BackupWindows   []TimeWindow `json:"backup_windows,omitempty"`
+	Blackouts       []Blackout   `json:"blackouts,omitempty"`
+	FanOut          string       `json:"fan_out,omitempty"`
+	PrimaryProvider string       `json:"primary_provider,omitempty"`
+	Providers       []string     `json:"providers,omitempty"` // Providers this job uploads to (default: all configured)
+	UploadOrder     string       `json:"upload_order,omitempty"`
+	PriorityPaths   []string     `json:"priority_paths,omitempty"`
+	Transforms      []string     `json:"transforms,omitempty"` // Replaces the top-level transforms for this job
+}
+
+// JobConfigs returns the effective configuration of every job, sorted by name
+func JobConfigs(configFile *ConfigFile, base Config) ([]Config, error) {
+	names := make([]string, 0, len(configFile.Jobs))
+	for name := range configFile.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	configs := make([]Config, 0, len(names))
+	for _, name := range names {
+		config, err := jobConfig(base, name, configFile.Jobs[name])
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// FindJobConfig returns the effective configuration of a single job
+func FindJobConfig(configFile *ConfigFile, base Config, name string) (Config, error) {
+	job, ok := configFile.Jobs[name]
+	if !ok {
+		return base, fmt.Errorf("job %s is not defined", name)
+	}
+	return jobConfig(base, name, job)
+}
+
+func jobConfig(base Config, name string, job *JobConfig) (Config, error) {
+	config := base
+	config.Job = name
+
+	if job == nil {
+		return config, fmt.Errorf("job %s has no configuration", name)
+	}
+
+	// Jobs keep their own incremental baseline
+	config.StateDir = filepath.Join(base.StateDir, "jobs", name)
+	config.SourceFolder = job.SourceFolder
+
+	if job.BackupInterval != "" {
+		interval, err := time.ParseDuration(job.BackupInterval)
+		if err != nil {
+			return config, fmt.Errorf("job %s: invalid backup interval: %w", name, err)
+		}
+		config.BackupInterval = interval
+	}
+	if job.BackupName != "" {
+		config.BackupName = job.BackupName
+	}
+	if job.MaxBackups != 0 {
+		config.MaxBackups = job.MaxBackups
+	}
+	if job.Incremental != nil {
+		config.Incremental = *job.Incremental
+	}
+	if job.Watch != nil {
+		config.Watch = *job.Watch
+	}
+	if len(job.BackupWindows) > 0 {
+		config.BackupWindows = job.BackupWindows
+	}
+	if len(job.Blackouts) > 0 {
+		config.Blackouts = job.Blackouts
+	}
+	if job.FanOut != "" {
+		config.FanOut = job.FanOut
+	}
+	if job.PrimaryProvider != "" {
+		config.PrimaryProvider = job.PrimaryProvider
+	}
+	if len(job.Providers) > 0 {
+		config.Providers = job.Providers
+	}
+	if job.UploadOrder != "" {
+		config.UploadOrder = job.UploadOrder
+	}
+	if len(job.PriorityPaths) > 0 {
+		config.PriorityPaths = job.PriorityPaths
+	}
+	if job.Transforms != nil {
+		config.Transforms = job.Transforms
+	}
+
+	return config, nil
+}
+
+// NewJobManagers creates a backup manager per job. The first manager
+// initializes the cloud clients, which are then shared by all jobs, and a
+// common limiter caps how many jobs run at the same time.
+func NewJobManagers(configs []Config, maxConcurrent int) []*BackupManager {
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	limiter := make(chan struct{}, maxConcurrent)
+
+	managers := make([]*BackupManager, 0, len(configs))
+	for i, config := range configs {
+		var bm *BackupManager
+		if i == 0 {
+			bm = NewBackupManager(config)
+		} else {
+			bm = managers[0].withConfig(config)
+		}
+		bm.limiter = limiter
+		managers = append(managers, bm)
+	}
+
+	return managers
+}
+
+// RunJobs runs every job on its own schedule until ctx is cancelled
+func RunJobs(ctx context.Context, managers []*BackupManager) {
+	// Notifications are shared, so one digest loop serves all jobs
+	if len(managers) > 0 {
+		go managers[0].alerts.Run(ctx)
+		go runReports(ctx, managers)
+	}
+
+	// Providers come up in the background, so one that is down doesn't hold
+	// up the jobs using the others
+	for _, bm := range managers {
+		bm.warmUp(ctx)
+	}
+
+	var wg sync.WaitGroup
+	for _, bm := range managers {
+		wg.Add(1)
+		go func(bm *BackupManager) {
+			defer wg.Done()
+			bm.Run(ctx)
+		}(bm)
+	}
+	wg.Wait()
+}
+
+// acquireSlot waits until the job may run under the global concurrency limit
+// and returns a function releasing the slot
+func (bm *BackupManager) acquireSlot(ctx context.Context) (func(), error) {
+	if bm.limiter == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case bm.limiter <- struct{}{}:
+	default:
+		log.Printf("%s: Waiting for other jobs to finish", bm.jobName())
+		select {
+		case bm.limiter <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() { <-bm.limiter }, nil
+}
+
+func (bm *BackupManager) jobName() string {
+	if bm.config.Job == "" {
+		return "default"
+	}
+	return bm.config.Job
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	provider := fs.String("provider", "", "Only list this provider (gdrive or pcloud)")
+	tag := fs.String("tag", "", "Only list backups with this tag, newest first")
+	details := fs.Bool("details", false, "Show the tags and comment of each backup, newest first")
+
+	config, _, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	bm := NewBackupManager(config)
+	if len(bm.providers()) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	// Tags and comments are kept in the manifests, which must be downloaded
+	if *tag != "" || *details {
+		fmt.Fprintf(w, "PROVIDER\tBACKUP\tCREATED\tTAGS\tCOMMENT\n")
+		for _, p := range bm.providers() {
+			if *provider != "" && p.Name() != *provider {
+				continue
+			}
+
+			backups, manifests, err := bm.taggedBackups(context.Background(), p, *tag)
+			if err != nil {
+				fmt.Fprintf(w, "%s\terror: %v\t\t\t\n", p.Name(), err)
+				continue
+			}
+			for i, backup := range backups {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name(), backup.Name, backup.Created.Local().Format(time.DateTime),
+					strings.Join(manifests[i].Tags, ","), manifests[i].Comment)
+			}
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintf(w, "PROVIDER\tBACKUP\tCREATED\n")
+	seen := make(map[string]map[string]bool) // Backup names by provider
+
+	for _, p := range bm.providers() {
+		if *provider != "" && p.Name() != *provider {
+			continue
+		}
+
+		backups, err := p.ListBackups(context.Background())
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror: %v\t\n", p.Name(), err)
+			continue
+		}
+
+		sort.Slice(backups, func(i, j int) bool {
+			return backups[i].Name < backups[j].Name
+		})
+		seen[p.Name()] = make(map[string]bool, len(backups))
+		for _, backup := range backups {
+			seen[p.Name()][backup.Name] = true
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Name(), backup.Name, backup.Created.Local().Format(time.DateTime))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// Backups uploaded by another OAuth client are invisible to drive.file
+	if gdrive, ok := seen["gdrive"]; ok && bm.gdrive.limitedScope() {
+		for name, backups := range seen {
+			for backup := range backups {
+				if name != "gdrive" && !gdrive[backup] {
+					fmt.Printf("\nNote: Google Drive may hold backups it can't show with gdrive_scope %s, set it to %s to list them\n",
+						gdriveScopeFile, gdriveScopeFull)
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Lock markers expire unless their holder refreshes them, so a crashed
+// machine blocks others for at most lockTTL
+const (
+	lockTTL     = 15 * time.Minute
+	lockRefresh = 5 * time.Minute
+	lockSettle  = 2 * time.Second // Time for a concurrent writer's marker to show up
+)
+
+// lockStore is implemented by providers that can keep lock markers in the
+// DataVault root folder
+type lockStore interface {
+	writeLock(ctx context.Context, name, id string, data []byte) (string, error)
+	readLocks(ctx context.Context, name string) ([]lockMarker, error)
+	deleteLock(ctx context.Context, id string) error
+}
+
+// lockInfo is the content of a lock marker
+type lockInfo struct {
+	Token    string    `json:"token"`
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// lockMarker is a lock marker file on a provider
+type lockMarker struct {
+	ID   string
+	Info lockInfo
+	OK   bool // The content could be parsed
+}
+
+func newLockMarker(id string, data []byte) lockMarker {
+	marker := lockMarker{ID: id}
+	marker.OK = json.Unmarshal(data, &marker.Info) == nil
+	return marker
+}
+
+// remoteLock is a lock held on a provider
+type remoteLock struct {
+	store lockStore
+	name  string
+	id    string
+	info  lockInfo
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// lockName is the name of the marker file locking a backup folder, or the
+// whole DataVault root for an empty backup name
+func lockName(backupName string) string {
+	if backupName == "" {
+		return ".datavault-lock"
+	}
+	return ".datavault-lock-" + escapeName(backupName)
+}
+
+// acquireLock takes the lock on a backup folder, or on the whole DataVault
+// root for an empty backup name, so several machines writing to the same
+// account don't write to it at once. The lock on the root also keeps others
+// from locking backups. Providers that can't store markers aren't locked.
+func (bm *BackupManager) acquireLock(ctx context.Context, p Provider, backupName string) (*remoteLock, error) {
+	store, ok := p.(lockStore)
+	if !ok {
+		return nil, nil
+	}
+
+	resource := backupName
+	if resource == "" {
+		resource = "DataVault root"
+	} else {
+		root := &remoteLock{store: store, name: lockName("")}
+		if err := root.checkHeld(ctx, ""); err != nil {
+			return nil, fmt.Errorf("DataVault root on %s: %w", providerLabel(p.Name()), err)
+		}
+	}
+
+	l := &remoteLock{store: store, name: lockName(backupName)}
+	if err := l.checkHeld(ctx, ""); err != nil {
+		return nil, fmt.Errorf("%s on %s: %w", resource, providerLabel(p.Name()), err)
+	}
+
+	hostname, _ := os.Hostname()
+	token := make([]byte, 16)
+	rand.Read(token)
+	l.info = lockInfo{
+		Token:    hex.EncodeToString(token),
+		Host:     hostname,
+		PID:      os.Getpid(),
+		Acquired: time.Now(),
+	}
+	if err := l.write(ctx); err != nil {
+		return nil, err
+	}
+
+	// Of two machines locking at once, the older marker wins
+	select {
+	case <-time.After(lockSettle):
+	case <-ctx.Done():
+		l.release()
+		return nil, ctx.Err()
+	}
+	if err := l.checkHeld(ctx, l.info.Token); err != nil {
+		l.release()
+		return nil, fmt.Errorf("%s on %s: %w", resource, providerLabel(p.Name()), err)
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.refresh()
+
+	return l, nil
+}
+
+// checkHeld fails if a live marker other than the one with token comes
+// first. Expired markers are removed.
+func (l *remoteLock) checkHeld(ctx context.Context, token string) error {
+	markers, err := l.store.readLocks(ctx, l.name)
+	if err != nil {
+		return fmt.Errorf("failed to read lock: %w", err)
+	}
+
+	for _, marker := range markers {
+		if !marker.OK || time.Now().After(marker.Info.Expires) {
+			if marker.ID != l.id {
+				log.Printf("Removing stale lock %s of %s", l.name, marker.Info.Host)
+				if err := l.store.deleteLock(ctx, marker.ID); err != nil {
+					log.Printf("Warning: Failed to remove stale lock: %v", err)
+				}
+			}
+			continue
+		}
+		if marker.Info.Token == token {
+			return nil
+		}
+		return fmt.Errorf("locked by %s (pid %d) since %s", marker.Info.Host, marker.Info.PID, marker.Info.Acquired.Format(time.RFC1123))
+	}
+
+	if token != "" {
+		return fmt.Errorf("lock marker disappeared")
+	}
+	return nil
+}
+
+func (l *remoteLock) write(ctx context.Context) error {
+	l.info.Expires = time.Now().Add(lockTTL)
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+
+	id, err := l.store.writeLock(ctx, l.name, l.id, data)
+	if err != nil {
+		return fmt.Errorf("failed to write lock: %w", err)
+	}
+	l.id = id
+	return nil
+}
+
+// refresh keeps the marker from expiring until Release
+func (l *remoteLock) refresh() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.write(context.Background()); err != nil {
+				log.Printf("Warning: Failed to refresh lock %s: %v", l.name, err)
+			}
+		}
+	}
+}
+
+// Release removes the lock. It is safe to call on a nil lock.
+func (l *remoteLock) Release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.release()
+}
+
+// release deletes the marker unless another writer replaced it, which
+// providers with one file per name allow
+func (l *remoteLock) release() {
+	ctx := context.Background()
+	markers, err := l.store.readLocks(ctx, l.name)
+	if err != nil {
+		log.Printf("Warning: Failed to remove lock %s: %v", l.name, err)
+		return
+	}
+
+	for _, marker := range markers {
+		if marker.ID != l.id || marker.Info.Token != l.info.Token {
+			continue
+		}
+		if err := l.store.deleteLock(ctx, marker.ID); err != nil {
+			log.Printf("Warning: Failed to remove lock %s: %v", l.name, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isMaildir reports whether dir is a maildir folder, which keeps one file
+// per message in its cur, new and tmp directories
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// maildirKey identifies a maildir message by its folder and unique name. Mail
+// clients rename messages when they move them from new to cur or change
+// their flags, which are appended after a colon, but the key stays the same.
+func maildirKey(relPath string) (string, bool) {
+	dir := path.Dir(relPath)
+	if base := path.Base(dir); base != "cur" && base != "new" {
+		return "", false
+	}
+
+	unique, _, _ := strings.Cut(path.Base(relPath), ":")
+	return path.Dir(dir) + "/" + unique, true
+}
+
+// maildirMessages returns the maildir messages of a manifest by their key
+func maildirMessages(m *Manifest) map[string]ManifestEntry {
+	messages := make(map[string]ManifestEntry)
+	for _, entry := range m.Files {
+		if key, ok := maildirKey(entry.Path); ok {
+			messages[key] = entry
+		}
+	}
+	return messages
+}
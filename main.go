@@ -7,22 +7,99 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 	"time"
 )
 
 type Config struct {
-	SourceFolder    string
-	BackupInterval  time.Duration
-	ConfigFile      string
-	GoogleDriveAuth string
-	PCloudAuth      string
-	DryRun          bool
-	Verbose         bool
+	SourceFolder       string
+	BackupInterval     time.Duration
+	ConfigFile         string
+	GoogleDriveAuth    string
+	GoogleDriveScope   string // file or full
+	PCloudAuth         string
+	DryRun             bool
+	Simulate           bool   // Run the pipeline once against an in-memory provider
+	Provider           string // Only use this provider; "fake" keeps backups in memory
+	Verbose            bool
+	MaxBackups         int
+	Incremental        bool
+	StateDir           string
+	Watch              bool
+	WatchDebounce      time.Duration
+	WatchMinInterval   time.Duration
+	WatchMaxBatch      int
+	BackupWindows      []TimeWindow
+	Blackouts          []Blackout
+	Job                string // Empty for the top-level job
+	MaxConcurrentJobs  int
+	RemoteRoot         string
+	FanOut             string // Which providers get each backup: all, any or fallback
+	PrimaryProvider    string
+	Providers          []string // Providers of this job; all configured ones if empty
+	UploadOrder        string   // Empty for directory order
+	PriorityPaths      []string // Patterns of paths uploaded before all others
+	StripeWeights      map[string]float64
+	BackupName         string
+	Tags               []string // Attached to every backup made
+	Comment            string   // Recorded in the manifest of a named backup
+	BreakerFailures    int
+	BreakerCooldown    time.Duration
+	DriveTimeouts      providerTimeouts
+	PCloudTimeouts     providerTimeouts
+	Network            NetworkConfig
+	SSH                SSHConfig
+	Endpoints          map[string]string
+	Strict             bool // Fail backups on files that can't be backed up
+	AllowEmptySource   bool
+	ForceSource        bool // Back up a filesystem root or the home directory
+	MountRetries       int
+	WalkParallelism    int
+	RunAs              string
+	Restricted         bool
+	WritableDirs       []string
+	OneFileSystem      bool
+	MaxDepth           int
+	CheckpointInterval time.Duration
+	TempQuota          int64 // Bytes; zero is unlimited
+	UploadSpeed        int64 // Bytes per second; zero is unknown
+	TempMaxAge         time.Duration
+	MaxRuntime         time.Duration // Zero is unlimited
+	HistoryRetention   time.Duration
+	HistoryMaxSize     int64
+	CompressText       bool
+	Transforms         []string
+	Checksum           string
+	Dedup              bool
+	Media              bool
+	Maildir            bool
+	Gitignore          bool
+	Excludes           []string // Patterns in the .gitignore format, relative to the source
+	ExcludePresets     []string
+	NotifyChannels     []ChannelConfig
+	NotifyTemplate     string
+	SummaryTemplate    string
+	NotifyDigest       time.Duration
+	NotifyRateLimit    time.Duration
+	ReportInterval     time.Duration // Zero disables the periodic report
 }
 
 func main() {
+	log.SetOutput(redactWriter{os.Stderr})
+
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if isPartial(err) {
+			// Monitoring can tell an incomplete backup from a failed one
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", redact(err.Error()))
+			os.Exit(exitPartial)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	var config Config
 
 	// CLI flags using standard library
@@ -30,20 +107,34 @@ func main() {
 	flag.DurationVar(&config.BackupInterval, "interval", time.Hour, "Backup interval (default: 1h)")
 	flag.StringVar(&config.ConfigFile, "config", "datavault.json", "Configuration file path")
 	flag.StringVar(&config.GoogleDriveAuth, "gdrive-auth", "", "Google Drive authentication JSON file path")
-	flag.StringVar(&config.PCloudAuth, "pcloud-auth", "", "pCloud authentication token")
+	flag.StringVar(&config.PCloudAuth, "pcloud-auth", "", "pCloud authentication token (visible in the process list, prefer $"+pcloudAuthEnv+")")
 	flag.BoolVar(&config.DryRun, "dry-run", false, "Show what would be backed up without actually doing it")
+	flag.BoolVar(&config.Simulate, "simulate", false, "Run one backup against an in-memory provider and print what would be uploaded")
+	flag.StringVar(&config.Provider, "provider", "", "Only use this provider (gdrive, pcloud or fake for an in-memory trial run)")
 	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
+	flag.BoolVar(&config.ForceSource, "force", false, "Back up the source folder even if it is a filesystem root or the home directory")
+	flag.BoolVar(&config.Watch, "watch", false, "Upload changes as they happen between scheduled backups")
+	flag.BoolVar(&config.Restricted, "restricted", false, "Only write to the staging and state directories and writable_dirs, for sandboxing")
+	flag.Func("tag", "Tag the backups of this run, e.g. before-migration (repeatable)", func(tag string) error {
+		config.Tags = append(config.Tags, tag)
+		return nil
+	})
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "DataVault - CLI tool for seamless data backup to multiple cloud drives\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s <command> [OPTIONS]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
+		printCommands()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  %s -source ~/Documents -gdrive-auth ./auth.json -pcloud-auth token123\n", os.Args[0])
 	}
 
 	flag.Parse()
+	if config.Restricted {
+		restrictWrites()
+	}
 
 	// Load configuration file
 	configFile, err := LoadConfig(config.ConfigFile)
@@ -54,31 +145,58 @@ func main() {
 
 	// Merge config file with command line flags
 	config = MergeConfigWithFlags(configFile, config)
+	if config.Restricted {
+		allowConfigWrites(config)
+	}
 
-	// Validate configuration
-	if err := ValidateConfig(config); err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration error: %v\n\n", err)
-		flag.Usage()
-		os.Exit(1)
+	// Jobs from the config file replace the top-level job unless a source
+	// folder is given on the command line
+	jobs := []Config{config}
+	if len(configFile.Jobs) > 0 && !flagSet("source") {
+		if jobs, err = JobConfigs(configFile, config); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration error: %v\n\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Convert source folder to absolute path
-	absPath, err := filepath.Abs(config.SourceFolder)
-	if err != nil {
-		log.Fatalf("Error resolving source path: %v", err)
+	for i := range jobs {
+		// Validate configuration
+		if err := ValidateConfig(jobs[i]); err != nil {
+			if jobs[i].Job != "" {
+				err = fmt.Errorf("job %s: %w", jobs[i].Job, err)
+			}
+			fmt.Fprintf(os.Stderr, "Configuration error: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
-	config.SourceFolder = absPath
 
 	// Setup logging
 	if config.Verbose {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
 
-	log.Printf("DataVault starting...")
-	log.Printf("Source folder: %s", config.SourceFolder)
-	log.Printf("Backup interval: %v", config.BackupInterval)
+	log.Printf("DataVault %s starting...", buildVersion())
+	for _, job := range jobs {
+		if job.Job != "" {
+			log.Printf("Job: %s", job.Job)
+		}
+		log.Printf("Source folder: %s", job.SourceFolder)
+		log.Printf("Backup interval: %v", job.BackupInterval)
+	}
 	log.Printf("Dry run: %v", config.DryRun)
 
+	// Deferred cleanup doesn't run after a crash or SIGKILL
+	cleanTemp(stagingDir(), jobs, config.TempMaxAge)
+
+	if config.Simulate {
+		if err := simulateJobs(context.Background(), NewJobManagers(jobs, config.MaxConcurrentJobs)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -93,18 +211,19 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize backup manager
-	backupManager := NewBackupManager(config)
-
-	// Run initial backup
-	if err := backupManager.RunBackup(ctx); err != nil {
-		log.Printf("Initial backup failed: %v", err)
-	}
-
-	// Start scheduled backups
-	if err := backupManager.StartScheduler(ctx); err != nil {
-		log.Fatalf("Failed to start scheduler: %v", err)
-	}
+	// Initialize a backup manager per job and run them until shutdown
+	RunJobs(ctx, NewJobManagers(jobs, config.MaxConcurrentJobs))
 
 	log.Printf("DataVault shutdown complete")
 }
+
+// flagSet reports whether a command line flag was given explicitly
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
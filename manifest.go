@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+// manifestFileName is stored at the root of every backup folder
+const manifestFileName = ".datavault-manifest.json"
+
+// currentManifestFormat is the manifest format written by this DataVault.
+// Manifests without format are format 1.
+const currentManifestFormat = 2
+
+// manifestMigrations[i] brings a decoded manifest of format i+1 to format
+// i+2. Formats only ever add fields, so every format decodes into Manifest
+// and older ones are migrated on read; newer ones are refused, since their
+// meaning can't be known.
+var manifestMigrations = []func(manifest *Manifest){
+	markImplicitCopies,
+}
+
+// Manifest lists every file that makes up a backup. With incremental backups
+// unchanged files are not uploaded again; their entries point to the older
+// backup folder that holds the content.
+type Manifest struct {
+	Format     int             `json:"format,omitempty"` // Format as read; always written as currentManifestFormat
+	BackupName string          `json:"backup_name"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Partial    bool            `json:"partial,omitempty"` // Checkpoint of a backup still being uploaded
+	Base       string          `json:"base,omitempty"`    // For a delta manifest, the backup whose manifest it amends
+	Chain      int             `json:"chain,omitempty"`   // Delta manifests since the last full one
+	Files      []ManifestEntry `json:"files"`
+	Removed    []string        `json:"removed,omitempty"` // Paths of the base manifest no longer in the backup
+	Tags       []string        `json:"tags,omitempty"`
+	Comment    string          `json:"comment,omitempty"`
+	Info       *BackupInfo     `json:"info,omitempty"`
+}
+
+type ManifestEntry struct {
+	Path     string    `json:"path"` // Slash-separated path relative to the backup root
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Backup   string    `json:"backup"`             // Backup folder containing the file content
+	Checksum string    `json:"checksum,omitempty"` // Content checksum, e.g. "sha256:<hex>"
+	Encoding string    `json:"encoding,omitempty"` // Transforms applied, in order, e.g. "gzip"; size and checksum are of the original
+	Stored   string    `json:"stored,omitempty"`   // Path on the providers, if it differs from Path; another file's for copies
+	Copy     bool      `json:"copy,omitempty"`     // Content stored with an identical file of the same backup
+	Provider string    `json:"provider,omitempty"` // The only provider holding the file in a striped backup
+}
+
+// storedPath returns the slash-separated path of the file on the providers
+func (e ManifestEntry) storedPath() string {
+	if e.Stored != "" {
+		return e.Stored
+	}
+	return e.Path
+}
+
+// isDuplicate reports whether the content of the entry is stored under the
+// path of an identical file of the same backup
+func (e ManifestEntry) isDuplicate() bool {
+	return e.Copy
+}
+
+// defaultChecksum is the algorithm manifest checksums are taken with unless
+// the checksum option picks another
+const defaultChecksum = "sha256"
+
+// checksumAlgorithms are the hashes manifest checksums can be taken with, by
+// the name prefixing the checksum. BLAKE3 is cryptographic like SHA-256 but
+// several times faster; xxh64 is faster still, but only detects corruption,
+// not deliberate tampering.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New() },
+	"xxh64":  func() hash.Hash { return xxhash.New() },
+}
+
+// newChecksum returns a hash of the algorithm, or of the default one if the
+// algorithm is unknown
+func newChecksum(algorithm string) hash.Hash {
+	if newHash, ok := checksumAlgorithms[algorithm]; ok {
+		return newHash()
+	}
+	return checksumAlgorithms[defaultChecksum]()
+}
+
+// formatChecksum returns the manifest form of a finished checksum
+func formatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// checksumAlgorithm returns the algorithm of a manifest checksum, or "" if
+// there is none or it is unknown, so the checksum can't be verified
+func checksumAlgorithm(checksum string) string {
+	algorithm, _, ok := strings.Cut(checksum, ":")
+	if _, known := checksumAlgorithms[algorithm]; !ok || !known {
+		return ""
+	}
+	return algorithm
+}
+
+// fileChecksum returns the manifest checksum of a file's content
+func fileChecksum(path, algorithm string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := newChecksum(algorithm)
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return formatChecksum(algorithm, h), nil
+}
+
+// Delta manifests are uploaded instead of full ones when at most
+// maxDeltaRatio of the files changed, until maxDeltaChain deltas follow each
+// other and a full manifest is due again
+const (
+	maxDeltaRatio = 0.25
+	maxDeltaChain = 10
+)
+
+// deltaManifest returns manifest as a delta against previous if only a small
+// part of the tree changed: just the files stored in this backup and the
+// paths removed since. Otherwise it returns manifest itself. The chain length
+// is recorded in manifest either way.
+func deltaManifest(manifest, previous *Manifest) *Manifest {
+	manifest.Chain = 0
+	if previous == nil || previous.Chain >= maxDeltaChain {
+		return manifest
+	}
+
+	delta := &Manifest{
+		BackupName: manifest.BackupName,
+		CreatedAt:  manifest.CreatedAt,
+		Base:       previous.BackupName,
+		Chain:      previous.Chain + 1,
+		Tags:       manifest.Tags,
+		Comment:    manifest.Comment,
+		Info:       manifest.Info,
+	}
+
+	current := manifest.index()
+	for _, entry := range manifest.Files {
+		if entry.Backup == manifest.BackupName {
+			delta.Files = append(delta.Files, entry)
+		}
+	}
+	for _, entry := range previous.Files {
+		if _, ok := current[entry.Path]; !ok {
+			delta.Removed = append(delta.Removed, entry.Path)
+		}
+	}
+
+	if float64(len(delta.Files)+len(delta.Removed)) > maxDeltaRatio*float64(len(manifest.Files)) {
+		return manifest
+	}
+
+	manifest.Chain = delta.Chain
+	return delta
+}
+
+// applyDelta returns the full manifest described by a delta manifest and the
+// full manifest of its base
+func applyDelta(base, delta *Manifest) *Manifest {
+	entries := base.index()
+	for _, removed := range delta.Removed {
+		delete(entries, removed)
+	}
+	for _, entry := range delta.Files {
+		entries[entry.Path] = entry
+	}
+
+	full := &Manifest{
+		Format:     delta.Format,
+		BackupName: delta.BackupName,
+		CreatedAt:  delta.CreatedAt,
+		Partial:    delta.Partial,
+		Tags:       delta.Tags,
+		Comment:    delta.Comment,
+		Info:       delta.Info,
+	}
+	for _, entry := range entries {
+		full.Files = append(full.Files, entry)
+	}
+	sort.Slice(full.Files, func(i, j int) bool {
+		return full.Files[i].Path < full.Files[j].Path
+	})
+
+	return full
+}
+
+// storedIndex returns the manifest entries keyed by their path on the
+// providers. Duplicates are left out, their stored file belongs to the
+// original.
+func (m *Manifest) storedIndex() map[string]ManifestEntry {
+	entries := make(map[string]ManifestEntry, len(m.Files))
+	for _, entry := range m.Files {
+		if !entry.isDuplicate() {
+			entries[entry.storedPath()] = entry
+		}
+	}
+	return entries
+}
+
+// duplicates returns the paths of duplicate files keyed by the stored path
+// holding their content
+func (m *Manifest) duplicates() map[string][]string {
+	paths := make(map[string][]string)
+	for _, entry := range m.Files {
+		if entry.isDuplicate() {
+			paths[entry.Stored] = append(paths[entry.Stored], entry.Path)
+		}
+	}
+	return paths
+}
+
+// index returns the manifest entries keyed by path
+func (m *Manifest) index() map[string]ManifestEntry {
+	entries := make(map[string]ManifestEntry, len(m.Files))
+	for _, entry := range m.Files {
+		entries[entry.Path] = entry
+	}
+	return entries
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// parseManifest decodes a manifest of any format up to the current one and
+// migrates it to the current format. Format keeps the format it was in.
+func parseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if manifest.Format == 0 {
+		manifest.Format = 1
+	}
+	if manifest.Format > currentManifestFormat {
+		return nil, fmt.Errorf("manifest format %d is newer than this DataVault supports (%d), please upgrade", manifest.Format, currentManifestFormat)
+	}
+	for v := manifest.Format; v < currentManifestFormat; v++ {
+		manifestMigrations[v-1](&manifest)
+	}
+
+	return &manifest, nil
+}
+
+// markImplicitCopies migrates format 1, in which the first release of dedup
+// marked no copies: their stored path was that of the identical file holding
+// the content. Of the entries sharing a stored file, the one stored under its
+// own escaped path is the original. Files sharing one that already has copies
+// marked were written by a later release.
+func markImplicitCopies(manifest *Manifest) {
+	shared := make(map[string]int)
+	marked := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		key := entry.Backup + "/" + entry.storedPath()
+		shared[key]++
+		marked[key] = marked[key] || entry.Copy
+	}
+	for i, entry := range manifest.Files {
+		key := entry.Backup + "/" + entry.storedPath()
+		if shared[key] > 1 && !marked[key] && entry.storedPath() != escapePath(entry.Path) {
+			manifest.Files[i].Copy = true
+		}
+	}
+}
+
+// marshalManifest encodes a manifest in the current format
+func marshalManifest(manifest *Manifest) ([]byte, error) {
+	current := *manifest
+	current.Format = currentManifestFormat
+	data, err := json.MarshalIndent(&current, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return data, nil
+}
+
+func saveManifest(manifest *Manifest, path string) error {
+	data, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// lastManifestPath is where the manifest of the last backup that reached all
+// providers is kept; incremental backups are computed against it
+func lastManifestPath(stateDir string) string {
+	return filepath.Join(stateDir, "last_manifest.json")
+}
+
+// loadLastManifest returns the last complete manifest, or nil if there is none
+func loadLastManifest(stateDir string) (*Manifest, error) {
+	manifest, err := loadManifest(lastManifestPath(stateDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return manifest, err
+}
+
+func defaultStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".datavault"
+	}
+	return filepath.Join(home, ".datavault")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mediaExtensions are the photos and videos that media mode sorts by date
+var mediaExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".heic": true,
+	".tif": true, ".tiff": true, ".dng": true, ".cr2": true, ".nef": true, ".arw": true,
+	".mp4": true, ".mov": true, ".m4v": true, ".3gp": true,
+}
+
+// mediaStoredPath returns where media mode stores a photo or video: below a
+// folder for the month it was taken, e.g. "2024/06/DCIM/IMG_0001.JPG". The
+// date comes from the EXIF data of photos or the movie header of videos, or
+// the modification time if they have none. It returns "" for other files.
+func mediaStoredPath(path, stored string, modTime time.Time) string {
+	if !mediaExtensions[strings.ToLower(filepath.Ext(path))] {
+		return ""
+	}
+
+	taken, err := mediaDate(path)
+	if err != nil || taken.IsZero() {
+		taken = modTime
+	}
+	return taken.Format("2006/01") + "/" + stored
+}
+
+// mediaDate returns when a photo or video was taken, or the zero time if the
+// file doesn't record it
+func mediaDate(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return time.Time{}, nil
+	}
+
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		return jpegDate(file)
+	case string(header[:4]) == "II*\x00" || string(header[:4]) == "MM\x00*":
+		// Raw photos are TIFF files
+		return exifDate(file)
+	case string(header[4:8]) == "ftyp":
+		return movieDate(file)
+	}
+	return time.Time{}, nil
+}
+
+// jpegDate reads the EXIF date from the APP1 segment of a JPEG file
+func jpegDate(r io.ReadSeeker) (time.Time, error) {
+	if _, err := r.Seek(2, io.SeekStart); err != nil {
+		return time.Time{}, err
+	}
+
+	marker := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xFF {
+			return time.Time{}, err
+		}
+		// Image data starts with the start of scan segment
+		if marker[1] == 0xDA {
+			return time.Time{}, nil
+		}
+
+		length := int64(binary.BigEndian.Uint16(marker[2:])) - 2
+		if marker[1] != 0xE1 {
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return time.Time{}, err
+			}
+			continue
+		}
+
+		data := make([]byte, max(length, 0))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return time.Time{}, err
+		}
+		if exif, ok := bytes.CutPrefix(data, []byte("Exif\x00\x00")); ok {
+			return exifDate(bytes.NewReader(exif))
+		}
+	}
+}
+
+// EXIF tags holding the date a photo was taken
+const (
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// exifDate reads DateTimeOriginal, or else DateTime, from TIFF-structured
+// EXIF data. EXIF dates have no time zone, so they are taken as local time.
+func exifDate(r io.ReaderAt) (time.Time, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return time.Time{}, err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(header[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+
+	ifd0, err := readIFD(r, order, int64(order.Uint32(header[4:])))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	value := ifd0[tagDateTime]
+	if offset, ok := ifd0[tagExifIFD]; ok {
+		exif, err := readIFD(r, order, int64(order.Uint32(offset)))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if original, ok := exif[tagDateTimeOriginal]; ok {
+			value = original
+		}
+	}
+	if value == nil {
+		return time.Time{}, nil
+	}
+
+	// Dates are 20 bytes of ASCII stored elsewhere in the file
+	text := make([]byte, 19)
+	if _, err := r.ReadAt(text, int64(order.Uint32(value))); err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation("2006:01:02 15:04:05", string(text), time.Local)
+}
+
+// readIFD returns the value fields of an image file directory by tag
+func readIFD(r io.ReaderAt, order binary.ByteOrder, offset int64) (map[uint16][]byte, error) {
+	count := make([]byte, 2)
+	if _, err := r.ReadAt(count, offset); err != nil {
+		return nil, err
+	}
+
+	n := int(order.Uint16(count))
+	entries := make([]byte, 12*n)
+	if _, err := r.ReadAt(entries, offset+2); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[uint16][]byte, n)
+	for i := 0; i < n; i++ {
+		entry := entries[12*i : 12*(i+1)]
+		fields[order.Uint16(entry)] = entry[8:]
+	}
+	return fields, nil
+}
+
+// movieEpoch is where the times of MP4 and QuickTime files count from
+var movieEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// movieDate reads the creation time from the movie header (moov/mvhd) of an
+// MP4 or QuickTime file
+func movieDate(r io.ReadSeeker) (time.Time, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	start := int64(0)
+	for _, boxType := range []string{"moov", "mvhd"} {
+		if start, end, err = findBox(r, start, end, boxType); err != nil || start < 0 {
+			return time.Time{}, err
+		}
+	}
+
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return time.Time{}, err
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return time.Time{}, err
+	}
+
+	// Version 1 headers have 64-bit times
+	var seconds uint64
+	if header[0] == 1 {
+		seconds = binary.BigEndian.Uint64(header[4:])
+	} else {
+		seconds = uint64(binary.BigEndian.Uint32(header[4:]))
+	}
+	if seconds == 0 {
+		return time.Time{}, nil
+	}
+	return movieEpoch.Add(time.Duration(seconds) * time.Second), nil
+}
+
+// findBox returns the content range of the first box of the given type
+// between start and end, or -1 if there is none
+func findBox(r io.ReadSeeker, start, end int64, boxType string) (int64, int64, error) {
+	header := make([]byte, 16)
+	for start+8 <= end {
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return 0, 0, err
+		}
+
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		switch size {
+		case 0:
+			size = end - start
+		case 1:
+			if _, err := io.ReadFull(r, header[8:]); err != nil {
+				return 0, 0, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if size < headerSize {
+			return 0, 0, fmt.Errorf("invalid %q box size %d", header[4:8], size)
+		}
+
+		if string(header[4:8]) == boxType {
+			return start + headerSize, start + size, nil
+		}
+		start += size
+	}
+	return -1, -1, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// currentConfigVersion is the config_version written by this DataVault.
+// Files without config_version are version 1.
+const currentConfigVersion = 3
+
+// configMigrations[i] rewrites a decoded config file of version i+1 into
+// version i+2. Migrations work on the raw JSON so they can handle fields the
+// ConfigFile struct no longer has.
+var configMigrations = []func(config map[string]any) error{
+	migrateWebhookURL,
+	migrateDefaultExcludes,
+}
+
+// migrateConfig brings the config file data up to currentConfigVersion,
+// taking data without config_version to be of version unversioned. It
+// returns the migrated data and the version it started from, which equals
+// currentConfigVersion if nothing changed.
+func migrateConfig(data []byte, unversioned int) ([]byte, int, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	version := unversioned
+	if v, ok := raw["config_version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 1 {
+			return nil, 0, fmt.Errorf("invalid config_version %v", v)
+		}
+		version = int(f)
+	}
+	if version > currentConfigVersion {
+		return nil, 0, fmt.Errorf("config_version %d is newer than this DataVault supports (%d), please upgrade", version, currentConfigVersion)
+	}
+	if version == currentConfigVersion {
+		return data, version, nil
+	}
+
+	for v := version; v < currentConfigVersion; v++ {
+		if err := configMigrations[v-1](raw); err != nil {
+			return nil, 0, fmt.Errorf("failed to migrate config from version %d: %w", v, err)
+		}
+	}
+	raw["config_version"] = currentConfigVersion
+
+	migrated, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return migrated, version, nil
+}
+
+// migrateConfigFile migrates the config file at configPath in place, keeping
+// the old file next to it. Loading a config only migrates it in memory; the
+// file is rewritten by commands that write the config anyway and by
+// "config migrate". It returns the migrated data.
+func migrateConfigFile(configPath string, data []byte, unversioned int) ([]byte, error) {
+	migrated, version, err := migrateConfig(data, unversioned)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	if version == currentConfigVersion {
+		return data, nil
+	}
+
+	if err := checkWritable(configPath); err != nil {
+		return nil, fmt.Errorf("not migrating %s to version %d: %w", configPath, currentConfigVersion, err)
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(configPath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, version)
+	if err := os.WriteFile(backupPath, data, mode); err != nil {
+		return nil, fmt.Errorf("not migrating %s to version %d, failed to back it up: %w", configPath, currentConfigVersion, err)
+	}
+	if err := os.WriteFile(configPath, migrated, mode); err != nil {
+		return nil, fmt.Errorf("failed to write migrated config file: %w", err)
+	}
+
+	log.Printf("Migrated config file %s from version %d to %d, the old file is kept at %s", configPath, version, currentConfigVersion, backupPath)
+	return migrated, nil
+}
+
+// migrateConfigFiles rewrites the main config file and its included files in
+// the current schema, keeping the old files next to them. Includes go first:
+// they get a config_version of their own, so they are still read right if
+// the main file can't be migrated.
+func migrateConfigFiles(configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	migrated, version, err := migrateConfig(data, 1)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+
+	var config ConfigFile
+	if err := json.Unmarshal(migrated, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	includes, err := includedFiles(config.Include, filepath.Dir(configPath))
+	if err != nil {
+		return err
+	}
+	for _, include := range includes {
+		data, err := os.ReadFile(include)
+		if err != nil {
+			return fmt.Errorf("failed to read included config %s: %w", include, err)
+		}
+		// Includes without config_version are as old as the main file
+		if _, err := migrateConfigFile(include, data, version); err != nil {
+			return err
+		}
+	}
+
+	_, err = migrateConfigFile(configPath, data, 1)
+	return err
+}
+
+// runConfigMigrate is "datavault config migrate"
+func runConfigMigrate(configPath string) error {
+	if err := migrateConfigFiles(configPath); err != nil {
+		return err
+	}
+	fmt.Printf("%s and its included files are at config version %d\n", configPath, currentConfigVersion)
+	return nil
+}
+
+// migrateWebhookURL replaces notifications.webhook_url of version 1 with the
+// slack channel it was a shorthand for. Later versions don't read it.
+func migrateWebhookURL(config map[string]any) error {
+	notifications, ok := config["notifications"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	url, ok := notifications["webhook_url"].(string)
+	if !ok {
+		return nil
+	}
+	delete(notifications, "webhook_url")
+	if url == "" {
+		return nil
+	}
+
+	channels, _ := notifications["channels"].([]any)
+	for _, c := range channels {
+		if channel, ok := c.(map[string]any); ok && channel["type"] == "slack" && channel["url"] == url {
+			return nil
+		}
+	}
+	notifications["channels"] = append(channels, map[string]any{"type": "slack", "url": url})
+	return nil
+}
+
+// oldDefaultExcludes is the excludes list default configs of version 2 and
+// earlier were created with
+var oldDefaultExcludes = []any{".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"}
+
+// migrateDefaultExcludes removes the excludes list of old default configs.
+// Before version 3 excludes weren't applied, and dropping .git folders and
+// log files now would silently change what these configs back up. Lists
+// the user wrote are kept and take effect.
+func migrateDefaultExcludes(config map[string]any) error {
+	excludes, ok := config["excludes"].([]any)
+	if ok && slices.Equal(excludes, oldDefaultExcludes) {
+		delete(config, "excludes")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		unversioned int
+		wantVersion int    // Version the data started from
+		want        string // Migrated data, compared as JSON
+		wantErr     string
+	}{
+		{
+			name:        "version 1 to current",
+			in:          `{"source_folder": "/data", "excludes": [".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"], "notifications": {"webhook_url": "https://hooks.example/a"}}`,
+			unversioned: 1,
+			wantVersion: 1,
+			want:        `{"config_version": 3, "source_folder": "/data", "notifications": {"channels": [{"type": "slack", "url": "https://hooks.example/a"}]}}`,
+		},
+		{
+			name:        "webhook already a channel",
+			in:          `{"notifications": {"webhook_url": "https://hooks.example/a", "channels": [{"type": "slack", "url": "https://hooks.example/a"}]}}`,
+			unversioned: 1,
+			wantVersion: 1,
+			want:        `{"config_version": 3, "notifications": {"channels": [{"type": "slack", "url": "https://hooks.example/a"}]}}`,
+		},
+		{
+			name:        "custom excludes are kept",
+			in:          `{"config_version": 2, "excludes": ["*.log"]}`,
+			unversioned: 1,
+			wantVersion: 2,
+			want:        `{"config_version": 3, "excludes": ["*.log"]}`,
+		},
+		{
+			name:        "current version is unchanged",
+			in:          `{"config_version": 3, "excludes": [".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"]}`,
+			unversioned: 1,
+			wantVersion: 3,
+			want:        `{"config_version": 3, "excludes": [".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"]}`,
+		},
+		{
+			name:        "unversioned include of a current main file",
+			in:          `{"excludes": [".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"]}`,
+			unversioned: 3,
+			wantVersion: 3,
+			want:        `{"excludes": [".git", ".DS_Store", "Thumbs.db", "*.tmp", "*.log"]}`,
+		},
+		{
+			name:        "newer version is refused",
+			in:          `{"config_version": 4}`,
+			unversioned: 1,
+			wantErr:     "newer than this DataVault supports",
+		},
+		{
+			name:        "invalid version",
+			in:          `{"config_version": "2"}`,
+			unversioned: 1,
+			wantErr:     "invalid config_version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, version, err := migrateConfig([]byte(tt.in), tt.unversioned)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("started from version %d, want %d", version, tt.wantVersion)
+			}
+
+			var gotJSON, wantJSON any
+			if err := json.Unmarshal(got, &gotJSON); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotJSON, wantJSON) {
+				t.Errorf("migrated to %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadConfigDoesNotRewrite checks that loading an old config migrates it
+// in memory only, and that config migrate rewrites it and its includes
+func TestLoadConfigDoesNotRewrite(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "datavault.json")
+	includePath := filepath.Join(dir, "notify.json")
+	mainData := `{"source_folder": "/data", "include": ["notify.json"]}`
+	includeData := `{"notifications": {"webhook_url": "https://hooks.example/a"}}`
+	if err := os.WriteFile(configPath, []byte(mainData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(includePath, []byte(includeData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Notifications == nil || len(config.Notifications.Channels) != 1 {
+		t.Errorf("the include's webhook_url wasn't migrated: %+v", config.Notifications)
+	}
+	for path, want := range map[string]string{configPath: mainData, includePath: includeData} {
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("loading rewrote %s", filepath.Base(path))
+		}
+	}
+	if _, err := os.Stat(configPath + ".v1.bak"); err == nil {
+		t.Error("loading left a backup of the config file")
+	}
+
+	if err := migrateConfigFiles(configPath); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{configPath, includePath} {
+		data, _ := os.ReadFile(path)
+		if _, version, err := migrateConfig(data, 1); err != nil || version != currentConfigVersion {
+			t.Errorf("%s is at version %d after config migrate (%v)", filepath.Base(path), version, err)
+		}
+		if _, err := os.Stat(path + ".v1.bak"); err != nil {
+			t.Errorf("the old %s wasn't kept: %v", filepath.Base(path), err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	shareProbeTimeout   = 30 * time.Second // A share not listing the source by then is taken as hanging
+	shareRetryDelay     = 30 * time.Second // Doubles with each retry
+	defaultMountRetries = 3
+	shareWalkers        = 16 // Directories read at the same time on network shares
+)
+
+// networkMountTypes are the fstab filesystem types of network shares
+var networkMountTypes = map[string]bool{
+	"nfs": true, "nfs4": true, "cifs": true, "smb3": true, "smbfs": true,
+	"9p": true, "ceph": true, "afs": true, "fuse.sshfs": true, "sshfs": true,
+}
+
+// awaitSource waits for the network share holding the source folder if it is
+// not mounted, disconnected or not responding. An unmounted share listed in
+// fstab is mounted again. It gives up after mount_retries attempts, doubling
+// the delay each time, and returns why the source is unavailable.
+func (bm *BackupManager) awaitSource(ctx context.Context, source string) error {
+	retries := bm.config.MountRetries
+	if retries == 0 {
+		retries = defaultMountRetries
+	}
+
+	delay := shareRetryDelay
+	for attempt := 0; ; attempt++ {
+		mountPoint, err := bm.shareProblem(source)
+		if err == nil {
+			if attempt > 0 {
+				log.Printf("Source folder %s is available again", source)
+			}
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+
+		log.Printf("Warning: %v, retrying in %s", err, delay)
+		if mountPoint != "" {
+			mountShare(ctx, mountPoint)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// shareProblem returns why the network share holding source can't be read,
+// and its fstab mount point if mounting it may help. Local sources are
+// checked by checkSource.
+func (bm *BackupManager) shareProblem(source string) (string, error) {
+	mountPoint, fsType := expectedMount(source)
+	if mountPoint != "" && networkMountTypes[fsType] && !bm.config.AllowEmptySource && !isMounted(mountPoint) {
+		return mountPoint, fmt.Errorf("source folder %s is on the %s share %s, which is not mounted", source, fsType, mountPoint)
+	}
+
+	// A share whose server went away may hang instead of failing; the read
+	// is abandoned then and finishes or fails in the background
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.ReadDir(source)
+		if err != nil && !disconnected(err, shareType(source) != "" || networkMountTypes[fsType]) {
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", fmt.Errorf("the share holding source folder %s is disconnected: %w", source, err)
+		}
+		return "", nil
+	case <-time.After(shareProbeTimeout):
+		return "", fmt.Errorf("the share holding source folder %s is not responding after %s", source, shareProbeTimeout)
+	}
+}
+
+// disconnected reports whether err means the server of a network share is
+// gone. I/O errors only count on shares; on a local disk they are reported
+// by staging.
+func disconnected(err error, share bool) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.ENOTCONN) ||
+		errors.Is(err, syscall.EHOSTDOWN) || (share && errors.Is(err, syscall.EIO))
+}
+
+// mountShare tries to mount an fstab entry, which needs root or the "user"
+// mount option
+func mountShare(ctx context.Context, mountPoint string) {
+	cmd := exec.CommandContext(ctx, "mount", mountPoint)
+	cmd.Env = childEnv()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Warning: Failed to mount %s: %v %s", mountPoint, err, strings.TrimSpace(string(output)))
+		return
+	}
+	log.Printf("Mounted %s", mountPoint)
+}
+
+// walkers returns how many directories staging reads at the same time:
+// walk_parallelism if set, more on network shares where each stat call waits
+// for the server, otherwise one
+func (bm *BackupManager) walkers(source string) int {
+	if bm.config.WalkParallelism > 0 {
+		return bm.config.WalkParallelism
+	}
+	if shareType(source) != "" {
+		return shareWalkers
+	}
+	return 1
+}
@@ -0,0 +1,19 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// networkFilesystems are the network filesystems macOS mounts
+var networkFilesystems = map[string]bool{"nfs": true, "smbfs": true, "afpfs": true, "webdav": true}
+
+// shareType returns the type of the network filesystem holding path, or ""
+// if it is local
+func shareType(path string) string {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	if name := unix.ByteSliceToString(stat.Fstypename[:]); networkFilesystems[name] {
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,24 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// networkFilesystems names the network filesystems by their statfs magic
+var networkFilesystems = map[uint32]string{
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.SMB_SUPER_MAGIC:  "smb",
+	unix.SMB2_SUPER_MAGIC: "smb",
+	unix.CIFS_SUPER_MAGIC: "cifs",
+	unix.V9FS_MAGIC:       "9p",
+	unix.CEPH_SUPER_MAGIC: "ceph",
+	unix.AFS_SUPER_MAGIC:  "afs",
+}
+
+// shareType returns the type of the network filesystem holding path, or ""
+// if it is local
+func shareType(path string) string {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	return networkFilesystems[uint32(stat.Type)]
+}
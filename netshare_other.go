@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// shareType can't tell network filesystems apart on this platform, so
+// sources are treated as local
+func shareType(path string) string {
+	return ""
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// shareType returns "smb" if path is on a network share, either as a UNC
+// path or on a mapped drive, or "" if it is local
+func shareType(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	volume := filepath.VolumeName(abs)
+	if strings.HasPrefix(volume, `\\`) {
+		return "smb"
+	}
+
+	root, err := windows.UTF16PtrFromString(volume + `\`)
+	if err != nil {
+		return ""
+	}
+	if windows.GetDriveType(root) == windows.DRIVE_REMOTE {
+		return "smb"
+	}
+	return ""
+}
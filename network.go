@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// networkTransport returns the transport provider requests go through: the
+// default one, or one dialing by the network settings. Host names stay in
+// the requests, so TLS still verifies the provider's certificates.
+func networkTransport(network NetworkConfig) http.RoundTripper {
+	if network.IPVersion == "" && len(network.Hosts) == 0 && network.Resolver == "" {
+		return chaosTransport(nil)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if network.Resolver != "" {
+		resolver := resolverAddress(network.Resolver)
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, proto, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := network.Hosts[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		if network.IPVersion != "" {
+			proto = "tcp" + network.IPVersion
+		}
+		return dialer.DialContext(ctx, proto, addr)
+	}
+	return chaosTransport(transport)
+}
+
+// resolverAddress adds the DNS port to a resolver given without one
+func resolverAddress(resolver string) string {
+	if _, _, err := net.SplitHostPort(resolver); err == nil {
+		return resolver
+	}
+	return net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+}
+
+// validateNetwork checks the network settings
+func validateNetwork(network NetworkConfig) error {
+	switch network.IPVersion {
+	case "", "4", "6":
+	default:
+		return fmt.Errorf("invalid network ip_version %q: must be 4 or 6", network.IPVersion)
+	}
+
+	for host, ip := range network.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid network host %s: %q is not an IP address", host, ip)
+		}
+	}
+
+	if network.Resolver != "" {
+		host, _, err := net.SplitHostPort(resolverAddress(network.Resolver))
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid network resolver %q: must be an IP address with an optional port", network.Resolver)
+		}
+	}
+	return nil
+}
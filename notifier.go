@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification is a message about backups, rendered once and delivered over
+// every configured channel
+type Notification struct {
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier delivers notifications over one channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+// notifierFactories creates notifiers by channel type. New channels only need
+// an entry here.
+var notifierFactories = map[string]func(ChannelConfig) (Notifier, error){
+	"webhook": newWebhookNotifier,
+	"slack":   newSlackNotifier,
+	"email":   newEmailNotifier,
+	"desktop": newDesktopNotifier,
+}
+
+func newNotifier(config ChannelConfig) (Notifier, error) {
+	factory, ok := notifierFactories[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported notification channel type: %q", config.Type)
+	}
+
+	// Slack webhook URLs are credentials of their own
+	addSecret(config.Password)
+	if config.Type == "slack" {
+		addSecret(config.URL)
+	}
+	return factory(config)
+}
+
+// notifyRetries is how often a failed delivery is attempted again
+const notifyRetries = 3
+
+// deliver sends n with retries and exponential backoff
+func deliver(ctx context.Context, notifier Notifier, n Notification) error {
+	backoff := 2 * time.Second
+
+	var err error
+	for attempt := 0; attempt <= notifyRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		if err = notifier.Notify(ctx, n); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", notifier.Name(), err)
+}
+
+// webhookNotifier posts the notification as JSON
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(config ChannelConfig) (Notifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook notifications need a url")
+	}
+	return &webhookNotifier{url: config.URL, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (w *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, w.client, w.url, n)
+}
+
+// slackNotifier posts to a Slack (or Mattermost) incoming webhook
+type slackNotifier struct {
+	webhookNotifier
+}
+
+func newSlackNotifier(config ChannelConfig) (Notifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("slack notifications need a url")
+	}
+	return &slackNotifier{webhookNotifier{url: config.URL, client: &http.Client{Timeout: 30 * time.Second}}}, nil
+}
+
+func (s *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": n.Text})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// emailNotifier sends mail through an SMTP server
+type emailNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newEmailNotifier(config ChannelConfig) (Notifier, error) {
+	if config.SMTPHost == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email notifications need smtp_host, from and to")
+	}
+
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.SMTPHost)
+	}
+
+	return &emailNotifier{
+		addr: config.SMTPHost + ":" + strconv.Itoa(port),
+		auth: auth,
+		from: config.From,
+		to:   config.To,
+	}, nil
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, n Notification) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+
+	// net/smtp has no context support
+	return smtp.SendMail(e.addr, e.auth, e.from, e.to, []byte(msg.String()))
+}
+
+// desktopNotifier shows a desktop notification with the platform's tool
+type desktopNotifier struct{}
+
+func newDesktopNotifier(config ChannelConfig) (Notifier, error) {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return desktopNotifier{}, nil
+	}
+	return nil, fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+}
+
+func (desktopNotifier) Name() string {
+	return "desktop"
+}
+
+func (desktopNotifier) Notify(ctx context.Context, n Notification) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(n.Text), strconv.Quote(n.Subject))
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	} else {
+		cmd = exec.CommandContext(ctx, "notify-send", n.Subject, n.Text)
+	}
+	cmd.Env = childEnv()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Defaults for notification aggregation
+const (
+	defaultDigestInterval = 24 * time.Hour
+	defaultNotifyRate     = 15 * time.Minute
+)
+
+// alerter turns backup results into notifications without flooding the
+// channels: only changes between succeeding, incomplete and failing backups
+// are sent right away, repeated failures are summed up in a periodic digest, and messages within a
+// channel's rate limit of the previous one are held back and sent together.
+type alerter struct {
+	mu       sync.Mutex
+	channels []*alertChannel
+	digest   time.Duration
+	jobs     map[string]*alertState
+	template *template.Template // Replaces the built-in message texts
+}
+
+// alertChannel is a notifier with its own rate limit
+type alertChannel struct {
+	notifier  Notifier
+	rateLimit time.Duration
+	lastSent  time.Time
+	held      []Notification // Waiting for the rate limit
+}
+
+// alertState tracks the health of one job
+type alertState struct {
+	failing  bool
+	partial  bool // Backups are made, but incomplete
+	since    time.Time
+	failures int // Failures since the last message about the job
+	lastErr  string
+}
+
+// newAlerter creates the configured notifiers. ValidateConfig has checked
+// them, so broken channels are only logged.
+func newAlerter(config Config) *alerter {
+	a := &alerter{
+		digest: config.NotifyDigest,
+		jobs:   make(map[string]*alertState),
+	}
+
+	var err error
+	if a.template, err = loadTemplate(config.NotifyTemplate); err != nil {
+		log.Printf("Warning: Ignoring notification template: %v", err)
+	}
+
+	for _, channel := range config.NotifyChannels {
+		notifier, err := newNotifier(channel)
+		if err != nil {
+			log.Printf("Warning: Ignoring notification channel: %v", err)
+			continue
+		}
+
+		rateLimit := config.NotifyRateLimit
+		if limit, err := time.ParseDuration(channel.RateLimit); err == nil {
+			rateLimit = limit
+		}
+		a.channels = append(a.channels, &alertChannel{notifier: notifier, rateLimit: rateLimit})
+	}
+
+	if len(a.channels) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Record notes the result of a backup run of job
+func (a *alerter) Record(job string, err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	state, ok := a.jobs[job]
+	if !ok {
+		state = &alertState{}
+		a.jobs[job] = state
+	}
+
+	switch {
+	case isPartial(err) && !state.failing && !state.partial:
+		*state = alertState{partial: true, since: time.Now(), lastErr: err.Error()}
+		a.post("DataVault: "+job+" incomplete", a.render(NotificationData{
+			Event: "partial",
+			Job:   job,
+			Error: state.lastErr,
+			Since: state.since,
+			Text:  fmt.Sprintf("DataVault: backups of job %s are incomplete: %v", job, err),
+		}))
+	case err != nil && !isPartial(err) && !state.failing:
+		*state = alertState{failing: true, since: time.Now(), lastErr: err.Error()}
+		a.post("DataVault: "+job+" failing", a.render(NotificationData{
+			Event: "failing",
+			Job:   job,
+			Error: state.lastErr,
+			Since: state.since,
+			Text:  fmt.Sprintf("DataVault: backups of job %s are failing: %v", job, err),
+		}))
+	case err != nil:
+		state.failures++
+		state.lastErr = err.Error()
+	case state.failing || state.partial:
+		trouble := "failing"
+		if !state.failing {
+			trouble = "being incomplete"
+		}
+		a.post("DataVault: "+job+" recovered", a.render(NotificationData{
+			Event: "recovered",
+			Job:   job,
+			Since: state.since,
+			Text: fmt.Sprintf("DataVault: backups of job %s are succeeding again after %s since %s",
+				job, trouble, state.since.Format(time.RFC1123)),
+		}))
+		*state = alertState{}
+	}
+}
+
+// Run sends digests and held messages until ctx is cancelled
+func (a *alerter) Run(ctx context.Context) {
+	if a == nil {
+		return
+	}
+
+	digest := time.NewTicker(a.digest)
+	defer digest.Stop()
+
+	// Held messages go out as soon as the rate limit allows
+	flush := time.NewTicker(time.Minute)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			a.mu.Lock()
+			for _, channel := range a.channels {
+				channel.flush()
+			}
+			a.mu.Unlock()
+		case <-digest.C:
+			a.sendDigest()
+		}
+	}
+}
+
+// sendDigest reports jobs that kept failing or stayed incomplete since their
+// last message
+func (a *alerter) sendDigest() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var lines []string
+	for job, state := range a.jobs {
+		if !(state.failing || state.partial) || state.failures == 0 {
+			continue
+		}
+		trouble := "failing"
+		if !state.failing {
+			trouble = "incomplete"
+		}
+		lines = append(lines, a.render(NotificationData{
+			Event:    "digest",
+			Job:      job,
+			Error:    state.lastErr,
+			Since:    state.since,
+			Failures: state.failures,
+			Text: fmt.Sprintf("DataVault: backups of job %s are still %s since %s (%d more failures, last error: %s)",
+				job, trouble, state.since.Format(time.RFC1123), state.failures, state.lastErr),
+		}))
+		state.failures = 0
+	}
+
+	if len(lines) > 0 {
+		a.post("DataVault: failure digest", strings.Join(lines, "\n"))
+	}
+}
+
+// Send posts a message that isn't about a single job, such as a report
+func (a *alerter) Send(subject, text string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.post(subject, text)
+}
+
+// render formats a message with the notification template, if any
+func (a *alerter) render(data NotificationData) string {
+	return renderTemplate(a.template, data, data.Text)
+}
+
+// post queues a message on every channel; a.mu must be held
+func (a *alerter) post(subject, text string) {
+	n := Notification{Subject: subject, Text: text, Time: time.Now()}
+	for _, channel := range a.channels {
+		channel.held = append(channel.held, n)
+		channel.flush()
+	}
+}
+
+// flush sends the held messages as one if the rate limit allows; the
+// alerter's mutex must be held
+func (c *alertChannel) flush() {
+	if len(c.held) == 0 || time.Since(c.lastSent) < c.rateLimit {
+		return
+	}
+
+	n := c.held[0]
+	if len(c.held) > 1 {
+		texts := make([]string, len(c.held))
+		for i, held := range c.held {
+			texts[i] = held.Text
+		}
+		n = Notification{
+			Subject: fmt.Sprintf("DataVault: %d notifications", len(c.held)),
+			Text:    strings.Join(texts, "\n"),
+			Time:    time.Now(),
+		}
+	}
+	c.held = nil
+	c.lastSent = time.Now()
+
+	go func(notifier Notifier) {
+		if err := deliver(context.Background(), notifier, n); err != nil {
+			log.Printf("Warning: Failed to send notification: %v", err)
+		}
+	}(c.notifier)
+}
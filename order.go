@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+)
+
+// Upload orders decide which files of a backup reach a provider first
+const (
+	orderSmallest = "smallest" // Many files done early, for quick visible progress
+	orderLargest  = "largest"  // Long transfers first, to use a night's window fully
+	orderChanged  = "changed"  // Files changed since the last backup first
+)
+
+// orderedBatch is how many files are handed to a provider at a time. Progress
+// is recorded per batch, so a resumed upload may send up to one batch again.
+const orderedBatch = 50
+
+// foldersOnly lets a provider's folder upload create the folder tree of a
+// backup without uploading any file
+type foldersOnly struct {
+	UploadProgress
+}
+
+func (foldersOnly) Done(relPath string) bool { return true }
+func (foldersOnly) MarkDone(relPath string)  {}
+
+// uploadOrdered uploads the files stored in a backup in the configured order
+// instead of directory order. The folder tree is created first, then the
+// files are sent in batches.
+func (bm *BackupManager) uploadOrdered(ctx context.Context, p Provider, queue *uploadQueue, staged *Manifest, progress UploadProgress) error {
+	if err := p.UploadFolder(ctx, queue.UploadPath, queue.BackupName, foldersOnly{progress}); err != nil {
+		return err
+	}
+
+	var entries []ManifestEntry
+	for _, entry := range staged.Files {
+		if entry.Backup == staged.BackupName && !entry.isDuplicate() && !progress.Done(entry.storedPath()) {
+			entries = append(entries, entry)
+		}
+	}
+	bm.sortUploads(entries)
+
+	failed := 0
+	for start := 0; start < len(entries); start += orderedBatch {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		batch := make([]string, 0, orderedBatch)
+		for _, entry := range entries[start:min(start+orderedBatch, len(entries))] {
+			batch = append(batch, entry.storedPath())
+		}
+
+		if qp, ok := progress.(*queueProgress); ok {
+			qp.uploading(batch[0])
+		}
+		if err := p.UploadFiles(ctx, queue.UploadPath, queue.BackupName, batch); err != nil {
+			log.Printf("Failed to upload %d files to %s: %v", len(batch), providerLabel(p.Name()), err)
+			failed += len(batch)
+			continue
+		}
+		for _, relPath := range batch {
+			progress.MarkDone(relPath)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to upload", failed, len(entries))
+	}
+	return nil
+}
+
+// sortUploads sorts entries into the configured upload order, with files
+// under priority paths ahead of all others. Ties keep path order.
+func (bm *BackupManager) sortUploads(entries []ManifestEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	bm.sortByOrder(entries)
+
+	if len(bm.config.PriorityPaths) == 0 {
+		return
+	}
+	ranks := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		ranks[entry.Path] = priorityRank(bm.config.PriorityPaths, entry.Path)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return ranks[entries[i].Path] < ranks[entries[j].Path]
+	})
+}
+
+// priorityRank returns the index of the first priority pattern matching the
+// file at relPath or one of its parent directories, or len(patterns) if none
+// does
+func priorityRank(patterns []string, relPath string) int {
+	for i, pattern := range patterns {
+		for p := relPath; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return i
+			}
+		}
+	}
+	return len(patterns)
+}
+
+// sortByOrder stably sorts entries by the upload_order policy
+func (bm *BackupManager) sortByOrder(entries []ManifestEntry) {
+	switch bm.config.UploadOrder {
+	case orderSmallest:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Size < entries[j].Size
+		})
+	case orderLargest:
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Size > entries[j].Size
+		})
+	case orderChanged:
+		previous, err := loadLastManifest(bm.config.StateDir)
+		if err != nil {
+			log.Printf("Warning: Failed to load last manifest, uploading in path order: %v", err)
+		}
+		if previous == nil {
+			return
+		}
+
+		old := previous.index()
+		changed := func(entry ManifestEntry) bool {
+			prev, ok := old[entry.Path]
+			return !ok || prev.Size != entry.Size || !prev.ModTime.Equal(entry.ModTime)
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return changed(entries[i]) && !changed(entries[j])
+		})
+	}
+}
@@ -9,17 +9,31 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// pcloudEndpoint is the pCloud API for accounts in the US region
+const pcloudEndpoint = "https://api.pcloud.com"
+
+// PCloudClient is safe for concurrent use. Folder IDs are cached, since
+// pCloud addresses folders by ID and looking one up by name lists its parent.
 type PCloudClient struct {
 	authToken    string
+	rootPath     string // Slash-separated path of the DataVault root folder
 	baseURL      string
-	client       *http.Client
+	client       *http.Client // Bounded by the configured timeouts
+	setup        lazyInit
 	rootFolderID int64
+
+	foldersMu sync.Mutex
+	folders   map[string]int64 // Keyed by slash-separated path below the root, e.g. "backup_x/docs"
 }
 
 type PCloudResponse struct {
@@ -46,38 +60,72 @@ type PCloudFile struct {
 	} `json:"metadata"`
 }
 
+type PCloudEntry struct {
+	Name     string        `json:"name"`
+	FolderID int64         `json:"folderid,omitempty"`
+	FileID   int64         `json:"fileid,omitempty"`
+	IsFolder bool          `json:"isfolder"`
+	Size     int64         `json:"size,omitempty"`
+	Modified string        `json:"modified,omitempty"`
+	Created  string        `json:"created,omitempty"`
+	Contents []PCloudEntry `json:"contents,omitempty"`
+}
+
 type PCloudListFolder struct {
 	PCloudResponse
-	Metadata struct {
-		Contents []struct {
-			Name     string `json:"name"`
-			FolderID int64  `json:"folderid,omitempty"`
-			FileID   int64  `json:"fileid,omitempty"`
-			IsFolder bool   `json:"isfolder"`
-		} `json:"contents"`
-	} `json:"metadata"`
+	Metadata PCloudEntry `json:"metadata"`
+}
+
+type PCloudFileLink struct {
+	PCloudResponse
+	Path  string   `json:"path"`
+	Hosts []string `json:"hosts"`
 }
 
-func NewPCloudClient(authToken string) *PCloudClient {
-	client := &PCloudClient{
+type PCloudPublink struct {
+	PCloudResponse
+	LinkID int64  `json:"linkid"`
+	Code   string `json:"code"`
+	Link   string `json:"link"`
+}
+
+// NewPCloudClient returns a client for the pCloud API at endpoint, or the US
+// API if endpoint is empty
+func NewPCloudClient(authToken, rootPath, endpoint string, transport http.RoundTripper, timeouts providerTimeouts) *PCloudClient {
+	if endpoint == "" {
+		endpoint = pcloudEndpoint
+	}
+	addSecret(authToken)
+	return &PCloudClient{
 		authToken: authToken,
-		baseURL:   "https://api.pcloud.com",
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		rootPath:  rootPath,
+		baseURL:   strings.TrimSuffix(endpoint, "/"),
+		folders:   make(map[string]int64),
+		client: &http.Client{Transport: &timeoutTransport{
+			base:     transport,
+			timeouts: timeouts,
+			transfer: pcloudTransfer,
+		}},
 	}
+}
 
-	if err := client.initialize(); err != nil {
-		log.Printf("Failed to initialize pCloud client: %v", err)
-		return nil
+// ready initializes the client unless that was done before. A failed
+// initialization is tried again by the next call.
+func (pc *PCloudClient) ready(ctx context.Context) error {
+	if err := pc.setup.do(ctx, pc.Name(), pc.initialize); err != nil {
+		return fmt.Errorf("failed to initialize pCloud client: %w", err)
 	}
+	return nil
+}
 
-	return client
+// health returns whether the client is initialized
+func (pc *PCloudClient) health() (string, error) {
+	return pc.setup.health()
 }
 
-func (pc *PCloudClient) initialize() error {
+func (pc *PCloudClient) initialize(ctx context.Context) error {
 	// Find or create DataVault root folder
-	if err := pc.ensureRootFolder(); err != nil {
+	if err := pc.ensureRootFolder(ctx); err != nil {
 		return fmt.Errorf("failed to setup root folder: %w", err)
 	}
 
@@ -85,28 +133,28 @@ func (pc *PCloudClient) initialize() error {
 }
 
 func (pc *PCloudClient) makeRequest(ctx context.Context, endpoint string, params map[string]string) ([]byte, error) {
-	url := pc.baseURL + "/" + endpoint
+	reqURL := pc.baseURL + "/" + endpoint
 
-	// Add auth token to params
-	if params == nil {
-		params = make(map[string]string)
+	// Parameters go in a POST body, so the token never appears in a URL
+	// that proxies or servers might log
+	form := url.Values{}
+	for key, value := range params {
+		form.Set(key, value)
 	}
-	params["access_token"] = pc.authToken
+	form.Set("access_token", pc.authToken)
 
-	// Build query parameters
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
-
-	q := req.URL.Query()
-	for key, value := range params {
-		q.Add(key, value)
-	}
-	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := pc.client.Do(req)
 	if err != nil {
+		// Errors echo the URL, which must not leak whatever it holds
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redact(urlErr.URL)
+		}
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
@@ -117,67 +165,33 @@ func (pc *PCloudClient) makeRequest(ctx context.Context, endpoint string, params
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("HTTP error %d: %s", resp.StatusCode, redact(string(body)))
 	}
 
 	return body, nil
 }
 
-func (pc *PCloudClient) ensureRootFolder() error {
-	// List contents of root folder to find DataVault folder
-	body, err := pc.makeRequest(context.Background(), "listfolder", map[string]string{
-		"folderid": "0", // Root folder
-	})
+func (pc *PCloudClient) ensureRootFolder(ctx context.Context) error {
+	// Find or create each folder of the root path, starting at the top folder
+	folderID, err := pc.createFolderPath(ctx, cleanRemotePath(pc.rootPath), map[string]int64{".": 0})
 	if err != nil {
-		return fmt.Errorf("failed to list root folder: %w", err)
-	}
-
-	var listResp PCloudListFolder
-	if err := json.Unmarshal(body, &listResp); err != nil {
-		return fmt.Errorf("failed to parse list response: %w", err)
-	}
-
-	if listResp.Result != 0 {
-		return fmt.Errorf("pCloud API error: %s", listResp.Error)
+		return fmt.Errorf("failed to find or create root folder: %w", err)
 	}
 
-	// Look for existing DataVault folder
-	for _, item := range listResp.Metadata.Contents {
-		if item.IsFolder && item.Name == "DataVault" {
-			pc.rootFolderID = item.FolderID
-			log.Printf("Found existing DataVault folder: %d", pc.rootFolderID)
-			return nil
-		}
-	}
-
-	// Create DataVault folder if it doesn't exist
-	body, err = pc.makeRequest(context.Background(), "createfolder", map[string]string{
-		"folderid": "0",
-		"name":     "DataVault",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create DataVault folder: %w", err)
-	}
-
-	var folderResp PCloudFolder
-	if err := json.Unmarshal(body, &folderResp); err != nil {
-		return fmt.Errorf("failed to parse folder response: %w", err)
-	}
-
-	if folderResp.Result != 0 {
-		return fmt.Errorf("pCloud API error: %s", folderResp.Error)
-	}
-
-	pc.rootFolderID = folderResp.Metadata.FolderID
-	log.Printf("Created DataVault folder: %d", pc.rootFolderID)
+	pc.rootFolderID = folderID
+	log.Printf("Using DataVault folder %s: %d", pc.rootPath, pc.rootFolderID)
 	return nil
 }
 
-func (pc *PCloudClient) UploadFolder(ctx context.Context, localPath, backupName string) error {
+func (pc *PCloudClient) UploadFolder(ctx context.Context, localPath, backupName string, progress UploadProgress) error {
+	if err := pc.ready(ctx); err != nil {
+		return err
+	}
+
 	log.Printf("Uploading %s to pCloud as %s", localPath, backupName)
 
-	// Create backup folder
-	body, err := pc.makeRequest(ctx, "createfolder", map[string]string{
+	// Create backup folder, reusing the one of an interrupted upload
+	body, err := pc.makeRequest(ctx, pc.createFolderEndpoint(progress), map[string]string{
 		"folderid": strconv.FormatInt(pc.rootFolderID, 10),
 		"name":     backupName,
 	})
@@ -196,12 +210,22 @@ func (pc *PCloudClient) UploadFolder(ctx context.Context, localPath, backupName
 
 	backupFolderID := folderResp.Metadata.FolderID
 	log.Printf("Created backup folder: %d", backupFolderID)
+	pc.cacheFolder(backupName, backupFolderID)
 
 	// Upload files recursively
-	return pc.uploadDirectoryRecursive(ctx, localPath, backupFolderID, "")
+	return pc.uploadDirectoryRecursive(ctx, localPath, backupFolderID, "", progress)
 }
 
-func (pc *PCloudClient) uploadDirectoryRecursive(ctx context.Context, localPath string, parentFolderID int64, relativePath string) error {
+// createFolderEndpoint returns the API method for creating folders during an
+// upload. Resumed uploads must not fail on folders created before.
+func (pc *PCloudClient) createFolderEndpoint(progress UploadProgress) string {
+	if progress.Resuming() {
+		return "createfolderifnotexists"
+	}
+	return "createfolder"
+}
+
+func (pc *PCloudClient) uploadDirectoryRecursive(ctx context.Context, localPath string, parentFolderID int64, relativePath string, progress UploadProgress) error {
 	entries, err := os.ReadDir(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
@@ -219,7 +243,7 @@ func (pc *PCloudClient) uploadDirectoryRecursive(ctx context.Context, localPath
 
 		if entry.IsDir() {
 			// Create subdirectory
-			body, err := pc.makeRequest(ctx, "createfolder", map[string]string{
+			body, err := pc.makeRequest(ctx, pc.createFolderEndpoint(progress), map[string]string{
 				"folderid": strconv.FormatInt(parentFolderID, 10),
 				"name":     entry.Name(),
 			})
@@ -240,14 +264,21 @@ func (pc *PCloudClient) uploadDirectoryRecursive(ctx context.Context, localPath
 			}
 
 			// Recursively upload subdirectory
-			if err := pc.uploadDirectoryRecursive(ctx, fullPath, folderResp.Metadata.FolderID, currentRelativePath); err != nil {
+			if err := pc.uploadDirectoryRecursive(ctx, fullPath, folderResp.Metadata.FolderID, currentRelativePath, progress); err != nil {
 				log.Printf("Failed to upload subdirectory %s: %v", currentRelativePath, err)
 			}
 		} else {
-			// Upload file
+			relPath := filepath.ToSlash(currentRelativePath)
+			if progress.Done(relPath) {
+				continue
+			}
+
+			// Upload file; pCloud overwrites a copy sent before an interruption
 			if err := pc.uploadFile(ctx, fullPath, entry.Name(), parentFolderID); err != nil {
 				log.Printf("Failed to upload file %s: %v", currentRelativePath, err)
+				continue
 			}
+			progress.MarkDone(relPath)
 		}
 	}
 
@@ -261,6 +292,12 @@ func (pc *PCloudClient) uploadFile(ctx context.Context, localPath, fileName stri
 	}
 	defer file.Close()
 
+	return pc.uploadReader(ctx, file, fileName, parentFolderID)
+}
+
+// uploadReader uploads the content of r as a file, overwriting a file with
+// the same name
+func (pc *PCloudClient) uploadReader(ctx context.Context, r io.Reader, fileName string, parentFolderID int64) error {
 	// Create multipart form data
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
@@ -275,7 +312,7 @@ func (pc *PCloudClient) uploadFile(ctx context.Context, localPath, fileName stri
 		return fmt.Errorf("failed to create form file: %w", err)
 	}
 
-	if _, err := io.Copy(part, file); err != nil {
+	if _, err := io.Copy(part, r); err != nil {
 		return fmt.Errorf("failed to copy file data: %w", err)
 	}
 
@@ -303,7 +340,7 @@ func (pc *PCloudClient) uploadFile(ctx context.Context, localPath, fileName stri
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("upload failed with HTTP %d: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("upload failed with HTTP %d: %s", resp.StatusCode, redact(string(body)))
 	}
 
 	var fileResp PCloudFile
@@ -318,3 +355,485 @@ func (pc *PCloudClient) uploadFile(ctx context.Context, localPath, fileName stri
 	log.Printf("Uploaded file: %s", fileName)
 	return nil
 }
+
+// listFolder lists the subfolders of a folder. listfolder has no paging, so
+// files are left out to keep responses small in folders with many backups.
+func (pc *PCloudClient) listFolder(ctx context.Context, folderID int64) (*PCloudListFolder, error) {
+	body, err := pc.makeRequest(ctx, "listfolder", map[string]string{
+		"folderid": strconv.FormatInt(folderID, 10),
+		"nofiles":  "1",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var listResp PCloudListFolder
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to parse list response: %w", err)
+	}
+
+	if listResp.Result != 0 {
+		return nil, fmt.Errorf("pCloud API error: %s", listResp.Error)
+	}
+
+	return &listResp, nil
+}
+
+// findFolder looks up a subfolder by name and reports whether it exists
+func (pc *PCloudClient) findFolder(ctx context.Context, parentFolderID int64, name string) (int64, bool, error) {
+	listResp, err := pc.listFolder(ctx, parentFolderID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, item := range listResp.Metadata.Contents {
+		if item.IsFolder && item.Name == name {
+			return item.FolderID, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// ShareBackup creates a public link to a backup folder that expires at the
+// given time
+func (pc *PCloudClient) ShareBackup(ctx context.Context, backupName string, expires time.Time) (string, error) {
+	folderID, found, err := pc.backupFolder(ctx, backupName)
+	if err != nil {
+		return "", fmt.Errorf("failed to search for backup folder: %w", err)
+	}
+	if !found {
+		return "", fmt.Errorf("backup %s not found", backupName)
+	}
+
+	body, err := pc.makeRequest(ctx, "getfolderpublink", map[string]string{
+		"folderid": strconv.FormatInt(folderID, 10),
+		"expire":   strconv.FormatInt(expires.Unix(), 10),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create public link: %w", err)
+	}
+
+	var linkResp PCloudPublink
+	if err := json.Unmarshal(body, &linkResp); err != nil {
+		return "", fmt.Errorf("failed to parse public link response: %w", err)
+	}
+
+	if linkResp.Result != 0 {
+		return "", fmt.Errorf("pCloud API error: %s", linkResp.Error)
+	}
+
+	return linkResp.Link, nil
+}
+
+func (pc *PCloudClient) Name() string {
+	return "pcloud"
+}
+
+// ListBackups returns all backup folders in the DataVault root
+func (pc *PCloudClient) ListBackups(ctx context.Context) ([]RemoteBackup, error) {
+	if err := pc.ready(ctx); err != nil {
+		return nil, err
+	}
+
+	listResp, err := pc.listFolder(ctx, pc.rootFolderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var backups []RemoteBackup
+	for _, item := range listResp.Metadata.Contents {
+		if !item.IsFolder {
+			continue
+		}
+		created, _ := time.Parse(time.RFC1123Z, item.Created)
+		backups = append(backups, RemoteBackup{
+			Name:    item.Name,
+			Created: created,
+			ID:      strconv.FormatInt(item.FolderID, 10),
+		})
+	}
+
+	return backups, nil
+}
+
+// ListBackupFiles returns all files of a backup using a single recursive
+// folder listing
+func (pc *PCloudClient) ListBackupFiles(ctx context.Context, backupName string) ([]RemoteFile, error) {
+	folderID, found, err := pc.backupFolder(ctx, backupName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for backup folder: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("backup %s not found", backupName)
+	}
+
+	body, err := pc.makeRequest(ctx, "listfolder", map[string]string{
+		"folderid":  strconv.FormatInt(folderID, 10),
+		"recursive": "1",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup folder: %w", err)
+	}
+
+	var listResp PCloudListFolder
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to parse list response: %w", err)
+	}
+
+	if listResp.Result != 0 {
+		return nil, fmt.Errorf("pCloud API error: %s", listResp.Error)
+	}
+
+	var files []RemoteFile
+	collectPCloudFiles(listResp.Metadata.Contents, "", &files)
+	return files, nil
+}
+
+func collectPCloudFiles(entries []PCloudEntry, relativePath string, files *[]RemoteFile) {
+	for _, entry := range entries {
+		path := entry.Name
+		if relativePath != "" {
+			path = relativePath + "/" + entry.Name
+		}
+
+		if entry.IsFolder {
+			collectPCloudFiles(entry.Contents, path, files)
+			continue
+		}
+
+		modTime, _ := time.Parse(time.RFC1123Z, entry.Modified)
+		*files = append(*files, RemoteFile{
+			Path:    path,
+			Size:    entry.Size,
+			ModTime: modTime,
+			ID:      strconv.FormatInt(entry.FileID, 10),
+		})
+	}
+}
+
+func (pc *PCloudClient) DownloadFile(ctx context.Context, file RemoteFile, w io.Writer) error {
+	body, err := pc.makeRequest(ctx, "getfilelink", map[string]string{
+		"fileid": file.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get download link for %s: %w", file.Path, err)
+	}
+
+	var linkResp PCloudFileLink
+	if err := json.Unmarshal(body, &linkResp); err != nil {
+		return fmt.Errorf("failed to parse file link response: %w", err)
+	}
+
+	if linkResp.Result != 0 {
+		return fmt.Errorf("pCloud API error: %s", linkResp.Error)
+	}
+
+	if len(linkResp.Hosts) == 0 {
+		return fmt.Errorf("no download host returned for %s", file.Path)
+	}
+
+	// Downloads can take much longer than API calls, so they have the file
+	// timeout instead of the request timeout
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+linkResp.Hosts[0]+linkResp.Path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download of %s failed with HTTP %d", file.Path, resp.StatusCode)
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+
+	return nil
+}
+
+// downloadZip writes a backup folder to w as a zip archive, which pCloud
+// builds on its side, so restoring a folder takes one download
+func (pc *PCloudClient) downloadZip(ctx context.Context, backupName string, w io.Writer) error {
+	folderID, found, err := pc.backupFolder(ctx, backupName)
+	if err != nil {
+		return fmt.Errorf("failed to search for backup folder: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("backup %s not found", backupName)
+	}
+
+	form := url.Values{}
+	form.Set("folderid", strconv.FormatInt(folderID, 10))
+	form.Set("access_token", pc.authToken)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", pc.baseURL+"/getzip", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create zip request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redact(urlErr.URL)
+		}
+		return fmt.Errorf("zip request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("zip download of %s failed with HTTP %d", backupName, resp.StatusCode)
+	}
+
+	// Errors come as a JSON response instead of the archive
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var apiResp PCloudResponse
+		if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+			return fmt.Errorf("failed to parse zip response: %w", err)
+		}
+		return fmt.Errorf("pCloud API error: %s", apiResp.Error)
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download zip of %s: %w", backupName, err)
+	}
+
+	return nil
+}
+
+// UploadFiles uploads the given files below localPath into an existing
+// backup. pCloud overwrites files with the same name.
+func (pc *PCloudClient) UploadFiles(ctx context.Context, localPath, backupName string, relPaths []string) error {
+	folderID, found, err := pc.backupFolder(ctx, backupName)
+	if err != nil {
+		return fmt.Errorf("failed to search for backup folder: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("backup %s not found", backupName)
+	}
+
+	failed := 0
+	for _, relPath := range relPaths {
+		parentID, err := pc.ensureFolderPath(ctx, folderID, path.Join(backupName, path.Dir(relPath)))
+		if err != nil {
+			log.Printf("Failed to create folder for %s: %v", relPath, err)
+			failed++
+			continue
+		}
+
+		if err := pc.uploadFile(ctx, filepath.Join(localPath, filepath.FromSlash(relPath)), path.Base(relPath), parentID); err != nil {
+			log.Printf("Failed to upload file %s: %v", relPath, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to upload", failed, len(relPaths))
+	}
+
+	return nil
+}
+
+// backupFolder looks up the folder of a backup in the root folder and
+// reports whether it exists
+func (pc *PCloudClient) backupFolder(ctx context.Context, backupName string) (int64, bool, error) {
+	if id, ok := pc.cachedFolder(backupName); ok {
+		return id, true, nil
+	}
+	if err := pc.ready(ctx); err != nil {
+		return 0, false, err
+	}
+
+	id, found, err := pc.findFolder(ctx, pc.rootFolderID, backupName)
+	if found {
+		pc.cacheFolder(backupName, id)
+	}
+	return id, found, err
+}
+
+// ensureFolderPath returns the ID of a slash-separated folder path below the
+// root, creating missing folders. The path starts with the backup folder,
+// whose ID is backupID. Creating folders holds the cache lock, so workers
+// uploading into the same new folder don't each create it.
+func (pc *PCloudClient) ensureFolderPath(ctx context.Context, backupID int64, dir string) (int64, error) {
+	backupName, _, _ := strings.Cut(dir, "/")
+	pc.cacheFolder(backupName, backupID)
+
+	pc.foldersMu.Lock()
+	defer pc.foldersMu.Unlock()
+	return pc.createFolderPath(ctx, dir, pc.folders)
+}
+
+// cachedFolder returns the cached ID of a folder below the root
+func (pc *PCloudClient) cachedFolder(dir string) (int64, bool) {
+	pc.foldersMu.Lock()
+	defer pc.foldersMu.Unlock()
+	id, ok := pc.folders[dir]
+	return id, ok
+}
+
+// cacheFolder records the ID of a folder below the root. A folder replaced
+// by another with the same path takes its cached subfolders with it.
+func (pc *PCloudClient) cacheFolder(dir string, id int64) {
+	pc.foldersMu.Lock()
+	defer pc.foldersMu.Unlock()
+	if old, ok := pc.folders[dir]; ok && old != id {
+		for key := range pc.folders {
+			if strings.HasPrefix(key, dir+"/") {
+				delete(pc.folders, key)
+			}
+		}
+	}
+	pc.folders[dir] = id
+}
+
+// createFolderPath returns the ID of a slash-separated folder path, creating
+// missing folders. folderIDs caches known folders and must contain the
+// folder the path starts in, such as "." for the top folder.
+func (pc *PCloudClient) createFolderPath(ctx context.Context, dir string, folderIDs map[string]int64) (int64, error) {
+	if id, ok := folderIDs[dir]; ok {
+		return id, nil
+	}
+
+	parentID, err := pc.createFolderPath(ctx, path.Dir(dir), folderIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := pc.makeRequest(ctx, "createfolderifnotexists", map[string]string{
+		"folderid": strconv.FormatInt(parentID, 10),
+		"name":     path.Base(dir),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var folderResp PCloudFolder
+	if err := json.Unmarshal(body, &folderResp); err != nil {
+		return 0, fmt.Errorf("failed to parse folder response: %w", err)
+	}
+
+	if folderResp.Result != 0 {
+		return 0, fmt.Errorf("pCloud API error: %s", folderResp.Error)
+	}
+
+	folderIDs[dir] = folderResp.Metadata.FolderID
+	return folderResp.Metadata.FolderID, nil
+}
+
+// writeLock stores a lock marker in the root folder. pCloud keeps one file
+// per name, so id is not needed to replace it.
+func (pc *PCloudClient) writeLock(ctx context.Context, name, id string, data []byte) (string, error) {
+	if err := pc.ready(ctx); err != nil {
+		return "", err
+	}
+	if err := pc.uploadReader(ctx, bytes.NewReader(data), name, pc.rootFolderID); err != nil {
+		return "", err
+	}
+
+	markers, err := pc.readLocks(ctx, name)
+	if err != nil || len(markers) == 0 {
+		return "", fmt.Errorf("failed to find lock marker: %v", err)
+	}
+	return markers[0].ID, nil
+}
+
+// readLocks returns the lock marker with the given name, if any
+func (pc *PCloudClient) readLocks(ctx context.Context, name string) ([]lockMarker, error) {
+	ids, err := pc.rootFileIDs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var markers []lockMarker
+	for _, id := range ids {
+		var buf bytes.Buffer
+		if err := pc.DownloadFile(ctx, RemoteFile{Path: name, ID: id}, &buf); err != nil {
+			return nil, err
+		}
+		markers = append(markers, newLockMarker(id, buf.Bytes()))
+	}
+
+	return markers, nil
+}
+
+// rootFileIDs returns the IDs of the files with the given name in the root
+// folder
+func (pc *PCloudClient) rootFileIDs(ctx context.Context, name string) ([]string, error) {
+	if err := pc.ready(ctx); err != nil {
+		return nil, err
+	}
+	body, err := pc.makeRequest(ctx, "listfolder", map[string]string{
+		"folderid": strconv.FormatInt(pc.rootFolderID, 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var listResp PCloudListFolder
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to parse list response: %w", err)
+	}
+	if listResp.Result != 0 {
+		return nil, fmt.Errorf("pCloud API error: %s", listResp.Error)
+	}
+
+	var ids []string
+	for _, item := range listResp.Metadata.Contents {
+		if !item.IsFolder && item.Name == name {
+			ids = append(ids, strconv.FormatInt(item.FileID, 10))
+		}
+	}
+
+	return ids, nil
+}
+
+func (pc *PCloudClient) deleteLock(ctx context.Context, id string) error {
+	body, err := pc.makeRequest(ctx, "deletefile", map[string]string{
+		"fileid": id,
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp PCloudResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("failed to parse delete response: %w", err)
+	}
+	if resp.Result != 0 {
+		return fmt.Errorf("pCloud API error: %s", resp.Error)
+	}
+	return nil
+}
+
+// writeRootFile stores a file in the root folder, replacing any file with
+// that name
+func (pc *PCloudClient) writeRootFile(ctx context.Context, name string, data []byte) error {
+	if err := pc.ready(ctx); err != nil {
+		return err
+	}
+	return pc.uploadReader(ctx, bytes.NewReader(data), name, pc.rootFolderID)
+}
+
+// readRootFile returns the file with the given name in the root folder
+func (pc *PCloudClient) readRootFile(ctx context.Context, name string) ([]byte, error) {
+	ids, err := pc.rootFileIDs(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	var buf bytes.Buffer
+	if err := pc.DownloadFile(ctx, RemoteFile{Path: name, ID: ids[0]}, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// runAsUser is the user that uploads run as when DataVault is started as
+// root: only reading the source needs root, so the code talking to the
+// providers runs without it
+type runAsUser struct {
+	name   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// uploadStopDelay is how long an upload process may take to stop after
+// being interrupted before it is killed
+const uploadStopDelay = time.Minute
+
+// dropsPrivileges reports whether uploads run in a process of the run_as
+// user instead of this one
+func (bm *BackupManager) dropsPrivileges() bool {
+	return bm.config.RunAs != "" && os.Geteuid() == 0
+}
+
+// upload uploads a queued backup, in a process of the run_as user if
+// uploads drop privileges
+func (bm *BackupManager) upload(ctx context.Context, queue *uploadQueue, manifest *Manifest, resuming bool) error {
+	if bm.dropsPrivileges() {
+		return bm.uploadAs(ctx, queue, resuming)
+	}
+	return bm.uploadQueued(ctx, queue, manifest, resuming)
+}
+
+// maxHandoffFile limits what is read back from a handoff directory
+const maxHandoffFile = 64 << 20
+
+// uploadAs runs "datavault upload-queued" as the run_as user to upload a
+// queued backup. The state and staging directories stay root's: the upload
+// gets read access to the staged copy and a handoff directory of its own with
+// a copy of the upload queue, history and incremental baseline, which it uses
+// as its state directory. What it leaves there is only read back, through
+// os.Root without following links, so an upload process that was taken over
+// can't make root write or read files elsewhere. The configuration is passed
+// on standard input, since the config file may only be readable by root.
+func (bm *BackupManager) uploadAs(ctx context.Context, queue *uploadQueue, resuming bool) error {
+	runAs, err := lookupRunAs(bm.config.RunAs)
+	if err != nil {
+		return fmt.Errorf("failed to look up run_as user: %w", err)
+	}
+
+	bm.stages.add(queue.StagePath)
+	defer bm.stages.remove(queue.StagePath)
+
+	// Earlier versions handed both directories to the run_as user
+	for _, dir := range []string{bm.tempDir, bm.config.StateDir} {
+		if err := reclaim(dir); err != nil {
+			return fmt.Errorf("failed to take back %s from %s: %w", dir, runAs.name, err)
+		}
+	}
+
+	handoff := queue.handoffDir(bm.tempDir)
+	bm.stages.add(handoff)
+	defer bm.stages.remove(handoff)
+	defer bm.cleanup(handoff)
+	if err := bm.prepareHandoff(queue, handoff, runAs); err != nil {
+		return fmt.Errorf("failed to prepare the upload as %s: %w", runAs.name, err)
+	}
+
+	childConfig := bm.config
+	childConfig.StateDir = handoff
+	config, err := json.Marshal(childConfig)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"upload-queued"}
+	if resuming {
+		args = append(args, "-resume")
+	}
+	cmd := exec.CommandContext(ctx, exe, append(args, queue.BackupName)...)
+	cmd.Stdin = bytes.NewReader(config)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = childEnv()
+	cmd.SysProcAttr = runAs.procAttr()
+
+	// An interrupted upload stops like at a shutdown, so it can resume
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = uploadStopDelay
+
+	err = cmd.Run()
+	if collectErr := bm.collectHandoff(queue, handoff, err == nil); collectErr != nil {
+		log.Printf("Warning: Failed to read back the upload as %s: %v", runAs.name, collectErr)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return &partialError{"interrupted, the upload resumes with the next run"}
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitPartial:
+		return &partialError{"the upload as " + runAs.name + " was incomplete"}
+	}
+	return fmt.Errorf("upload as %s failed: %w", runAs.name, err)
+}
+
+// handoffDir returns the directory an upload as the run_as user gets as its
+// state directory
+func (q *uploadQueue) handoffDir(tempDir string) string {
+	return filepath.Join(tempDir, "handoff_"+q.BackupName)
+}
+
+// prepareHandoff creates the handoff directory of an upload with copies of
+// the state it reads, gives it to the user, and lets the user's group read
+// the staged backup. All of it is written while only root can write there.
+func (bm *BackupManager) prepareHandoff(queue *uploadQueue, handoff string, runAs *runAsUser) error {
+	if err := os.RemoveAll(handoff); err != nil {
+		return err
+	}
+	childQueue := filepath.Join(queueRoot(handoff), queue.BackupName)
+	if err := os.MkdirAll(childQueue, 0700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(queue.dir)
+	if err != nil {
+		return err
+	}
+	copies := map[string]string{
+		historyPath(bm.config.StateDir):      historyPath(handoff),
+		lastManifestPath(bm.config.StateDir): lastManifestPath(handoff),
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			copies[filepath.Join(queue.dir, entry.Name())] = filepath.Join(childQueue, entry.Name())
+		}
+	}
+	for src, dst := range copies {
+		data, err := os.ReadFile(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			return err
+		}
+	}
+
+	err = filepath.WalkDir(handoff, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, int(runAs.uid), int(runAs.gid))
+	})
+	if err != nil {
+		return err
+	}
+
+	// The staged backup stays root's, so the user can read it but not
+	// change it
+	return filepath.WalkDir(queue.StagePath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm() | 0040
+		if d.IsDir() {
+			mode |= 0010
+		}
+		if err := os.Lchown(p, -1, int(runAs.gid)); err != nil {
+			return err
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// collectHandoff reads back what an upload as the run_as user left in its
+// handoff directory: the runs it recorded, and either the progress of an
+// unfinished upload or, once the upload removed its queue, the end of the
+// queued upload, which root finishes by removing the stage. The baseline
+// only advances if the upload reported success, and it is the manifest root
+// queued, not one the upload wrote.
+func (bm *BackupManager) collectHandoff(queue *uploadQueue, handoff string, succeeded bool) error {
+	root, err := os.OpenRoot(handoff)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	if data, err := readHandoffFile(root, filepath.Base(historyPath(handoff))); err == nil {
+		if err := bm.mergeHistory(data); err != nil {
+			log.Printf("Warning: Failed to record the upload: %v", err)
+		}
+	}
+
+	childQueue := filepath.Join("queue", queue.BackupName)
+	dir, err := root.Open(childQueue)
+	if errors.Is(err, fs.ErrNotExist) {
+		if succeeded {
+			manifest, err := queue.manifest()
+			if err == nil {
+				err = saveManifest(manifest, lastManifestPath(bm.config.StateDir))
+			}
+			if err != nil {
+				log.Printf("Warning: Failed to save manifest: %v", err)
+			}
+		}
+		if err := queue.remove(); err != nil {
+			log.Printf("Warning: Failed to remove upload queue: %v", err)
+		}
+		bm.cleanup(queue.StagePath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := dir.ReadDir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	// The upload resumes from the providers' logs; queue.json and the
+	// manifest are root's own
+	for _, entry := range entries {
+		name := entry.Name()
+		switch filepath.Ext(name) {
+		case ".done", ".complete", ".status":
+		default:
+			continue
+		}
+		data, err := readHandoffFile(root, filepath.Join(childQueue, name))
+		if err != nil {
+			log.Printf("Warning: Skipping %s of the upload: %v", name, err)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(queue.dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeHistory appends the records of a handoff's history that are newer than
+// the last one of the job's own
+func (bm *BackupManager) mergeHistory(data []byte) error {
+	history, err := loadHistory(bm.config.StateDir, time.Time{})
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	if len(history) > 0 {
+		last = history[len(history)-1].Time
+	}
+
+	added := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record runRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Time.After(last) {
+			history = append(history, record)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	history = pruneHistory(history, time.Now(), bm.config.HistoryRetention, bm.config.HistoryMaxSize)
+	return writeHistory(bm.config.StateDir, history)
+}
+
+// readHandoffFile reads a regular file below root, refusing links and
+// anything larger than maxHandoffFile
+func readHandoffFile(root *os.Root, name string) ([]byte, error) {
+	file, err := root.OpenFile(name, os.O_RDONLY|noFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxHandoffFile {
+		return nil, fmt.Errorf("%s is not a regular file of at most %s", name, formatBytes(maxHandoffFile))
+	}
+	return io.ReadAll(io.LimitReader(file, maxHandoffFile))
+}
+
+// runUploadQueued uploads a queued backup with the configuration read from
+// standard input. Backup runs of a daemon started as root start it as the
+// run_as user.
+func runUploadQueued(args []string) error {
+	fs := flag.NewFlagSet("upload-queued", flag.ExitOnError)
+	resume := fs.Bool("resume", false, "Continue an interrupted upload")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: datavault upload-queued [-resume] <backup_name> < config.json")
+	}
+	backupName := fs.Arg(0)
+
+	var config Config
+	if err := json.NewDecoder(os.Stdin).Decode(&config); err != nil {
+		return fmt.Errorf("failed to read configuration: %w", err)
+	}
+
+	queues, err := loadUploadQueues(config.StateDir)
+	if err != nil {
+		return err
+	}
+	var queue *uploadQueue
+	for _, q := range queues {
+		if q.BackupName == backupName {
+			queue = q
+		}
+	}
+	if queue == nil {
+		return fmt.Errorf("no upload of %s is queued", backupName)
+	}
+
+	manifest, err := queue.manifest()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bm := NewBackupManager(config)
+	bm.handedOff = true
+	return bm.uploadQueued(ctx, queue, manifest, *resume)
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// lookupRunAs fails, since processes can't be started as another user on
+// this platform
+func lookupRunAs(name string) (*runAsUser, error) {
+	return nil, fmt.Errorf("running as another user is not supported on %s", runtime.GOOS)
+}
+
+// noFollow adds nothing where processes don't run as other users
+const noFollow = 0
+
+// reclaim does nothing, since no directory is handed to another user on this
+// platform
+func reclaim(dir string) error {
+	return nil
+}
+
+func (u *runAsUser) procAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lookupRunAs looks up the user uploads run as and their groups
+func lookupRunAs(name string) (*runAsUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	runAs := &runAsUser{name: name, uid: uint32(uid), gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			runAs.groups = append(runAs.groups, uint32(id))
+		}
+	}
+	return runAs, nil
+}
+
+// noFollow makes opening a symbolic link fail, and opening a named pipe not
+// wait for a writer
+const noFollow = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+
+// reclaim makes root own dir and everything below it again if another user
+// owns dir
+func reclaim(dir string) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid == 0 {
+		return nil
+	}
+
+	log.Printf("Taking back %s from the run_as user", dir)
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, 0, 0)
+	})
+}
+
+// procAttr returns the attributes of a process running as the user
+func (u *runAsUser) procAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: u.uid, Gid: u.gid, Groups: u.groups}}
+}
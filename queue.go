@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// UploadProgress records which files of a backup reached a provider, so an
+// interrupted upload can continue where it stopped
+type UploadProgress interface {
+	// Resuming reports whether an earlier attempt may have created folders
+	// and files already
+	Resuming() bool
+	Done(relPath string) bool
+	MarkDone(relPath string)
+}
+
+// uploadQueue is the on-disk state of a backup whose uploads haven't finished.
+// It lives in <state_dir>/queue/<backup_name> together with one append-only
+// log of uploaded files per provider.
+type uploadQueue struct {
+	dir        string
+	BackupName string    `json:"backup_name"`
+	StagePath  string    `json:"stage_path"`  // Temp directory removed once done
+	UploadPath string    `json:"upload_path"` // Folder uploaded as the backup
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func queueRoot(stateDir string) string {
+	return filepath.Join(stateDir, "queue")
+}
+
+func newUploadQueue(stateDir, backupName, stagePath, uploadPath string, manifest *Manifest) (*uploadQueue, error) {
+	q := &uploadQueue{
+		dir:        filepath.Join(queueRoot(stateDir), backupName),
+		BackupName: backupName,
+		StagePath:  stagePath,
+		UploadPath: uploadPath,
+		CreatedAt:  time.Now(),
+	}
+
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upload queue: %w", err)
+	}
+
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upload queue: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(q.dir, "queue.json"), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write upload queue: %w", err)
+	}
+
+	// The staged manifest may be a delta, so keep the full one for the
+	// incremental baseline
+	if err := saveManifest(manifest, filepath.Join(q.dir, "manifest.json")); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// manifest returns the full manifest of the queued backup
+func (q *uploadQueue) manifest() (*Manifest, error) {
+	return loadManifest(filepath.Join(q.dir, "manifest.json"))
+}
+
+// loadUploadQueues returns the queues of uploads left over from earlier runs
+func loadUploadQueues(stateDir string) ([]*uploadQueue, error) {
+	entries, err := os.ReadDir(queueRoot(stateDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var queues []*uploadQueue
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(queueRoot(stateDir), entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "queue.json"))
+		if err != nil {
+			log.Printf("Warning: Ignoring broken upload queue %s: %v", dir, err)
+			continue
+		}
+
+		q := &uploadQueue{dir: dir}
+		if err := json.Unmarshal(data, q); err != nil {
+			log.Printf("Warning: Ignoring broken upload queue %s: %v", dir, err)
+			continue
+		}
+		queues = append(queues, q)
+	}
+
+	return queues, nil
+}
+
+// progress opens the upload log of a provider
+func (q *uploadQueue) progress(provider string, resuming bool) (*queueProgress, error) {
+	logPath := filepath.Join(q.dir, provider+".done")
+	done := make(map[string]bool)
+
+	if file, err := os.Open(logPath); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			done[scanner.Text()] = true
+		}
+		file.Close()
+	}
+
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload log: %w", err)
+	}
+
+	return &queueProgress{resuming: resuming, done: done, log: file, statusPath: filepath.Join(q.dir, provider+".status")}, nil
+}
+
+func (q *uploadQueue) markComplete(provider string) error {
+	return os.WriteFile(filepath.Join(q.dir, provider+".complete"), nil, 0600)
+}
+
+func (q *uploadQueue) complete(provider string) bool {
+	_, err := os.Stat(filepath.Join(q.dir, provider+".complete"))
+	return err == nil
+}
+
+func (q *uploadQueue) remove() error {
+	return os.RemoveAll(q.dir)
+}
+
+type queueProgress struct {
+	mu       sync.Mutex
+	resuming bool
+	done     map[string]bool
+	log      *os.File
+
+	// Live status for "datavault status", once tracked
+	statusPath string
+	status     *uploadStatus
+	sizes      map[string]int64 // Of the files to upload, by stored path
+	stop       chan struct{}
+}
+
+// statusInterval is how often the status of a running upload is written
+const statusInterval = 5 * time.Second
+
+// uploadStatus is the live progress of an upload to one provider. It is kept
+// in <provider>.status next to the upload log while the upload runs, so a
+// long upload can be told from a hung one.
+type uploadStatus struct {
+	Started      time.Time `json:"started"`
+	Updated      time.Time `json:"updated"`
+	Current      string    `json:"current,omitempty"` // File being uploaded
+	CurrentSince time.Time `json:"current_since,omitempty"`
+	Files        int       `json:"files"`
+	FilesDone    int       `json:"files_done"`
+	Bytes        int64     `json:"bytes"`
+	BytesDone    int64     `json:"bytes_done"`
+	StartBytes   int64     `json:"start_bytes"` // Done before this attempt started
+	Running      bool      `json:"running"`
+}
+
+func (qp *queueProgress) Resuming() bool {
+	return qp.resuming
+}
+
+func (qp *queueProgress) Done(relPath string) bool {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	// Providers ask right before uploading a file
+	if !qp.done[relPath] {
+		qp.setCurrent(relPath)
+	}
+	return qp.done[relPath]
+}
+
+func (qp *queueProgress) MarkDone(relPath string) {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	if size, ok := qp.sizes[relPath]; ok && !qp.done[relPath] && qp.status != nil {
+		qp.status.FilesDone++
+		qp.status.BytesDone += size
+	}
+	qp.done[relPath] = true
+	if _, err := fmt.Fprintln(qp.log, relPath); err != nil {
+		log.Printf("Warning: Failed to record upload of %s: %v", relPath, err)
+	}
+}
+
+// track starts keeping the status of uploading the files of staged that go
+// to provider, written every statusInterval until Close
+func (qp *queueProgress) track(staged *Manifest, provider string) {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	now := time.Now()
+	status := &uploadStatus{Started: now, Running: true}
+	qp.sizes = make(map[string]int64)
+	for _, entry := range staged.Files {
+		if entry.Backup != staged.BackupName || entry.isDuplicate() || (entry.Provider != "" && entry.Provider != provider) {
+			continue
+		}
+		qp.sizes[entry.storedPath()] = entry.Size
+		status.Files++
+		status.Bytes += entry.Size
+		if qp.done[entry.storedPath()] {
+			status.FilesDone++
+			status.BytesDone += entry.Size
+		}
+	}
+	status.StartBytes = status.BytesDone
+	qp.status = status
+	qp.writeStatus()
+
+	qp.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-qp.stop:
+				return
+			case <-ticker.C:
+				qp.mu.Lock()
+				qp.writeStatus()
+				qp.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// uploading records that relPath is being uploaded, for uploads that don't
+// ask Done right before
+func (qp *queueProgress) uploading(relPath string) {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	qp.setCurrent(relPath)
+}
+
+func (qp *queueProgress) setCurrent(relPath string) {
+	if _, ok := qp.sizes[relPath]; ok && qp.status.Current != relPath {
+		qp.status.Current, qp.status.CurrentSince = relPath, time.Now()
+	}
+}
+
+// writeStatus replaces the status file, so readers never see half of it
+func (qp *queueProgress) writeStatus() {
+	qp.status.Updated = time.Now()
+	data, err := json.Marshal(qp.status)
+	if err != nil {
+		return
+	}
+	tmp := qp.statusPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err == nil {
+		os.Rename(tmp, qp.statusPath)
+	}
+}
+
+// minRateSample is the least an upload must send for its speed to be
+// recorded, since a few small files mostly measure latency
+const minRateSample = 1 << 20
+
+// rate returns the bytes per second sent so far by this attempt, or zero if
+// it sent too little to tell
+func (qp *queueProgress) rate() float64 {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	if qp.status == nil {
+		return 0
+	}
+	sent := qp.status.BytesDone - qp.status.StartBytes
+	elapsed := time.Since(qp.status.Started)
+	if sent < minRateSample || elapsed < time.Second {
+		return 0
+	}
+	return float64(sent) / elapsed.Seconds()
+}
+
+// exclude keeps relPath out of the folder upload without recording it as
+// uploaded
+func (qp *queueProgress) exclude(relPath string) {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+
+	qp.done[relPath] = true
+}
+
+func (qp *queueProgress) Close() error {
+	qp.mu.Lock()
+	if qp.status != nil {
+		close(qp.stop)
+		qp.status.Running, qp.status.Current = false, ""
+		qp.writeStatus()
+	}
+	qp.mu.Unlock()
+
+	return qp.log.Close()
+}
+
+// memoryProgress tracks an upload that needs no queue, such as a repair
+type memoryProgress struct {
+	mu       sync.Mutex
+	resuming bool
+	done     map[string]bool
+}
+
+func (mp *memoryProgress) Resuming() bool {
+	return mp.resuming
+}
+
+func (mp *memoryProgress) Done(relPath string) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.done[relPath]
+}
+
+func (mp *memoryProgress) MarkDone(relPath string) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.done == nil {
+		mp.done = make(map[string]bool)
+	}
+	mp.done[relPath] = true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// readmeFileName is a plain-text description of a backup uploaded next to
+// its manifest, for people browsing the provider without DataVault
+const readmeFileName = "DATAVAULT-README.txt"
+
+// writeReadme writes the description of the backup in manifest to path: how
+// the files are stored and where each one is
+func writeReadme(manifest *Manifest, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", readmeFileName, err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "DataVault backup %s\n", manifest.BackupName)
+	fmt.Fprintf(w, "Created %s\n", manifest.CreatedAt.Format(time.RFC1123))
+	if info := manifest.Info; info != nil {
+		fmt.Fprintf(w, "Source %s on %s, DataVault %s\n", info.Source, info.Host, info.Version)
+	}
+	if manifest.Comment != "" {
+		fmt.Fprintf(w, "Comment: %s\n", manifest.Comment)
+	}
+
+	var size int64
+	for _, entry := range manifest.Files {
+		size += entry.Size
+	}
+	fmt.Fprintf(w, "%d files, %s\n\n", len(manifest.Files), formatBytes(size))
+
+	fmt.Fprintf(w, `To restore this backup with DataVault, run
+
+    datavault restore %s
+
+Without DataVault, the files can be copied out of this folder as they are.
+The list below says where each one is:
+
+  - "in <backup>" means the file didn't change since an earlier backup and is
+    stored in that backup's folder instead of this one
+  - "as <path>" means the file is stored under another path: with characters
+    the providers don't allow written as %%XX, below a year/month folder in
+    media mode, or as an identical file stored once
+  - "gzip" means the file is stored compressed; decompress it with gunzip
+    after renaming it to end in ".gz". Several transforms are separated by
+    commas in the order they were applied, and are undone last to first
+  - "on <provider>" means only that provider holds the file
+
+%s holds the same list in JSON, with a checksum of
+every file.
+
+`, manifest.BackupName, manifestFileName)
+
+	entries := append([]ManifestEntry(nil), manifest.Files...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%10s  %s", formatBytes(entry.Size), entry.Path)
+		if entry.Backup != manifest.BackupName {
+			fmt.Fprintf(w, "  in %s", entry.Backup)
+		}
+		if entry.storedPath() != entry.Path {
+			fmt.Fprintf(w, "  as %s", entry.storedPath())
+		}
+		if entry.Encoding != "" {
+			fmt.Fprintf(w, "  %s", entry.Encoding)
+		}
+		if entry.Provider != "" {
+			fmt.Fprintf(w, "  on %s", providerLabel(entry.Provider))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", readmeFileName, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credentials in log output and error messages
+const redacted = "[REDACTED]"
+
+// pcloudAuthEnv names the environment variable the pCloud token may be given
+// in, so it doesn't show up in the process list like -pcloud-auth does
+const pcloudAuthEnv = "DATAVAULT_PCLOUD_AUTH"
+
+// secretEnvs are the environment variables that may hold credentials
+var secretEnvs = []string{pcloudAuthEnv, passphraseEnv}
+
+// childEnv returns the environment of processes DataVault starts, without
+// the credentials, so a compromised helper program can't read them
+func childEnv() []string {
+	return slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(secretEnvs, name)
+	})
+}
+
+// secretParamPattern matches credentials passed as URL query or form
+// parameters, such as the pCloud access_token
+var secretParamPattern = regexp.MustCompile(`(?i)\b(access_token|refresh_token|auth|password|client_secret)=[^&\s"']+`)
+
+// secrets holds the credentials known at run time, which are redacted
+// wherever they appear
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+// addSecret registers a credential to be redacted from logs. Values too short
+// to be credentials are ignored, since they would garble unrelated text.
+func addSecret(value string) {
+	if len(value) < 8 {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, known := range secrets.values {
+		if known == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+}
+
+// redact removes registered credentials and credential parameters from s
+func redact(s string) string {
+	secrets.Lock()
+	for _, value := range secrets.values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	secrets.Unlock()
+
+	return secretParamPattern.ReplaceAllString(s, "${1}="+redacted)
+}
+
+// redactWriter redacts everything written through it. The standard logger
+// writes through one, so no log line can carry a credential.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (rw redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+)
+
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be repaired")
+
+	config, _, names, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	bm := NewBackupManager(config)
+	ctx := context.Background()
+
+	if bm.gdrive == nil && bm.pcloud == nil {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	// Named backups are healed instead of repairing the root folders
+	if len(names) > 0 {
+		failed := 0
+		for _, name := range names {
+			copied, err := bm.HealBackup(ctx, name, *dryRun)
+			if err != nil {
+				log.Printf("Failed to repair %s: %v", name, err)
+				failed++
+				continue
+			}
+			log.Printf("%s: copied %d files", name, copied)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d backups could not be repaired", failed, len(names))
+		}
+		return nil
+	}
+
+	if bm.gdrive != nil {
+		// Merging moves other machines' backups, so nobody may write meanwhile
+		lock, err := bm.acquireLock(ctx, bm.gdrive, "")
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+
+		merged, err := bm.gdrive.RepairRoot(ctx, *dryRun)
+		if err != nil {
+			return fmt.Errorf("Google Drive repair failed: %w", err)
+		}
+		log.Printf("Google Drive: merged %d duplicate folders", merged)
+	}
+
+	// pCloud rejects duplicate names within a folder, so there is nothing to merge
+	if bm.pcloud != nil {
+		log.Printf("pCloud: folder names are unique, nothing to repair")
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxLargestFiles is how many of the largest new files runs and reports list
+const maxLargestFiles = 5
+
+// RunSummary describes a finished backup run to the summary template
+type RunSummary struct {
+	Job       string
+	Backup    string
+	Source    string
+	Started   time.Time
+	Duration  time.Duration
+	Files     int             // Files in the backup
+	Size      int64           // Size of the files in the backup
+	Uploaded  int             // Files stored in this backup; the rest are in older ones
+	Bytes     int64           // Size of the uploaded files
+	Largest   []ManifestEntry // Largest uploaded files, biggest first
+	Results   []BackupResult
+	Succeeded int    // Providers that received the backup
+	Status    string // "succeeded", "partial" or "failed"
+}
+
+// NotificationData describes one event to the notification template
+type NotificationData struct {
+	Event    string // "failing", "partial", "recovered" or "digest"
+	Job      string
+	Error    string // Last error, unless recovered
+	Since    time.Time
+	Failures int    // Failures since the last message, for digests
+	Text     string // The built-in message
+}
+
+// templateFuncs are available in notification and summary templates
+var templateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+	"time": func(t time.Time) string {
+		return t.Format(time.RFC1123)
+	},
+}
+
+// loadTemplate parses a Go template file; an empty path means the built-in
+// format
+func loadTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(data))
+}
+
+// renderTemplate executes t, or returns fallback without a template or if
+// the template fails
+func renderTemplate(t *template.Template, data any, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		log.Printf("Warning: Failed to render %s: %v", t.Name(), err)
+		return fallback
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// runSummary describes a run that uploaded manifest's backup
+func (bm *BackupManager) runSummary(manifest *Manifest, results []BackupResult) RunSummary {
+	summary := RunSummary{
+		Job:      bm.jobName(),
+		Backup:   manifest.BackupName,
+		Started:  manifest.CreatedAt,
+		Duration: time.Since(manifest.CreatedAt).Round(time.Second),
+		Files:    len(manifest.Files),
+		Results:  results,
+		Status:   runSucceeded,
+	}
+	if manifest.Info != nil {
+		summary.Source = manifest.Info.Source
+	}
+
+	for _, entry := range manifest.Files {
+		summary.Size += entry.Size
+		if entry.Backup == manifest.BackupName {
+			summary.Uploaded++
+			summary.Bytes += entry.Size
+			summary.Largest = append(summary.Largest, entry)
+		}
+	}
+
+	sort.Slice(summary.Largest, func(i, j int) bool {
+		return summary.Largest[i].Size > summary.Largest[j].Size
+	})
+	if len(summary.Largest) > maxLargestFiles {
+		summary.Largest = summary.Largest[:maxLargestFiles]
+	}
+	for _, result := range results {
+		if result.Success {
+			summary.Succeeded++
+		}
+	}
+
+	return summary
+}
+
+// jobReport sums up the recorded runs of one job over a report period
+type jobReport struct {
+	Job           string
+	Runs          int
+	Succeeded     int // Runs that reached every provider
+	Partial       int // Runs that reached only some providers
+	Size          int64
+	Growth        int64 // Change of Size over the period
+	UploadedFiles int
+	Uploaded      int64
+	Largest       []largeFile
+	Providers     map[string]*providerHealth
+}
+
+// providerHealth sums up the uploads to one provider over a report period
+type providerHealth struct {
+	Runs      int
+	Succeeded int
+	LastError string
+}
+
+// newJobReport sums up the runs of job since the given time. records is the
+// job's whole history, oldest first, so growth can be measured against the
+// last run before the period.
+func newJobReport(job string, records []runRecord, since time.Time) jobReport {
+	report := jobReport{Job: job, Providers: make(map[string]*providerHealth)}
+
+	baseline := int64(-1)
+	for _, record := range records {
+		if record.Time.Before(since) {
+			baseline = record.Size
+			continue
+		}
+		if baseline < 0 {
+			baseline = record.Size
+		}
+
+		report.Runs++
+		report.Size = record.Size
+		report.UploadedFiles += record.UploadedFiles
+		report.Uploaded += record.Uploaded
+		report.Largest = append(report.Largest, record.Largest...)
+
+		succeeded := true
+		for name, errText := range record.Providers {
+			health, ok := report.Providers[name]
+			if !ok {
+				health = &providerHealth{}
+				report.Providers[name] = health
+			}
+			health.Runs++
+			if errText == "" {
+				health.Succeeded++
+			} else {
+				health.LastError = errText
+				succeeded = false
+			}
+		}
+		switch {
+		case record.Status == runPartial:
+			report.Partial++
+		case succeeded:
+			report.Succeeded++
+		}
+	}
+
+	if report.Runs > 0 {
+		report.Growth = report.Size - baseline
+	}
+
+	sort.Slice(report.Largest, func(i, j int) bool {
+		return report.Largest[i].Size > report.Largest[j].Size
+	})
+	if len(report.Largest) > maxLargestFiles {
+		report.Largest = report.Largest[:maxLargestFiles]
+	}
+
+	return report
+}
+
+// buildReport sums up the runs of every job since the given time
+func buildReport(configs []Config, since time.Time) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "DataVault report for %s to %s\n",
+		since.Local().Format(time.DateOnly), time.Now().Local().Format(time.DateOnly))
+
+	for _, config := range configs {
+		records, err := loadHistory(config.StateDir, time.Time{})
+		if err != nil {
+			return "", err
+		}
+
+		job := config.Job
+		if job == "" {
+			job = "default"
+		}
+		report := newJobReport(job, records, since)
+
+		fmt.Fprintf(&b, "\nJob %s:\n", report.Job)
+		if report.Runs == 0 {
+			fmt.Fprintf(&b, "  No backups ran\n")
+			continue
+		}
+
+		fmt.Fprintf(&b, "  Backups:  %d of %d complete (%.1f%%)",
+			report.Succeeded, report.Runs, 100*float64(report.Succeeded)/float64(report.Runs))
+		if report.Partial > 0 {
+			fmt.Fprintf(&b, ", %d partial", report.Partial)
+		}
+		fmt.Fprintf(&b, "\n")
+		fmt.Fprintf(&b, "  Size:     %s (%s)\n", formatBytes(report.Size), formatGrowth(report.Growth))
+		fmt.Fprintf(&b, "  Uploaded: %s in %d files\n", formatBytes(report.Uploaded), report.UploadedFiles)
+
+		if len(report.Largest) > 0 {
+			fmt.Fprintf(&b, "  Largest new files:\n")
+			for _, file := range report.Largest {
+				fmt.Fprintf(&b, "    %s (%s)\n", file.Path, formatBytes(file.Size))
+			}
+		}
+
+		names := make([]string, 0, len(report.Providers))
+		for name := range report.Providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(&b, "  Providers:\n")
+		for _, name := range names {
+			health := report.Providers[name]
+			fmt.Fprintf(&b, "    %s: %d of %d uploads succeeded", providerLabel(name), health.Succeeded, health.Runs)
+			if health.LastError != "" {
+				fmt.Fprintf(&b, ", last error: %s", health.LastError)
+			}
+			fmt.Fprintf(&b, "\n")
+		}
+	}
+
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// formatGrowth formats a change in size such as "+1.5 MiB"
+func formatGrowth(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
+
+// runReports sends a report of all jobs through the notification channels
+// every report interval. The time of the last report is kept in the state
+// directory, so restarts don't postpone it.
+func runReports(ctx context.Context, managers []*BackupManager) {
+	bm := managers[0]
+	interval := bm.config.ReportInterval
+	if interval <= 0 || bm.alerts == nil {
+		return
+	}
+
+	configs := make([]Config, len(managers))
+	for i, m := range managers {
+		configs[i] = m.config
+	}
+	path := filepath.Join(bm.config.StateDir, "last_report")
+
+	check := func() {
+		var last time.Time
+		if data, err := os.ReadFile(path); err == nil {
+			last, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		}
+
+		// The first period starts now rather than with the oldest history
+		if !last.IsZero() && time.Since(last) < interval {
+			return
+		}
+		if !last.IsZero() {
+			text, err := buildReport(configs, last)
+			if err != nil {
+				log.Printf("Warning: Failed to build report: %v", err)
+				return
+			}
+			bm.alerts.Send("DataVault: report", text)
+		}
+
+		err := os.MkdirAll(bm.config.StateDir, 0700)
+		if err == nil {
+			err = os.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0600)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to save report time: %v", err)
+		}
+	}
+
+	check()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	period := fs.Duration("period", 7*24*time.Hour, "How far back the report goes")
+	send := fs.Bool("send", false, "Send the report through the notification channels")
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	configs := []Config{config}
+	if config.Job == "" && len(configFile.Jobs) > 0 {
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	text, err := buildReport(configs, time.Now().Add(-*period))
+	if err != nil {
+		return err
+	}
+
+	if !*send {
+		fmt.Println(text)
+		return nil
+	}
+
+	if len(config.NotifyChannels) == 0 {
+		return fmt.Errorf("no notification channels configured")
+	}
+
+	n := Notification{Subject: "DataVault: report", Text: text, Time: time.Now()}
+	for _, channel := range config.NotifyChannels {
+		notifier, err := newNotifier(channel)
+		if err != nil {
+			return err
+		}
+		if err := deliver(context.Background(), notifier, n); err != nil {
+			return fmt.Errorf("%s: %w", notifier.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collision policies for files whose names can't coexist on the target
+const (
+	collisionRename = "rename"
+	collisionSkip   = "skip"
+	collisionFail   = "fail"
+)
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := fs.String("to", "", "Directory to restore into (default: ./<backup_name>)")
+	provider := fs.String("provider", "", "Download from this provider (gdrive or pcloud)")
+	onCollision := fs.String("on-collision", collisionRename, "Files whose names collide on the target: rename, skip or fail")
+	tag := fs.String("tag", "", "Restore the newest backup with this tag")
+	manifestFile := fs.String("manifest", "", "Restore the files listed in this local manifest instead of downloading the backup's own")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var manifest *Manifest
+	if *manifestFile != "" {
+		if manifest, err = loadManifest(*manifestFile); err != nil {
+			return err
+		}
+		if manifest.Base != "" {
+			return fmt.Errorf("%s is a delta manifest amending %s, a full manifest is needed", *manifestFile, manifest.Base)
+		}
+		if len(positional) == 0 {
+			positional = []string{manifest.BackupName}
+		}
+	}
+
+	bm := NewBackupManager(config)
+	if *tag != "" && len(positional) == 0 {
+		p, err := bm.provider(*provider)
+		if err != nil {
+			return err
+		}
+		backups, _, err := bm.taggedBackups(context.Background(), p, *tag)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backup on %s is tagged %s", providerLabel(p.Name()), *tag)
+		}
+		positional = []string{backups[0].Name}
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: datavault restore [OPTIONS] <backup_name> | -tag <tag>")
+	}
+	backupName := positional[0]
+	if manifest != nil && manifest.BackupName != backupName {
+		return fmt.Errorf("%s is the manifest of %s, not %s", *manifestFile, manifest.BackupName, backupName)
+	}
+
+	switch *onCollision {
+	case collisionRename, collisionSkip, collisionFail:
+	default:
+		return fmt.Errorf("unsupported collision policy: %s (use rename, skip or fail)", *onCollision)
+	}
+
+	if *to == "" {
+		*to = backupName
+	}
+
+	var restored int
+	if manifest != nil {
+		restored, err = bm.RestoreFromManifest(context.Background(), manifest, *provider, *to, *onCollision)
+	} else {
+		restored, err = bm.RestoreBackup(context.Background(), backupName, *provider, *to, *onCollision)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restored %d files of %s to %s", restored, backupName, *to)
+	return nil
+}
+
+// restoreItem is a manifest entry and the slash-separated path it is
+// restored to
+type restoreItem struct {
+	entry ManifestEntry
+	path  string
+
+	// Where the stored file is, once it has been looked up
+	src    Provider
+	remote RemoteFile
+}
+
+// folderArchiver is implemented by providers that can send a whole backup
+// folder as one zip archive
+type folderArchiver interface {
+	downloadZip(ctx context.Context, backupName string, w io.Writer) error
+}
+
+// zipRestoreMin is the fewest files of one backup folder worth fetching as a
+// zip archive instead of one by one
+const zipRestoreMin = 20
+
+// RestoreBackup downloads every file of a backup into target, including the
+// files an incremental backup keeps in older backups. It returns the number
+// of files restored.
+func (bm *BackupManager) RestoreBackup(ctx context.Context, backupName, providerName, target, policy string) (int, error) {
+	p, err := bm.provider(providerName)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Restoring %s from %s", backupName, p.Name())
+
+	listings := make(map[string]map[string]RemoteFile)
+	manifest, err := bm.remoteManifest(ctx, p, backupName, listings)
+	if err != nil {
+		return 0, err
+	}
+	if manifest == nil {
+		// Without a manifest, restore whatever the folder holds
+		if manifest, err = bm.listingManifest(ctx, p, backupName, listings); err != nil {
+			return 0, err
+		}
+	}
+
+	return bm.restoreManifest(ctx, p, manifest, target, policy, listings)
+}
+
+// RestoreFromManifest restores the files listed in a full manifest kept
+// outside the providers, such as the one embedded in a restore script
+func (bm *BackupManager) RestoreFromManifest(ctx context.Context, manifest *Manifest, providerName, target, policy string) (int, error) {
+	p, err := bm.provider(providerName)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Restoring %s from %s using a local manifest", manifest.BackupName, p.Name())
+	return bm.restoreManifest(ctx, p, manifest, target, policy, make(map[string]map[string]RemoteFile))
+}
+
+// restoreManifest downloads the files listed in a full manifest from p, or
+// the provider a striped file went to, into target
+func (bm *BackupManager) restoreManifest(ctx context.Context, p Provider, manifest *Manifest, target, policy string, listings map[string]map[string]RemoteFile) (int, error) {
+	backupName := manifest.BackupName
+	if err := checkWritable(target); err != nil {
+		return 0, err
+	}
+
+	// A tampered or hand-made manifest must not write outside target, so
+	// nothing is created before every path is checked
+	for _, entry := range manifest.Files {
+		if err := checkRestorePath(entry.Path); err != nil {
+			return 0, err
+		}
+	}
+
+	// Nothing is downloaded if some files can't be decoded
+	if unknown := unknownTransforms(manifest.Files); len(unknown) > 0 {
+		return 0, fmt.Errorf("%s was stored with transforms this version can't undo (%s), restore it with a newer version", backupName, strings.Join(unknown, ", "))
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create target directory: %w", err)
+	}
+
+	plan, err := planRestore(manifest.Files, pathFolding(target), policy)
+	if err != nil {
+		return 0, err
+	}
+
+	failed, present := 0, 0
+	var found []restoreItem
+	for _, item := range plan {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		// Files an earlier attempt restored aren't downloaded again
+		if restoredAlready(filepath.Join(target, filepath.FromSlash(item.path)), item.entry) {
+			present++
+			continue
+		}
+
+		// Files of a striped backup are only on the provider they went to
+		src := p
+		if item.entry.Provider != "" && item.entry.Provider != p.Name() {
+			if src, err = bm.provider(item.entry.Provider); err != nil {
+				return 0, fmt.Errorf("%s is striped across providers: %w", backupName, err)
+			}
+		}
+
+		files, err := bm.storedFiles(ctx, src, item.entry.Backup, listings)
+		if err != nil {
+			return 0, err
+		}
+
+		remote, ok := files[item.entry.storedPath()]
+		if !ok {
+			log.Printf("Failed to restore %s: not found in %s", item.entry.Path, item.entry.Backup)
+			failed++
+			continue
+		}
+
+		item.src, item.remote = src, remote
+		found = append(found, item)
+	}
+
+	if present > 0 {
+		log.Printf("%d files are already in %s and are kept", present, target)
+	}
+
+	// Whole folders come as one archive where the provider can zip them
+	pending, restored := bm.restoreZipped(ctx, found, target, listings)
+
+	for _, item := range pending {
+		if ctx.Err() != nil {
+			return restored, ctx.Err()
+		}
+
+		if err := bm.restoreFile(ctx, item.src, item.remote, item.entry, filepath.Join(target, filepath.FromSlash(item.path))); err != nil {
+			log.Printf("Failed to restore %s: %v", item.entry.Path, err)
+			failed++
+			continue
+		}
+
+		restored++
+		if bm.config.Verbose {
+			log.Printf("Restored file: %s", item.path)
+		}
+	}
+
+	if failed > 0 {
+		return restored, fmt.Errorf("%d of %d files failed to restore", failed, len(plan))
+	}
+
+	return restored, nil
+}
+
+// storedFiles lists the files of a backup on p by stored path, caching
+// listings
+func (bm *BackupManager) storedFiles(ctx context.Context, p Provider, backupName string, listings map[string]map[string]RemoteFile) (map[string]RemoteFile, error) {
+	key := p.Name() + "/" + backupName
+	if files, ok := listings[key]; ok {
+		return files, nil
+	}
+
+	list, err := p.ListBackupFiles(ctx, backupName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup %s: %w", backupName, err)
+	}
+
+	files := make(map[string]RemoteFile, len(list))
+	for _, file := range list {
+		files[file.Path] = file
+	}
+	listings[key] = files
+	return files, nil
+}
+
+// remoteManifest downloads the manifest of a backup and resolves delta
+// manifests against their bases. It returns nil if the backup has none.
+func (bm *BackupManager) remoteManifest(ctx context.Context, p Provider, backupName string, listings map[string]map[string]RemoteFile) (*Manifest, error) {
+	files, err := bm.storedFiles(ctx, p, backupName, listings)
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := files[manifestFileName]
+	if !ok {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := p.DownloadFile(ctx, file, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download manifest of %s: %w", backupName, err)
+	}
+
+	manifest, err := parseManifest(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest of %s: %w", backupName, err)
+	}
+
+	if manifest.Partial {
+		log.Printf("Warning: %s was not completely uploaded, restoring the files it has", backupName)
+	}
+
+	if manifest.Base == "" {
+		return manifest, nil
+	}
+
+	base, err := bm.remoteManifest(ctx, p, manifest.Base, listings)
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return nil, fmt.Errorf("manifest of %s amends %s, which has no manifest", backupName, manifest.Base)
+	}
+
+	return applyDelta(base, manifest), nil
+}
+
+// listingManifest builds a manifest from the files in a backup folder
+func (bm *BackupManager) listingManifest(ctx context.Context, p Provider, backupName string, listings map[string]map[string]RemoteFile) (*Manifest, error) {
+	files, err := bm.storedFiles(ctx, p, backupName, listings)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{BackupName: backupName}
+	for stored, file := range files {
+		entry := ManifestEntry{
+			Path:    unescapePath(stored),
+			Size:    file.Size,
+			ModTime: file.ModTime,
+			Backup:  backupName,
+		}
+		if entry.Path != stored {
+			entry.Stored = stored
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	return manifest, nil
+}
+
+// planRestore decides where each entry is restored to. Entries whose paths
+// map to the same name on the target filesystem are renamed, skipped or
+// rejected according to policy instead of overwriting each other.
+func planRestore(entries []ManifestEntry, fold func(string) string, policy string) ([]restoreItem, error) {
+	sorted := append([]ManifestEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	taken := make(map[string]string)
+	isTaken := func(p string) bool {
+		_, ok := taken[fold(p)]
+		return ok
+	}
+
+	var plan []restoreItem
+	for _, entry := range sorted {
+		if err := checkRestorePath(entry.Path); err != nil {
+			return nil, err
+		}
+		restorePath := entry.Path
+		if other, ok := taken[fold(restorePath)]; ok {
+			switch policy {
+			case collisionFail:
+				return nil, fmt.Errorf("%s and %s collide on the target filesystem", other, restorePath)
+			case collisionSkip:
+				log.Printf("Warning: Skipping %s, it collides with %s on the target filesystem", restorePath, other)
+				continue
+			default:
+				restorePath = collisionName(restorePath, isTaken)
+				if err := checkRestorePath(restorePath); err != nil {
+					return nil, err
+				}
+				log.Printf("Warning: Restoring %s as %s, it collides with %s on the target filesystem", entry.Path, restorePath, other)
+			}
+		}
+
+		taken[fold(restorePath)] = restorePath
+		plan = append(plan, restoreItem{entry: entry, path: restorePath})
+	}
+
+	return plan, nil
+}
+
+// checkRestorePath returns an error unless the slash-separated manifest path
+// p stays inside the directory it is restored into
+func checkRestorePath(p string) error {
+	if !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("refusing to restore %q, it leads outside the restore directory", p)
+	}
+	return nil
+}
+
+// collisionName returns the first free name of the form "name (n).ext"
+func collisionName(p string, taken func(string) bool) string {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, i, ext)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// pathFolding returns how the filesystem at dir compares names: paths with
+// the same key can't exist side by side. It probes for the case and Unicode
+// normalization insensitivity of macOS and Windows filesystems.
+func pathFolding(dir string) func(string) string {
+	foldCase := probeAlias(dir, "Probe", "probe")
+	foldNorm := probeAlias(dir, "\u00e9", "e\u0301")
+
+	return func(p string) string {
+		if foldNorm {
+			p = norm.NFC.String(p)
+		}
+		if foldCase {
+			p = strings.ToLower(p)
+		}
+		return p
+	}
+}
+
+// probeAlias creates a file named name in dir and reports whether it can also
+// be found as alias. If probing fails, the names are assumed to alias.
+func probeAlias(dir, name, alias string) bool {
+	probe := filepath.Join(dir, ".datavault-probe-"+name)
+	file, err := os.OpenFile(probe, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return true
+	}
+	file.Close()
+	defer os.Remove(probe)
+
+	_, err = os.Stat(filepath.Join(dir, ".datavault-probe-"+alias))
+	return err == nil
+}
+
+// restoreZipped restores the files of each backup folder that a provider
+// can zip, and that make up most of the folder, from a single download. It
+// returns the items left to download one by one, including any that failed,
+// and the number restored.
+func (bm *BackupManager) restoreZipped(ctx context.Context, items []restoreItem, target string, listings map[string]map[string]RemoteFile) ([]restoreItem, int) {
+	groups := make(map[string][]restoreItem)
+	var keys []string
+	for _, item := range items {
+		key := item.src.Name() + "/" + item.entry.Backup
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], item)
+	}
+
+	var pending []restoreItem
+	restored := 0
+	for _, key := range keys {
+		group := groups[key]
+		archiver, ok := group[0].src.(folderArchiver)
+		if !ok || !worthZipping(group, listings[key]) || ctx.Err() != nil {
+			pending = append(pending, group...)
+			continue
+		}
+
+		n, rest, err := bm.restoreZip(ctx, archiver, group, target)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Failed to download %s as a zip archive, downloading its files one by one: %v", group[0].entry.Backup, err)
+		}
+		restored += n
+		pending = append(pending, rest...)
+	}
+
+	return pending, restored
+}
+
+// worthZipping reports whether the files to restore from a backup folder are
+// enough, and enough of its content, to download the folder as a whole
+func worthZipping(group []restoreItem, folder map[string]RemoteFile) bool {
+	if len(group) < zipRestoreMin {
+		return false
+	}
+
+	var wanted, total int64
+	for _, item := range group {
+		wanted += item.remote.Size
+	}
+	for _, file := range folder {
+		total += file.Size
+	}
+	return 2*wanted >= total
+}
+
+// restoreZip downloads the backup folder of a group of items as a zip
+// archive next to target and restores the items from it. It returns the
+// number restored and the items the archive didn't provide.
+func (bm *BackupManager) restoreZip(ctx context.Context, archiver folderArchiver, group []restoreItem, target string) (int, []restoreItem, error) {
+	backupName := group[0].entry.Backup
+	tmp, err := os.CreateTemp(target, ".datavault-"+backupName+"-*.zip")
+	if err != nil {
+		return 0, group, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	log.Printf("Downloading %d files of %s as a zip archive", len(group), backupName)
+	if err := archiver.downloadZip(ctx, backupName, tmp); err != nil {
+		return 0, group, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, group, err
+	}
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return 0, group, fmt.Errorf("failed to read zip archive: %w", err)
+	}
+
+	// Archives may hold the backup folder itself or only its content
+	members := make(map[string]*zip.File, len(archive.File))
+	for _, member := range archive.File {
+		members[strings.TrimPrefix(member.Name, backupName+"/")] = member
+	}
+
+	restored := 0
+	var rest []restoreItem
+	for i, item := range group {
+		if ctx.Err() != nil {
+			return restored, append(rest, group[i:]...), nil
+		}
+
+		member, ok := members[item.entry.storedPath()]
+		if !ok {
+			rest = append(rest, item)
+			continue
+		}
+		if err := restoreMember(member, item.entry, filepath.Join(target, filepath.FromSlash(item.path))); err != nil {
+			log.Printf("Warning: Failed to restore %s from the zip archive, downloading it alone: %v", item.entry.Path, err)
+			rest = append(rest, item)
+			continue
+		}
+
+		restored++
+		if bm.config.Verbose {
+			log.Printf("Restored file: %s", item.path)
+		}
+	}
+
+	return restored, rest, nil
+}
+
+// restoreMember restores a stored file from a zip archive member to dst
+func restoreMember(member *zip.File, entry ManifestEntry, dst string) error {
+	rc, err := member.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return writeRestored(rc, int64(member.UncompressedSize64), entry, dst)
+}
+
+// restoredAlready reports whether dst already holds the file of entry. Files
+// are compared by checksum, or by size and modification time if the manifest
+// has no checksum for them.
+func restoredAlready(dst string, entry ManifestEntry) bool {
+	info, err := os.Lstat(dst)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+		return false
+	}
+	algorithm := checksumAlgorithm(entry.Checksum)
+	if algorithm == "" {
+		return info.ModTime().Equal(entry.ModTime)
+	}
+
+	if checksum, err := fileChecksum(dst, algorithm); err != nil || checksum != entry.Checksum {
+		return false
+	}
+	if !info.ModTime().Equal(entry.ModTime) {
+		os.Chtimes(dst, entry.ModTime, entry.ModTime)
+	}
+	return true
+}
+
+// restoreFile downloads a stored file to dst
+func (bm *BackupManager) restoreFile(ctx context.Context, p Provider, remote RemoteFile, entry ManifestEntry, dst string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(p.DownloadFile(ctx, remote, pw))
+	}()
+	defer pr.Close()
+
+	return writeRestored(pr, remote.Size, entry, dst)
+}
+
+// writeRestored writes a stored file read from r to dst, undoing
+// compression, checking its checksum and restoring its modification time
+func writeRestored(r io.Reader, size int64, entry ManifestEntry, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	algorithm := checksumAlgorithm(entry.Checksum)
+	h := newChecksum(algorithm)
+	r, _, err = decodeStored(r, size, entry, true)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(file, h), r)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && algorithm != "" && formatChecksum(algorithm, h) != entry.Checksum {
+		err = fmt.Errorf("checksum mismatch")
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, entry.ModTime, entry.ModTime)
+}
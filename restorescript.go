@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// restoreScript is a POSIX shell script that restores one backup with nothing
+// but the datavault binary and provider credentials. The manifest and the
+// remote root are embedded, so neither the config nor the state directory of
+// the machine that made the backup is needed.
+var restoreScript = template.Must(template.New("restore").Parse(`#!/bin/sh
+# DataVault restore script for {{.Backup}}
+# Generated {{.Generated}} by DataVault {{.Version}} from {{.Provider}}
+# {{.Files}} files, {{.Size}}
+#
+# Usage: sh {{.Script}} -gdrive-auth auth.json | -pcloud-auth token [-to dir] [restore options]
+#
+# The datavault binary is taken from $DATAVAULT or the PATH.
+set -eu
+
+DATAVAULT="${DATAVAULT:-datavault}"
+if ! command -v "$DATAVAULT" >/dev/null 2>&1; then
+	echo "datavault not found: install it or set DATAVAULT to its path" >&2
+	exit 1
+fi
+
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+
+cat > "$work/datavault.json" <<'DATAVAULT_CONFIG_END'
+{{.Config}}
+DATAVAULT_CONFIG_END
+
+cat > "$work/manifest.json" <<'DATAVAULT_MANIFEST_END'
+{{.Manifest}}
+DATAVAULT_MANIFEST_END
+
+"$DATAVAULT" restore -config "$work/datavault.json" -manifest "$work/manifest.json" -to {{.Target}} "$@" {{.BackupArg}}
+`))
+
+func runRestoreScript(args []string) error {
+	fs := flag.NewFlagSet("restore-script", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Directory to write the scripts to")
+	provider := fs.String("provider", "", "Read the manifests from this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) == 0 {
+		return fmt.Errorf("usage: datavault restore-script [OPTIONS] <backup_name>...")
+	}
+
+	bm := NewBackupManager(config)
+	p, err := bm.provider(*provider)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	listings := make(map[string]map[string]RemoteFile)
+	for _, backupName := range positional {
+		path := filepath.Join(*dir, "restore_"+backupName+".sh")
+		if err := bm.writeRestoreScript(ctx, p, backupName, path, listings); err != nil {
+			return fmt.Errorf("%s: %w", backupName, err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+
+	return nil
+}
+
+// writeRestoreScript writes the restore script of a backup on p to path
+func (bm *BackupManager) writeRestoreScript(ctx context.Context, p Provider, backupName, path string, listings map[string]map[string]RemoteFile) error {
+	manifest, err := bm.remoteManifest(ctx, p, backupName, listings)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		if manifest, err = bm.listingManifest(ctx, p, backupName, listings); err != nil {
+			return err
+		}
+	}
+
+	manifestData, err := marshalManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Templates in the remote root may expand differently on another machine
+	configData, err := json.MarshalIndent(ConfigFile{
+		ConfigVersion: currentConfigVersion,
+		RemoteRoot:    expandTemplate(bm.config.RemoteRoot, bm.config.Job, bm.now()),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	var size int64
+	for _, entry := range manifest.Files {
+		size += entry.Size
+	}
+
+	var script strings.Builder
+	err = restoreScript.Execute(&script, map[string]any{
+		"Backup":    backupName,
+		"BackupArg": shellQuote(backupName),
+		"Target":    shellQuote(backupName),
+		"Generated": time.Now().Format(time.RFC3339),
+		"Version":   buildVersion(),
+		"Provider":  providerLabel(p.Name()),
+		"Files":     len(manifest.Files),
+		"Size":      formatBytes(size),
+		"Script":    filepath.Base(path),
+		"Config":    string(configData),
+		"Manifest":  string(manifestData),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := checkWritable(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create script directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(script.String()), 0700); err != nil {
+		return fmt.Errorf("failed to write restore script: %w", err)
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// restriction confines writes in restricted mode ("-restricted") to the
+// staging directory, the state directory and writable_dirs, so the daemon
+// can be sandboxed by AppArmor, SELinux or systemd's ReadWritePaths with a
+// short, fixed list of directories
+var restriction struct {
+	sync.Mutex
+	on   bool
+	dirs []string // Resolved, absolute
+}
+
+// restrictWrites turns on restricted mode. Until allowWrites is called no
+// path is writable, so the config file is not created.
+func restrictWrites() {
+	restriction.Lock()
+	defer restriction.Unlock()
+
+	restriction.on = true
+}
+
+// allowWrites makes dirs and everything below them writable in restricted
+// mode
+func allowWrites(dirs ...string) {
+	restriction.Lock()
+	defer restriction.Unlock()
+
+	for _, dir := range dirs {
+		if dir != "" {
+			restriction.dirs = append(restriction.dirs, resolvePath(dir))
+		}
+	}
+}
+
+// allowConfigWrites makes the directories a config writes to writable in
+// restricted mode
+func allowConfigWrites(config Config) {
+	allowWrites(append([]string{stagingDir(), config.StateDir}, config.WritableDirs...)...)
+}
+
+// checkWritable returns an error if restricted mode doesn't allow writing
+// path
+func checkWritable(path string) error {
+	restriction.Lock()
+	defer restriction.Unlock()
+
+	if !restriction.on {
+		return nil
+	}
+
+	resolved := resolvePath(path)
+	for _, dir := range restriction.dirs {
+		if rel, err := filepath.Rel(dir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	if len(restriction.dirs) == 0 {
+		return fmt.Errorf("restricted mode doesn't allow writing %s", path)
+	}
+	return fmt.Errorf("restricted mode doesn't allow writing %s, only below %s", path, strings.Join(restriction.dirs, ", "))
+}
+
+// resolvePath returns the absolute path with symbolic links of its existing
+// part resolved, so a link can't lead a write out of a writable directory
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	var missing []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...)
+		}
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			return abs
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+	}
+}
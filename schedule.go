@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a recurring period during which backups may run, e.g.
+// {"days": ["weekdays"], "start": "22:00", "end": "06:00"}. A window whose
+// end is before its start extends past midnight; without start and end it
+// covers the whole day.
+type TimeWindow struct {
+	Days  []string `json:"days,omitempty"` // mon..sun, "weekdays", "weekends"; empty means every day
+	Start string   `json:"start,omitempty"`
+	End   string   `json:"end,omitempty"`
+}
+
+// Blackout is a period during which scheduled backups are skipped, e.g. a
+// vacation on a metered connection. Dates without a time cover the whole day.
+type Blackout struct {
+	Start  string `json:"start"` // "2006-01-02", "2006-01-02 15:04" or RFC 3339
+	End    string `json:"end"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type blackoutPeriod struct {
+	start, end time.Time
+	reason     string
+}
+
+type activityWindow struct {
+	days       [7]bool // Indexed by time.Weekday
+	start, end time.Duration
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+func parseWindows(windows []TimeWindow) ([]activityWindow, error) {
+	parsed := make([]activityWindow, 0, len(windows))
+
+	for _, w := range windows {
+		var aw activityWindow
+
+		if len(w.Days) == 0 {
+			for i := range aw.days {
+				aw.days[i] = true
+			}
+		}
+		for _, day := range w.Days {
+			weekdays, ok := weekdayNames[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day in backup window: %s", day)
+			}
+			for _, wd := range weekdays {
+				aw.days[wd] = true
+			}
+		}
+
+		var err error
+		if aw.start, err = parseClock(w.Start); err != nil {
+			return nil, err
+		}
+		if aw.end, err = parseClock(w.End); err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, aw)
+	}
+
+	return parsed, nil
+}
+
+// parseClock parses "HH:MM" into the offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time in backup window: %s (use HH:MM)", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func (aw activityWindow) contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+
+	switch {
+	case aw.start == aw.end:
+		return aw.days[t.Weekday()]
+	case aw.start < aw.end:
+		return aw.days[t.Weekday()] && offset >= aw.start && offset < aw.end
+	default:
+		// Spans midnight: the early hours belong to the previous day's window
+		return (aw.days[t.Weekday()] && offset >= aw.start) || (aw.days[yesterday] && offset < aw.end)
+	}
+}
+
+// inWindows reports whether t falls into any window; no windows means always
+func inWindows(t time.Time, windows []activityWindow) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextWindowStart returns t if it falls into a window, otherwise the start of
+// the next window
+func nextWindowStart(t time.Time, windows []activityWindow) time.Time {
+	if inWindows(t, windows) {
+		return t
+	}
+
+	var next time.Time
+	for d := 0; d <= 7; d++ {
+		day := midnight(t).AddDate(0, 0, d)
+		for _, w := range windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start := day.Add(w.start)
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+
+	return t
+}
+
+func parseBlackouts(blackouts []Blackout) ([]blackoutPeriod, error) {
+	parsed := make([]blackoutPeriod, 0, len(blackouts))
+
+	for _, b := range blackouts {
+		start, _, err := parseBlackoutTime(b.Start)
+		if err != nil {
+			return nil, err
+		}
+
+		end, dateOnly, err := parseBlackoutTime(b.End)
+		if err != nil {
+			return nil, err
+		}
+		if dateOnly {
+			end = end.AddDate(0, 0, 1)
+		}
+
+		if !end.After(start) {
+			return nil, fmt.Errorf("blackout end must be after its start: %s - %s", b.Start, b.End)
+		}
+
+		parsed = append(parsed, blackoutPeriod{start: start, end: end, reason: b.Reason})
+	}
+
+	return parsed, nil
+}
+
+// parseBlackoutTime parses a local date or date and time, reporting whether
+// only a date was given
+func parseBlackoutTime(value string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+
+	return time.Time{}, false, fmt.Errorf("invalid blackout time: %s (use YYYY-MM-DD or YYYY-MM-DD HH:MM)", value)
+}
+
+// activeBlackout returns the blackout t falls into, if any
+func activeBlackout(t time.Time, blackouts []blackoutPeriod) *blackoutPeriod {
+	for i, b := range blackouts {
+		if !t.Before(b.start) && t.Before(b.end) {
+			return &blackouts[i]
+		}
+	}
+	return nil
+}
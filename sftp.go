@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout limits connecting and logging in to a remote source host
+const sshDialTimeout = 30 * time.Second
+
+// sshDefaultKeys are the private keys tried when no key_file is configured,
+// relative to ~/.ssh
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// remoteSource returns the parsed URL if source is a directory on another
+// host pulled over SFTP, e.g. "sftp://backup@web1.example.com/var/www"
+func remoteSource(source string) (*url.URL, bool) {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// mirrorPath returns the local copy of a remote source, which is kept in the
+// state directory so each pull only transfers what changed
+func mirrorPath(stateDir string, u *url.URL) string {
+	host := strings.ReplaceAll(u.Host, ":", "_")
+	return filepath.Join(stateDir, "mirror", host, filepath.FromSlash(path.Clean("/"+u.Path)))
+}
+
+// localSource returns the folder the files of source are read from: the
+// mirror for remote sources, otherwise source itself
+func localSource(stateDir, source string) string {
+	if u, ok := remoteSource(source); ok {
+		return mirrorPath(stateDir, u)
+	}
+	return source
+}
+
+// pullRemote updates the mirror of a remote source over SFTP and returns its
+// path. Files are transferred if their size or modification time changed,
+// and files removed on the remote host are removed from the mirror.
+// Excluded paths are never transferred.
+func (bm *BackupManager) pullRemote(ctx context.Context, u *url.URL) (string, error) {
+	conn, err := bm.dialSSH(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to start SFTP: %w", err)
+	}
+	defer client.Close()
+
+	// Without a path the folder is the login directory
+	root := "."
+	if u.Path != "" {
+		root = path.Clean(u.Path)
+	}
+	if info, err := client.Stat(root); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", root, err)
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+
+	mirror := mirrorPath(bm.config.StateDir, u)
+	if err := os.MkdirAll(mirror, 0700); err != nil {
+		return "", fmt.Errorf("failed to create mirror: %w", err)
+	}
+	if err := bm.updateMirror(ctx, sftpRemote{client}, root, mirror, u.Host); err != nil {
+		return "", err
+	}
+	return mirror, nil
+}
+
+// remoteFS is what updateMirror reads from the remote host
+type remoteFS interface {
+	Walk(root string) remoteWalker
+	Stat(p string) (os.FileInfo, error)
+	Open(p string) (io.ReadCloser, error)
+}
+
+// remoteWalker walks a remote tree like the walker of an SFTP client
+type remoteWalker interface {
+	Step() bool
+	Err() error
+	Path() string
+	Stat() os.FileInfo
+	SkipDir()
+}
+
+// sftpRemote is the remoteFS of an SFTP connection
+type sftpRemote struct {
+	client *sftp.Client
+}
+
+func (r sftpRemote) Walk(root string) remoteWalker {
+	return r.client.Walk(root)
+}
+
+func (r sftpRemote) Stat(p string) (os.FileInfo, error) {
+	return r.client.Stat(p)
+}
+
+func (r sftpRemote) Open(p string) (io.ReadCloser, error) {
+	return r.client.Open(p)
+}
+
+// updateMirror brings mirror up to date with the tree below root on remote.
+// If part of the tree couldn't be read, nothing is removed from the mirror,
+// since the files missing from the walk may well still exist.
+func (bm *BackupManager) updateMirror(ctx context.Context, remote remoteFS, root, mirror, host string) error {
+	excludes := excludeRules(bm.config.Excludes, bm.config.ExcludePresets)
+	present := make(map[string]bool)
+	var pulled, unchanged int
+	var pulledBytes int64
+	incomplete := false
+
+	walker := remote.Walk(root)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker.Err(); err != nil {
+			log.Printf("Warning: Skipping %s: %v", walker.Path(), err)
+			incomplete = true
+			continue
+		}
+
+		rel := remoteRel(root, walker.Path())
+		if rel == "" {
+			continue
+		}
+		// The names come from the remote host, which must not write
+		// outside the mirror
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			log.Printf("Warning: Skipping %s, it leads outside the mirror", walker.Path())
+			continue
+		}
+		info := walker.Stat()
+		if excludes != nil && excludes.match(rel, info.IsDir(), false) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		// A link is pulled as the file it points to on the remote host. It
+		// is never recreated, since the mirror is read on this machine, where
+		// it would point to a local file.
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := remote.Stat(walker.Path())
+			if err != nil {
+				log.Printf("Warning: Skipping link %s: %v", walker.Path(), err)
+				continue
+			}
+			if !target.Mode().IsRegular() {
+				log.Printf("Warning: Skipping link %s, it doesn't point to a file", walker.Path())
+				continue
+			}
+			info = target
+		}
+
+		dst := filepath.Join(mirror, filepath.FromSlash(rel))
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if mirrored(dst, info) {
+				unchanged++
+				break
+			}
+			if err := pullFile(remote, walker.Path(), dst, info); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("failed to pull %s: %w", walker.Path(), err)
+			}
+			pulled++
+			pulledBytes += info.Size()
+		default:
+			// FIFOs, sockets and devices have no content to back up
+			continue
+		}
+		present[rel] = true
+	}
+
+	log.Printf("Pulled %d changed files (%s) from %s, %d unchanged", pulled, formatBytes(pulledBytes), host, unchanged)
+	if incomplete {
+		log.Printf("Warning: Not removing files from the mirror of %s, part of it couldn't be read", host)
+		return nil
+	}
+
+	// Files removed on the remote host are removed from the mirror
+	err := filepath.WalkDir(mirror, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == mirror {
+			return err
+		}
+		rel, _ := filepath.Rel(mirror, p)
+		if present[filepath.ToSlash(rel)] {
+			return nil
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update mirror: %w", err)
+	}
+	return nil
+}
+
+// remoteRel returns the slash-separated path of p, reached by walking root,
+// relative to root; it is empty for root itself
+func remoteRel(root, p string) string {
+	switch {
+	case p == root:
+		return ""
+	case root == ".":
+		return p
+	}
+	return strings.TrimPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// mirrored reports whether dst already has the content of a remote file
+// with info. SFTP transfers modification times in whole seconds.
+func mirrored(dst string, info os.FileInfo) bool {
+	local, err := os.Lstat(dst)
+	return err == nil && local.Mode().IsRegular() && local.Size() == info.Size() &&
+		local.ModTime().Truncate(time.Second).Equal(info.ModTime().Truncate(time.Second))
+}
+
+// pullFile downloads a remote file to dst with its permissions and
+// modification time. It is written next to dst first, so an interrupted pull
+// never leaves a partial file that looks complete.
+func pullFile(remote remoteFS, src, dst string, info os.FileInfo) error {
+	file, err := remote.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	os.RemoveAll(dst)
+	tmp := dst + ".part"
+	local, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(local, file); err != nil {
+		local.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := local.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// dialSSH connects and logs in to the host of a remote source. The host key
+// must be listed in the known_hosts file; keys are taken from the SSH agent
+// and the key file, or the default keys in ~/.ssh.
+func (bm *BackupManager) dialSSH(ctx context.Context, u *url.URL) (*ssh.Client, error) {
+	name := u.User.Username()
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no user in %s: %w", u.Redacted(), err)
+		}
+		name = current.Username
+	}
+
+	knownHosts := bm.config.SSH.KnownHosts
+	if knownHosts == "" {
+		home, _ := os.UserHomeDir()
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts, add the host with ssh-keyscan: %w", err)
+	}
+
+	auth, err := bm.sshAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         sshDialTimeout,
+	}
+
+	dialer := net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(sshDialTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to log in to %s as %s: %w", addr, name, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshAuth returns the ways to authenticate to remote source hosts
+func (bm *BackupManager) sshAuth() ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+
+	keyFiles := []string{bm.config.SSH.KeyFile}
+	if bm.config.SSH.KeyFile == "" {
+		home, _ := os.UserHomeDir()
+		keyFiles = nil
+		for _, key := range sshDefaultKeys {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", key))
+		}
+	}
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if os.IsNotExist(err) && bm.config.SSH.KeyFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			// Keys with a passphrase are used through the agent
+			log.Printf("Warning: Can't use SSH key %s: %v", keyFile, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH key available: set ssh.key_file or run an SSH agent")
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteRel(t *testing.T) {
+	tests := []struct {
+		root, path, want string
+	}{
+		{".", ".", ""},
+		{".", ".bashrc", ".bashrc"},
+		{".", "www/index.html", "www/index.html"},
+		{"/var/www", "/var/www", ""},
+		{"/var/www", "/var/www/.htaccess", ".htaccess"},
+		{"/var/www", "/var/www/site/index.html", "site/index.html"},
+		{"/", "/etc/hosts", "etc/hosts"},
+	}
+	for _, tt := range tests {
+		if got := remoteRel(tt.root, tt.path); got != tt.want {
+			t.Errorf("remoteRel(%q, %q) = %q, want %q", tt.root, tt.path, got, tt.want)
+		}
+	}
+}
+
+// fakeRemote is a remote tree whose walk yields steps in order
+type fakeRemote struct {
+	steps []fakeStep
+	files map[string]string // Content by path
+}
+
+type fakeStep struct {
+	path string
+	dir  bool
+	err  error
+}
+
+func (r *fakeRemote) Walk(root string) remoteWalker {
+	return &fakeWalker{remote: r, i: -1}
+}
+
+func (r *fakeRemote) Stat(p string) (os.FileInfo, error) {
+	for _, step := range r.steps {
+		if step.path == p && step.err == nil {
+			return r.info(step), nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (r *fakeRemote) Open(p string) (io.ReadCloser, error) {
+	content, ok := r.files[p]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(content)), nil
+}
+
+func (r *fakeRemote) info(step fakeStep) os.FileInfo {
+	info := fakeInfo{name: filepath.Base(step.path), mode: 0644}
+	if step.dir {
+		info.mode = fs.ModeDir | 0755
+	} else {
+		info.size = int64(len(r.files[step.path]))
+	}
+	return info
+}
+
+type fakeWalker struct {
+	remote *fakeRemote
+	i      int
+	skip   string // Directory whose entries are skipped
+}
+
+func (w *fakeWalker) Step() bool {
+	for w.i++; w.i < len(w.remote.steps); w.i++ {
+		if w.skip == "" || !strings.HasPrefix(w.remote.steps[w.i].path, w.skip+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWalker) Err() error        { return w.remote.steps[w.i].err }
+func (w *fakeWalker) Path() string      { return w.remote.steps[w.i].path }
+func (w *fakeWalker) Stat() os.FileInfo { return w.remote.info(w.remote.steps[w.i]) }
+func (w *fakeWalker) SkipDir()          { w.skip = w.Path() }
+
+type fakeInfo struct {
+	name string
+	size int64
+	mode fs.FileMode
+}
+
+func (i fakeInfo) Name() string       { return i.name }
+func (i fakeInfo) Size() int64        { return i.size }
+func (i fakeInfo) Mode() fs.FileMode  { return i.mode }
+func (i fakeInfo) ModTime() time.Time { return time.Unix(1700000000, 0) }
+func (i fakeInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fakeInfo) Sys() any           { return nil }
+
+// writeMirror creates files below mirror, by slash-separated path
+func writeMirror(t *testing.T, mirror string, files ...string) {
+	t.Helper()
+	for _, name := range files {
+		path := filepath.Join(mirror, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateMirror(t *testing.T) {
+	readFailed := errors.New("connection lost")
+
+	tests := []struct {
+		name     string
+		steps    []fakeStep
+		existing []string // In the mirror before the pull
+		want     []string // In the mirror after the pull
+	}{
+		{
+			name:     "removes deleted files",
+			steps:    []fakeStep{{path: "/src", dir: true}, {path: "/src/a.txt"}, {path: "/src/dir", dir: true}},
+			existing: []string{"gone.txt", "dir/gone.txt"},
+			want:     []string{"a.txt", "dir"},
+		},
+		{
+			name: "keeps files when a directory can't be read",
+			steps: []fakeStep{{path: "/src", dir: true}, {path: "/src/a.txt"},
+				{path: "/src/dir", err: readFailed}},
+			existing: []string{"dir/b.txt", "c.txt"},
+			want:     []string{"a.txt", "c.txt", "dir", "dir/b.txt"},
+		},
+		{
+			name:  "refuses names leading outside the mirror",
+			steps: []fakeStep{{path: "/src", dir: true}, {path: "/src/a.txt"}, {path: "/src/../escaped.txt"}},
+			want:  []string{"a.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mirror := filepath.Join(dir, "mirror")
+			if err := os.Mkdir(mirror, 0700); err != nil {
+				t.Fatal(err)
+			}
+			writeMirror(t, mirror, tt.existing...)
+
+			remote := &fakeRemote{steps: tt.steps, files: map[string]string{
+				"/src/a.txt":          "alpha",
+				"/src/../escaped.txt": "escaped",
+			}}
+			bm := &BackupManager{}
+			if err := bm.updateMirror(context.Background(), remote, "/src", mirror, "host"); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			filepath.WalkDir(mirror, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && p != mirror {
+					rel, _ := filepath.Rel(mirror, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("mirror has %v, want %v", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+				t.Error("a remote name wrote outside the mirror")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+func runShare(args []string) error {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	expire := fs.Duration("expire", 72*time.Hour, "How long the share link stays valid")
+	email := fs.String("email", "", "Google Drive: share with this account only (required for expiry)")
+	provider := fs.String("provider", "", "Only share from this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: datavault share [OPTIONS] <backup_name>")
+	}
+	backupName := positional[0]
+	expires := time.Now().Add(*expire)
+
+	ctx := context.Background()
+	bm := NewBackupManager(config)
+
+	shared := 0
+	if bm.gdrive != nil && (*provider == "" || *provider == "gdrive") {
+		link, err := bm.gdrive.ShareBackup(ctx, backupName, *email, expires)
+		if err != nil {
+			fmt.Printf("Google Drive: %v\n", err)
+		} else {
+			fmt.Printf("Google Drive: %s\n", link)
+			shared++
+		}
+	}
+
+	if bm.pcloud != nil && (*provider == "" || *provider == "pcloud") {
+		link, err := bm.pcloud.ShareBackup(ctx, backupName, expires)
+		if err != nil {
+			fmt.Printf("pCloud: %v\n", err)
+		} else {
+			fmt.Printf("pCloud: %s (expires %s)\n", link, expires.Format(time.RFC1123))
+			shared++
+		}
+	}
+
+	if shared == 0 {
+		return fmt.Errorf("failed to share %s", backupName)
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Simulate runs the backup pipeline once against an in-memory provider and
+// prints what a real run would upload and how long it would take. The local
+// state is read for the incremental baseline and upload speed but never
+// written, so the next real backup is unaffected.
+func (bm *BackupManager) Simulate(ctx context.Context) error {
+	started := time.Now()
+	now := bm.now()
+	source := bm.sourceFolder(now)
+	if _, ok := remoteSource(source); ok {
+		// Pulling would write the mirror, so the last pull is simulated
+		fmt.Printf("Note: simulating with the files of %s pulled last\n", source)
+		source = localSource(bm.config.StateDir, source)
+	}
+
+	if err := bm.checkSource(source); err != nil {
+		return err
+	}
+
+	backupName := bm.backupName(now)
+	backupPath := filepath.Join(bm.tempDir, "simulate_"+backupName)
+	bm.stages.add(backupPath)
+	defer bm.stages.remove(backupPath)
+
+	limit, err := bm.reserveTemp()
+	if err != nil {
+		return err
+	}
+	defer bm.cleanup(backupPath)
+
+	var previous *Manifest
+	if bm.config.Incremental {
+		if previous, err = loadLastManifest(bm.config.StateDir); err != nil {
+			return fmt.Errorf("failed to load last manifest: %w", err)
+		}
+	}
+
+	destPath := filepath.Join(backupPath, filepath.Base(source))
+	manifest, err := bm.stageDirectory(source, destPath, backupName, previous, limit)
+	if err != nil {
+		return fmt.Errorf("failed to copy source directory: %w", err)
+	}
+	staging := time.Since(started)
+
+	if err := saveManifest(deltaManifest(manifest, previous), filepath.Join(destPath, manifestFileName)); err != nil {
+		return err
+	}
+	stored, _, err := dirSize(destPath)
+	if err != nil {
+		return err
+	}
+
+	// The fake provider reads every file, so this is the local cost of an
+	// upload without the network
+	started = time.Now()
+	if err := newFakeProvider().UploadFolder(ctx, destPath, backupName, &memoryProgress{}); err != nil {
+		return fmt.Errorf("simulated upload failed: %w", err)
+	}
+	reading := time.Since(started)
+
+	summary := bm.runSummary(manifest, nil)
+	compressed := 0
+	for _, entry := range manifest.Files {
+		if entry.Backup == backupName && slices.Contains(encodingStages(entry.Encoding), encodingGzip) {
+			compressed++
+		}
+	}
+
+	fmt.Printf("Simulated backup %s of %s\n", backupName, source)
+	fmt.Printf("  Files:      %d (%s)\n", summary.Files, formatBytes(summary.Size))
+	fmt.Printf("  To upload:  %d files (%s)\n", summary.Uploaded, formatBytes(summary.Bytes))
+	fmt.Printf("  Stored:     %s with the manifest, %d files compressed\n", formatBytes(stored), compressed)
+	if previous != nil {
+		fmt.Printf("  Unchanged:  %d files since %s\n", summary.Files-summary.Uploaded, previous.BackupName)
+	}
+	for _, entry := range summary.Largest {
+		fmt.Printf("  Largest:    %s (%s)\n", entry.Path, formatBytes(entry.Size))
+	}
+	fmt.Printf("  Staging:    %s\n", staging.Round(time.Millisecond))
+	fmt.Printf("  Reading:    %s\n", reading.Round(time.Millisecond))
+
+	estimates, err := bm.estimateUploads(summary.Bytes)
+	if err != nil {
+		return err
+	}
+	label := "  Upload:     "
+	for _, e := range estimates {
+		name := "all providers"
+		if e.Provider != "" {
+			name = providerLabel(e.Provider)
+		}
+		if e.Rate == 0 {
+			fmt.Printf("%s%s: no earlier runs or upload_speed to estimate from\n", label, name)
+		} else {
+			took := time.Duration(float64(e.Bytes) / e.Rate * float64(time.Second))
+			fmt.Printf("%s%s: about %s for %s at %s/s (%s), done around %s\n", label, name, formatETA(took),
+				formatBytes(e.Bytes), formatBytes(int64(e.Rate)), e.Basis, bm.now().Add(took).Format("Mon Jan 2 15:04"))
+		}
+		label = "              "
+	}
+	return nil
+}
+
+// rateSamples is how many recent runs the measured upload speed of a
+// provider is averaged over
+const rateSamples = 10
+
+// uploadEstimate is the expected upload of a backup to one provider
+type uploadEstimate struct {
+	Provider string // Empty when no provider is configured
+	Bytes    int64
+	Rate     float64 // Bytes per second; zero if unknown
+	Basis    string  // Where the rate comes from
+}
+
+// estimateUploads estimates the upload of size bytes to each provider the
+// fan-out policy sends them to. Each provider's speed measured by recent runs
+// is used, or the speed of whole earlier runs, and is capped by its share of
+// upload_speed when several providers upload at the same time.
+func (bm *BackupManager) estimateUploads(size int64) ([]uploadEstimate, error) {
+	records, err := loadHistory(bm.config.StateDir, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Whole runs, for providers without a speed of their own
+	var uploaded int64
+	var took time.Duration
+	for _, record := range records {
+		if record.Uploaded > 0 && record.Duration > 0 && !record.Resumed {
+			uploaded += record.Uploaded
+			took += record.Duration
+		}
+	}
+
+	var estimates []uploadEstimate
+	providers := bm.fanOutOrder(bm.providers())
+	switch {
+	case len(providers) == 0:
+		estimates = append(estimates, uploadEstimate{Bytes: size})
+	case bm.config.FanOut == fanOutAny || bm.config.FanOut == fanOutFallback:
+		estimates = append(estimates, uploadEstimate{Provider: providers[0].Name(), Bytes: size})
+	case bm.config.FanOut == fanOutStripe:
+		var total float64
+		weights := make(map[string]float64)
+		for _, p := range providers {
+			weights[p.Name()] = 1
+			if len(bm.config.StripeWeights) > 0 {
+				weights[p.Name()] = bm.config.StripeWeights[p.Name()]
+			}
+			total += weights[p.Name()]
+		}
+		for _, p := range providers {
+			if weights[p.Name()] > 0 {
+				share := int64(float64(size) * weights[p.Name()] / total)
+				estimates = append(estimates, uploadEstimate{Provider: p.Name(), Bytes: share})
+			}
+		}
+	default:
+		for _, p := range providers {
+			estimates = append(estimates, uploadEstimate{Provider: p.Name(), Bytes: size})
+		}
+	}
+
+	for i := range estimates {
+		e := &estimates[i]
+		var sum float64
+		samples := 0
+		for j := len(records) - 1; j >= 0 && samples < rateSamples; j-- {
+			if rate := records[j].Rates[e.Provider]; rate > 0 {
+				sum += float64(rate)
+				samples++
+			}
+		}
+		switch {
+		case samples > 0:
+			e.Rate = sum / float64(samples)
+			e.Basis = fmt.Sprintf("measured over %d runs", samples)
+		case uploaded > 0:
+			e.Rate = float64(uploaded) / took.Seconds()
+			e.Basis = "speed of earlier runs"
+		}
+
+		// Providers uploading at the same time share the connection
+		if speed := float64(bm.config.UploadSpeed) / float64(len(estimates)); speed > 0 && (e.Rate == 0 || speed < e.Rate) {
+			e.Rate = speed
+			e.Basis = "upload_speed"
+			if len(estimates) > 1 {
+				e.Basis = fmt.Sprintf("upload_speed shared by %d providers", len(estimates))
+			}
+		}
+	}
+	return estimates, nil
+}
+
+// formatETA rounds an estimate to what matters at its length, with days for
+// uploads that take several
+func formatETA(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return d.Round(time.Second).String()
+	case d < 24*time.Hour:
+		s := strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+		if strings.HasSuffix(s, "h0m") {
+			s = strings.TrimSuffix(s, "0m")
+		}
+		return s
+	}
+	d = d.Round(time.Hour)
+	return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+}
+
+// simulateJobs simulates a backup of every job in turn
+func simulateJobs(ctx context.Context, managers []*BackupManager) error {
+	failed := 0
+	for _, bm := range managers {
+		if bm.config.Job != "" {
+			fmt.Printf("Job %s:\n", bm.config.Job)
+		}
+		if err := bm.Simulate(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Simulation failed: %v\n", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d simulations failed", failed, len(managers))
+	}
+	return nil
+}
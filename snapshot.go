@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runSnapshot makes one backup outside the schedule under an explicit name,
+// e.g. "datavault backup -name before-os-upgrade"
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the backup folder (required)")
+	comment := fs.String("comment", "", "Comment recorded in the backup, shown by \"datavault list -details\"")
+	var tags []string
+	fs.Func("tag", "Tag the backup (repeatable)", func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *name == "" || len(positional) > 0 {
+		return fmt.Errorf("usage: datavault backup -name <backup_name> [OPTIONS]")
+	}
+	if err := validateTemplate("name", *name); err != nil {
+		return err
+	}
+	if strings.Contains(*name, "/") {
+		return fmt.Errorf("name must not contain slashes")
+	}
+
+	config.Tags = append(config.Tags, tags...)
+	config.Comment = *comment
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+
+	// Named backups don't need a timestamp to be unique, so they are checked
+	// against the existing ones instead
+	config.BackupName = *name
+	bm := NewBackupManager(config)
+	backupName := bm.backupName(bm.now())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	for _, p := range bm.providers() {
+		backups, err := p.ListBackups(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", providerLabel(p.Name()), err)
+		}
+		for _, backup := range backups {
+			if backup.Name == backupName {
+				return fmt.Errorf("%s already has a backup named %s", providerLabel(p.Name()), backupName)
+			}
+		}
+	}
+
+	return bm.RunBackup(ctx)
+}
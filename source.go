@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fstabPath lists the filesystems that are expected to be mounted
+const fstabPath = "/etc/fstab"
+
+// checkSource refuses to back up a source folder that looks unavailable: an
+// empty folder, or one on a filesystem from fstab that isn't mounted. Either
+// would upload an empty backup that pushes good ones out of retention.
+func (bm *BackupManager) checkSource(source string) error {
+	if bm.config.AllowEmptySource {
+		return nil
+	}
+
+	if mountPoint, _ := expectedMount(source); mountPoint != "" && !isMounted(mountPoint) {
+		return fmt.Errorf("source folder %s is on %s, which is listed in %s but not mounted (set allow_empty_source to back it up anyway)",
+			source, mountPoint, fstabPath)
+	}
+
+	// Shares mounted by hand or by an automounter aren't in fstab, but the
+	// last backup tells whether the source was on one
+	if last, err := loadLastManifest(bm.config.StateDir); err == nil && last != nil && last.Info != nil &&
+		last.Info.Source == source && last.Info.Filesystem != "" && shareType(source) == "" {
+		return fmt.Errorf("source folder %s was on a %s share at the last backup but is on a local disk now, so the share is probably not mounted (set allow_empty_source to back it up anyway)",
+			source, last.Info.Filesystem)
+	}
+
+	// A missing or unreadable source is reported by staging
+	entries, err := os.ReadDir(source)
+	if err == nil && len(entries) == 0 {
+		return fmt.Errorf("source folder %s is empty (set allow_empty_source to back it up anyway)", source)
+	}
+
+	return nil
+}
+
+// checkSourceRoot refuses source folders that would back up far more than
+// intended, such as a filesystem root or the home directory, unless allowed.
+// A source containing the staging directory is fine since it is skipped, but
+// one inside it is always refused.
+func checkSourceRoot(source string, allow bool) error {
+	source = realPath(source)
+
+	staging := realPath(stagingDir())
+	if staging == source || strings.HasPrefix(source, staging+string(filepath.Separator)) {
+		return fmt.Errorf("source folder %s is inside the staging directory %s", source, staging)
+	}
+
+	if allow {
+		return nil
+	}
+	if filepath.Dir(source) == source {
+		return fmt.Errorf("source folder %s is a filesystem root (use -force or force_source to back it up anyway)", source)
+	}
+	if home, err := os.UserHomeDir(); err == nil && realPath(home) == source {
+		return fmt.Errorf("source folder %s is the home directory (use -force or force_source to back it up anyway)", source)
+	}
+	return nil
+}
+
+// realPath returns the absolute path with symlinks resolved as far as they
+// exist
+func realPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
+
+// expectedMount returns the innermost mount point from fstab that holds
+// path, other than the root filesystem, and its filesystem type
+func expectedMount(path string) (string, string) {
+	file, err := os.Open(fstabPath)
+	if err != nil {
+		return "", ""
+	}
+	defer file.Close()
+
+	path = filepath.Clean(path)
+	best, bestType := "", ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		// Spaces in mount points are written as \040
+		mountPoint := filepath.Clean(strings.ReplaceAll(fields[1], `\040`, " "))
+		if !filepath.IsAbs(mountPoint) || mountPoint == "/" {
+			continue
+		}
+		if (path == mountPoint || strings.HasPrefix(path, mountPoint+string(filepath.Separator))) && len(mountPoint) > len(best) {
+			best, bestType = mountPoint, fields[2]
+		}
+	}
+
+	return best, bestType
+}
+
+// isMounted reports whether another filesystem is mounted at path. Where
+// devices can't be compared, it assumes so.
+func isMounted(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	parent, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+
+	dev, ok := deviceID(info)
+	parentDev, parentOK := deviceID(parent)
+	if !ok || !parentOK {
+		return true
+	}
+	return dev != parentDev
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statusStale is how long a running upload may go without updating its
+// status before it is taken as stopped
+const statusStale = 6 * statusInterval
+
+// runStatus prints the progress of the uploads of every job that haven't
+// finished, including those running right now
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	configs := []Config{config}
+	if config.Job == "" && len(configFile.Jobs) > 0 {
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, config := range configs {
+		job := config.Job
+		if job == "" {
+			job = "default"
+		}
+
+		queues, err := loadUploadQueues(config.StateDir)
+		if err != nil {
+			return fmt.Errorf("job %s: %w", job, err)
+		}
+		if len(queues) == 0 {
+			fmt.Printf("Job %s: no upload pending\n", job)
+			continue
+		}
+
+		sort.Slice(queues, func(i, j int) bool {
+			return queues[i].CreatedAt.Before(queues[j].CreatedAt)
+		})
+		for _, queue := range queues {
+			fmt.Printf("Job %s: %s, staged %s ago\n", job, queue.BackupName, now.Sub(queue.CreatedAt).Round(time.Second))
+			writeQueueStatus(os.Stdout, queue, now)
+		}
+	}
+
+	return nil
+}
+
+// writeQueueStatus writes the progress of a queued backup on each provider
+// that has started uploading it
+func writeQueueStatus(w io.Writer, queue *uploadQueue, now time.Time) {
+	statuses := make(map[string][]byte)
+	paths, _ := filepath.Glob(filepath.Join(queue.dir, "*.status"))
+	for _, path := range paths {
+		data, _ := os.ReadFile(path)
+		statuses[strings.TrimSuffix(filepath.Base(path), ".status")] = data
+	}
+
+	// An upload as the run_as user keeps its status in its handoff directory
+	if root, err := os.OpenRoot(queue.handoffDir(stagingDir())); err == nil {
+		dir := filepath.Join("queue", queue.BackupName)
+		if f, err := root.Open(dir); err == nil {
+			entries, _ := f.ReadDir(-1)
+			f.Close()
+			for _, entry := range entries {
+				if provider, ok := strings.CutSuffix(entry.Name(), ".status"); ok {
+					if data, err := readHandoffFile(root, filepath.Join(dir, entry.Name())); err == nil {
+						statuses[provider] = data
+					}
+				}
+			}
+		}
+		root.Close()
+	}
+
+	if len(statuses) == 0 {
+		fmt.Fprintf(w, "  Waiting for the upload to start\n")
+		return
+	}
+
+	providers := make([]string, 0, len(statuses))
+	for provider := range statuses {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	for _, provider := range providers {
+		if queue.complete(provider) {
+			fmt.Fprintf(w, "  %s: complete\n", providerLabel(provider))
+			continue
+		}
+
+		var status uploadStatus
+		if err := json.Unmarshal(statuses[provider], &status); err != nil {
+			fmt.Fprintf(w, "  %s: unknown (%v)\n", providerLabel(provider), err)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s\n", providerLabel(provider), status.describe(now))
+	}
+}
+
+// describe summarizes an upload status, estimating the time left from the
+// rate of the current attempt
+func (s uploadStatus) describe(now time.Time) string {
+	percent := 100.0
+	if s.Bytes > 0 {
+		percent = 100 * float64(s.BytesDone) / float64(s.Bytes)
+	}
+	text := fmt.Sprintf("%.1f%% (%d of %d files, %s of %s)", percent, s.FilesDone, s.Files,
+		formatBytes(s.BytesDone), formatBytes(s.Bytes))
+
+	age := now.Sub(s.Updated).Round(time.Second)
+	switch {
+	case !s.Running:
+		return text + fmt.Sprintf(", stopped %s ago, continues with the next run", age)
+	case age > statusStale:
+		return text + fmt.Sprintf(", no sign of the uploading process for %s, it may have been killed", age)
+	}
+
+	elapsed := s.Updated.Sub(s.Started)
+	if sent := s.BytesDone - s.StartBytes; sent > 0 && elapsed > 0 {
+		rate := float64(sent) / elapsed.Seconds()
+		left := time.Duration(float64(s.Bytes-s.BytesDone) / rate * float64(time.Second))
+		text += fmt.Sprintf(", %s/s, about %s left", formatBytes(int64(rate)), left.Round(time.Second))
+	}
+	if s.Current != "" {
+		text += fmt.Sprintf(", uploading %s for %s", s.Current, s.Updated.Sub(s.CurrentSince).Round(time.Second))
+	}
+	return text
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// stripe places each file of the backup on one provider so that the bytes
+// each provider receives follow its weight. Without stripe_weights every
+// provider weighs the same; providers missing from the weights get nothing.
+func (bm *BackupManager) stripe(manifest *Manifest) error {
+	weights := make(map[string]float64)
+	var names []string
+	for _, p := range bm.providers() {
+		weight := 1.0
+		if len(bm.config.StripeWeights) > 0 {
+			weight = bm.config.StripeWeights[p.Name()]
+		}
+		if weight > 0 {
+			weights[p.Name()] = weight
+			names = append(names, p.Name())
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no provider to stripe the backup across")
+	}
+
+	// Placing the largest files first keeps the shares close to the weights
+	order := make([]int, 0, len(manifest.Files))
+	for i, entry := range manifest.Files {
+		if entry.Backup == manifest.BackupName {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return manifest.Files[order[a]].Size > manifest.Files[order[b]].Size
+	})
+
+	assigned := make(map[string]int64)
+	placed := make(map[string]string)
+	for _, i := range order {
+		entry := &manifest.Files[i]
+		if entry.isDuplicate() {
+			continue
+		}
+		best := names[0]
+		for _, name := range names[1:] {
+			if float64(assigned[name]+entry.Size)/weights[name] < float64(assigned[best]+entry.Size)/weights[best] {
+				best = name
+			}
+		}
+		entry.Provider = best
+		assigned[best] += entry.Size
+		placed[entry.storedPath()] = best
+	}
+
+	// Duplicates are wherever their content is
+	for _, i := range order {
+		if entry := &manifest.Files[i]; entry.isDuplicate() {
+			entry.Provider = placed[entry.Stored]
+		}
+	}
+
+	for _, name := range names {
+		log.Printf("Striping %s of %s to %s", formatBytes(assigned[name]), manifest.BackupName, providerLabel(name))
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Limits of what a support bundle includes
+const (
+	supportLogSize    = 4 << 20 // End of the log file
+	supportLogLines   = 20000   // Lines of the systemd journal
+	supportHistoryMax = 50      // Latest runs of each job
+	supportPeriod     = 30 * 24 * time.Hour
+)
+
+// runSupportBundle writes a zip archive with what is needed to diagnose a
+// problem: version and platform, the config with credentials removed, a
+// report and the latest runs of every job, pending uploads and the recent
+// log. Everything in it is redacted like log output.
+func runSupportBundle(args []string) error {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	out := fs.String("out", "", "Archive path (default: datavault-support-<time>.zip)")
+	logFile := fs.String("log", "", "Log file of the daemon to include (default: the systemd journal of datavault.service)")
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	configs := []Config{config}
+	if config.Job == "" && len(configFile.Jobs) > 0 {
+		if configs, err = JobConfigs(configFile, config); err != nil {
+			return err
+		}
+	}
+
+	addSecret(config.PCloudAuth)
+	now := time.Now()
+	if *out == "" {
+		*out = "datavault-support-" + now.Format("2006-01-02_15-04-05") + ".zip"
+	}
+	if err := checkWritable(*out); err != nil {
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", *out, err)
+	}
+	defer file.Close()
+	archive, err := newArchiveWriter("zip", file)
+	if err != nil {
+		return err
+	}
+
+	add := func(name string, data []byte) error {
+		data = []byte(redact(string(data)))
+		return archive.AddFile(name, int64(len(data)), now, 0644, bytes.NewReader(data))
+	}
+
+	// Version, platform and the effective configuration without credentials
+	info := NewBackupManager(config).backupInfo(expandTemplate(config.SourceFolder, config.Job, now), now)
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := add("version.json", data); err != nil {
+		return err
+	}
+
+	if data, err = json.MarshalIndent(redactConfig(configFile), "", "  "); err != nil {
+		return err
+	}
+	if err := add("config.json", data); err != nil {
+		return err
+	}
+
+	report, err := buildReport(configs, now.Add(-supportPeriod))
+	if err != nil {
+		report = fmt.Sprintf("Failed to build the report: %v", err)
+	}
+	if err := add("report.txt", []byte(report+"\n")); err != nil {
+		return err
+	}
+
+	var uploads bytes.Buffer
+	for _, config := range configs {
+		job := config.Job
+		if job == "" {
+			job = "default"
+		}
+
+		// The latest runs hold the errors of each provider
+		records, err := loadHistory(config.StateDir, time.Time{})
+		if err != nil {
+			log.Printf("Warning: Failed to read the run history of job %s: %v", job, err)
+		}
+		var history bytes.Buffer
+		for _, record := range records[max(len(records)-supportHistoryMax, 0):] {
+			line, _ := json.Marshal(record)
+			history.Write(append(line, '\n'))
+		}
+		if err := add("history/"+job+".jsonl", history.Bytes()); err != nil {
+			return err
+		}
+
+		queues, err := loadUploadQueues(config.StateDir)
+		if err != nil {
+			fmt.Fprintf(&uploads, "Job %s: %v\n", job, err)
+		}
+		for _, queue := range queues {
+			fmt.Fprintf(&uploads, "Job %s: %s, staged %s ago\n", job, queue.BackupName, now.Sub(queue.CreatedAt).Round(time.Second))
+			writeQueueStatus(&uploads, queue, now)
+		}
+	}
+	if uploads.Len() == 0 {
+		uploads.WriteString("No upload pending\n")
+	}
+	if err := add("uploads.txt", uploads.Bytes()); err != nil {
+		return err
+	}
+
+	logData, source := recentLog(*logFile)
+	if logData == nil {
+		logData = []byte("No log included: " + source + "\n")
+	}
+	if err := add("log.txt", logData); err != nil {
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s. Credentials were removed, but it still names your files,\n", *out)
+	fmt.Printf("folders and hosts; look through it before attaching it to an issue.\n")
+	return nil
+}
+
+// redactConfig returns a copy of a config file with its credentials
+// replaced, and registers them so they are redacted from the log as well
+func redactConfig(configFile *ConfigFile) ConfigFile {
+	clean := *configFile
+	hide := func(value *string) {
+		if *value != "" {
+			addSecret(*value)
+			*value = redacted
+		}
+	}
+
+	hide(&clean.PCloudAuth)
+	if configFile.Notifications != nil {
+		notifications := *configFile.Notifications
+		notifications.Channels = append([]ChannelConfig(nil), notifications.Channels...)
+		for i := range notifications.Channels {
+			hide(&notifications.Channels[i].URL)
+			hide(&notifications.Channels[i].Password)
+		}
+		clean.Notifications = &notifications
+	}
+	return clean
+}
+
+// recentLog returns the end of the log file at path, or of the systemd
+// journal of datavault.service if path is empty. It returns nil and why if
+// there is no log to include.
+func recentLog(path string) ([]byte, string) {
+	if path == "" {
+		if runtime.GOOS != "linux" {
+			return nil, "pass the log file with -log"
+		}
+		cmd := exec.Command("journalctl", "--unit", "datavault", "--no-pager", "--lines", fmt.Sprint(supportLogLines))
+		cmd.Env = childEnv()
+		output, err := cmd.Output()
+		if err != nil || len(bytes.TrimSpace(output)) == 0 || strings.HasPrefix(string(output), "-- No entries --") {
+			return nil, "datavault.service has no journal, pass the log file with -log"
+		}
+		return output, "journal"
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err.Error()
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil && info.Size() > supportLogSize {
+		file.Seek(info.Size()-supportLogSize, io.SeekStart)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return data, path
+}
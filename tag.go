@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// tagPattern restricts tags to names that need no quoting on the command line
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func validateTag(tag string) error {
+	if !tagPattern.MatchString(tag) {
+		return fmt.Errorf("invalid tag %q: use letters, digits, '.', '_' and '-'", tag)
+	}
+	return nil
+}
+
+// runTag adds tags to a backup, or removes them with -remove, on every
+// provider holding it
+func runTag(args []string) error {
+	fs := flag.NewFlagSet("tag", flag.ExitOnError)
+	remove := fs.Bool("remove", false, "Remove the tags instead of adding them")
+	provider := fs.String("provider", "", "Only tag the backup on this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) < 2 {
+		return fmt.Errorf("usage: datavault tag [OPTIONS] <backup_name> <tag>...")
+	}
+	backupName, tags := positional[0], positional[1:]
+	for _, tag := range tags {
+		if err := validateTag(tag); err != nil {
+			return err
+		}
+	}
+
+	config.Provider = *provider
+	bm := NewBackupManager(config)
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, p := range providers {
+		current, err := bm.retagBackup(ctx, p, backupName, tags, *remove)
+		if err != nil {
+			fmt.Printf("%s: %v\n", providerLabel(p.Name()), err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %s tags: %v\n", providerLabel(p.Name()), backupName, current)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d providers failed", failed, len(providers))
+	}
+	return nil
+}
+
+// runComment sets the comment of a backup on every provider holding it; an
+// empty comment removes it
+func runComment(args []string) error {
+	fs := flag.NewFlagSet("comment", flag.ExitOnError)
+	provider := fs.String("provider", "", "Only change the backup on this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: datavault comment [OPTIONS] <backup_name> <comment>")
+	}
+	backupName, comment := positional[0], positional[1]
+
+	config.Provider = *provider
+	bm := NewBackupManager(config)
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, p := range providers {
+		err := bm.updateManifest(ctx, p, backupName, func(manifest *Manifest) {
+			manifest.Comment = comment
+		})
+		if err != nil {
+			fmt.Printf("%s: %v\n", providerLabel(p.Name()), err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: updated the comment of %s\n", providerLabel(p.Name()), backupName)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d providers failed", failed, len(providers))
+	}
+	return nil
+}
+
+// retagBackup adds tags to or removes them from a backup on p and returns
+// the resulting tags
+func (bm *BackupManager) retagBackup(ctx context.Context, p Provider, backupName string, tags []string, remove bool) ([]string, error) {
+	var result []string
+	err := bm.updateManifest(ctx, p, backupName, func(manifest *Manifest) {
+		for _, tag := range tags {
+			i := slices.Index(manifest.Tags, tag)
+			switch {
+			case remove && i >= 0:
+				manifest.Tags = slices.Delete(manifest.Tags, i, i+1)
+			case !remove && i < 0:
+				manifest.Tags = append(manifest.Tags, tag)
+			}
+		}
+		sort.Strings(manifest.Tags)
+		result = manifest.Tags
+	})
+	return result, err
+}
+
+// updateManifest downloads the manifest of a backup on p, applies update and
+// uploads it again. A delta manifest stays a delta.
+func (bm *BackupManager) updateManifest(ctx context.Context, p Provider, backupName string, update func(*Manifest)) error {
+	files, err := bm.storedFiles(ctx, p, backupName, make(map[string]map[string]RemoteFile))
+	if err != nil {
+		return err
+	}
+	file, ok := files[manifestFileName]
+	if !ok {
+		return fmt.Errorf("%s has no manifest", backupName)
+	}
+
+	var buf bytes.Buffer
+	if err := p.DownloadFile(ctx, file, &buf); err != nil {
+		return fmt.Errorf("failed to download manifest of %s: %w", backupName, err)
+	}
+	manifest, err := parseManifest(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest of %s: %w", backupName, err)
+	}
+	update(manifest)
+
+	dir, err := os.MkdirTemp(bm.tempDir, "manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := saveManifest(manifest, filepath.Join(dir, manifestFileName)); err != nil {
+		return err
+	}
+	return p.UploadFiles(ctx, dir, backupName, []string{manifestFileName})
+}
+
+// taggedBackups returns the backups on p carrying tag, or all backups with a
+// manifest if tag is empty, newest first along with their full manifests
+func (bm *BackupManager) taggedBackups(ctx context.Context, p Provider, tag string) ([]RemoteBackup, []*Manifest, error) {
+	backups, err := p.ListBackups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+
+	var tagged []RemoteBackup
+	var manifests []*Manifest
+	listings := make(map[string]map[string]RemoteFile)
+	for _, backup := range backups {
+		manifest, err := bm.remoteManifest(ctx, p, backup.Name, listings)
+		if err != nil {
+			log.Printf("Warning: Skipping %s: %v", backup.Name, err)
+			continue
+		}
+		if manifest != nil && (tag == "" || slices.Contains(manifest.Tags, tag)) {
+			tagged = append(tagged, backup)
+			manifests = append(manifests, manifest)
+		}
+	}
+	return tagged, manifests, nil
+}
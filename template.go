@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Backup names must be unique, so templates need a time component
+const (
+	defaultBackupName    = "backup_{timestamp}"
+	defaultJobBackupName = "backup_{job}_{timestamp}"
+	defaultRemoteRoot    = "DataVault"
+)
+
+// templateVarPattern matches {name} and {name:arg}
+var templateVarPattern = regexp.MustCompile(`\{([a-z]+)(?::([^}]*))?\}`)
+
+// expandTemplate substitutes variables such as {home}, {hostname}, {date}
+// and {env:FOO} in source paths, remote roots and backup names. Unknown
+// variables are left as they are; validateTemplate reports them.
+func expandTemplate(template, job string, now time.Time) string {
+	return templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		parts := templateVarPattern.FindStringSubmatch(match)
+		if value, ok := templateVar(parts[1], parts[2], job, now); ok {
+			return value
+		}
+		return match
+	})
+}
+
+func templateVar(name, arg, job string, now time.Time) (string, bool) {
+	switch name {
+	case "home":
+		home, _ := os.UserHomeDir()
+		return home, true
+	case "hostname":
+		hostname, _ := os.Hostname()
+		return hostname, true
+	case "user":
+		if u, err := user.Current(); err == nil {
+			return u.Username, true
+		}
+		return os.Getenv("USER"), true
+	case "job":
+		if job == "" {
+			return "default", true
+		}
+		return job, true
+	case "date":
+		return now.Format("2006-01-02"), true
+	case "time":
+		return now.Format("15-04-05"), true
+	case "timestamp":
+		return now.Format("2006-01-02_15-04-05"), true
+	case "env":
+		return os.Getenv(arg), arg != ""
+	}
+	return "", false
+}
+
+func validateTemplate(field, template string) error {
+	for _, parts := range templateVarPattern.FindAllStringSubmatch(template, -1) {
+		if _, ok := templateVar(parts[1], parts[2], "", time.Time{}); !ok {
+			return fmt.Errorf("%s: unknown variable %s", field, parts[0])
+		}
+	}
+	return nil
+}
+
+// validateRemoteRootTemplate checks remote_root, which is expanded once at
+// startup and shared by all jobs, so it can't take the job or the time
+func validateRemoteRootTemplate(template string) error {
+	if err := validateTemplate("remote_root", template); err != nil {
+		return err
+	}
+	for _, parts := range templateVarPattern.FindAllStringSubmatch(template, -1) {
+		switch parts[1] {
+		case "job", "date", "time", "timestamp":
+			return fmt.Errorf("remote_root can't contain %s, it is the same for all jobs and runs", parts[0])
+		}
+	}
+	return nil
+}
+
+func validateBackupNameTemplate(template string) error {
+	if err := validateTemplate("backup_name", template); err != nil {
+		return err
+	}
+	// {time} alone repeats every day
+	unique := strings.Contains(template, "{timestamp}") ||
+		strings.Contains(template, "{date}") && strings.Contains(template, "{time}")
+	if !unique {
+		return fmt.Errorf("backup_name must include {timestamp}, or {date} and {time}, to be unique")
+	}
+	if strings.Contains(template, "/") {
+		return fmt.Errorf("backup_name must not contain slashes")
+	}
+	return nil
+}
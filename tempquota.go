@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stageSet tracks the staging directories that running backups use, so
+// temp_quota never removes them
+type stageSet struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func newStageSet() *stageSet {
+	return &stageSet{paths: make(map[string]bool)}
+}
+
+func (s *stageSet) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths[path] = true
+}
+
+func (s *stageSet) remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.paths, path)
+}
+
+func (s *stageSet) has(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paths[path]
+}
+
+// reserveTemp keeps the temp directory under temp_quota before a new backup
+// is staged. Stages left over from failed or interrupted runs are removed,
+// oldest first, while the directory is at the quota; their queued uploads
+// are dropped. It returns how much the new stage may take, or -1 without a
+// quota, and fails if the stages in use leave no room.
+func (bm *BackupManager) reserveTemp() (int64, error) {
+	quota := bm.config.TempQuota
+	if quota <= 0 {
+		return -1, nil
+	}
+
+	entries, err := os.ReadDir(bm.tempDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read temp directory: %w", err)
+	}
+
+	type stage struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var stale []stage
+	var used int64
+	for _, entry := range entries {
+		path := filepath.Join(bm.tempDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size, _, _ := dirSize(path)
+		used += size
+		if !bm.stages.has(path) {
+			stale = append(stale, stage{path: path, size: size, modTime: info.ModTime()})
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].modTime.Before(stale[j].modTime)
+	})
+	for _, s := range stale {
+		if used < quota {
+			break
+		}
+		log.Printf("Removing staged backup %s (%s) to stay within temp_quota", filepath.Base(s.path), formatBytes(s.size))
+		bm.cleanup(s.path)
+		used -= s.size
+	}
+
+	if used >= quota {
+		return 0, fmt.Errorf("temp directory %s holds %s of running backups, the temp_quota is %s",
+			bm.tempDir, formatBytes(used), formatBytes(quota))
+	}
+	return quota - used, nil
+}
+
+// defaultTempMaxAge is how old leftovers in the temp directory must be before
+// they are removed on startup
+const defaultTempMaxAge = 24 * time.Hour
+
+// cleanTemp removes what crashed or killed runs left in the temp directory
+// once it is older than maxAge, since their deferred cleanup never ran. Stages
+// of queued uploads are kept so the uploads can resume.
+func cleanTemp(tempDir string, configs []Config, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to read temp directory: %v", err)
+		return
+	}
+
+	queued := make(map[string]bool)
+	for _, config := range configs {
+		queues, err := loadUploadQueues(config.StateDir)
+		if err != nil {
+			log.Printf("Warning: Not cleaning the temp directory, failed to load upload queues: %v", err)
+			return
+		}
+		for _, queue := range queues {
+			queued[queue.StagePath] = true
+		}
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(tempDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil || queued[path] || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+
+		size, _, _ := dirSize(path)
+		log.Printf("Removing %s (%s) left in the temp directory by an earlier run", entry.Name(), formatBytes(size))
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Warning: Failed to remove %s: %v", path, err)
+		}
+	}
+}
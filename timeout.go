@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRequestTimeout bounds provider API calls other than file transfers
+const defaultRequestTimeout = 30 * time.Second
+
+// defaultStallWindow is how long a transfer may stay below the minimum speed
+const defaultStallWindow = time.Minute
+
+// stallRetries is how often a stalled upload is sent again before it fails
+const stallRetries = 2
+
+// errStalled ends transfers that fell below the minimum speed
+var errStalled = errors.New("transfer stalled")
+
+// providerTimeouts limit how long a provider may take; zero is unlimited
+type providerTimeouts struct {
+	Request  time.Duration // Each API call other than a file transfer
+	File     time.Duration // Each file upload or download
+	Run      time.Duration // Uploading one backup
+	MinSpeed int64         // Bytes a second a transfer must average over Stall
+	Stall    time.Duration // Window the minimum speed is checked over
+}
+
+// timeoutTransport bounds each request to a provider: file transfers by the
+// file timeout and minimum speed, everything else by the request timeout
+type timeoutTransport struct {
+	base     http.RoundTripper
+	timeouts providerTimeouts
+	transfer func(*http.Request) bool // Reports whether a request carries file content
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.transfer(req) {
+		return t.send(req, t.timeouts.Request, 0)
+	}
+	if t.timeouts.MinSpeed <= 0 {
+		return t.send(req, t.timeouts.File, 0)
+	}
+
+	// A stall mostly means a dead connection, so uploads that can be sent
+	// again are retried on a new one. Downloads stalling while the body is
+	// read fail, and their file is fetched again by the caller.
+	for attempt := 1; ; attempt++ {
+		resp, err := t.send(req, t.timeouts.File, t.timeouts.MinSpeed)
+		if !errors.Is(err, errStalled) || attempt > stallRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		log.Printf("Transfer to %s stalled, retrying on a new connection", req.URL.Host)
+		if idle, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+			idle.CloseIdleConnections()
+		}
+
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// send sends req within timeout, if set, and cancels it if the request and
+// response bodies together move fewer than minSpeed bytes a second over the
+// stall window, if minSpeed is set
+func (t *timeoutTransport) send(req *http.Request, timeout time.Duration, minSpeed int64) (*http.Response, error) {
+	if timeout <= 0 && minSpeed <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancelCause := context.WithCancelCause(req.Context())
+	cancel := func() { cancelCause(context.Canceled) }
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = func() {
+			cancelTimeout()
+			cancelCause(context.Canceled)
+		}
+	}
+
+	req = req.WithContext(ctx)
+	var watch *stallWatch
+	if minSpeed > 0 {
+		watch = watchStall(minSpeed, t.timeouts.Stall, cancelCause)
+		if req.Body != nil {
+			req.Body = &countingBody{ReadCloser: req.Body, watch: watch}
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		watch.stop()
+		cancel()
+		return nil, stallError(ctx, err)
+	}
+
+	// The timeout and stall detection cover reading the response
+	resp.Body = &cancelBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, watch: watch}
+	return resp, nil
+}
+
+// stallError replaces the cancellation error of a stalled request
+func stallError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errStalled) {
+		return cause
+	}
+	return err
+}
+
+// stallWatch cancels a transfer whose throughput falls below a minimum
+type stallWatch struct {
+	moved    atomic.Int64
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// watchStall checks the bytes moved once per window and cancels with
+// errStalled if they are fewer than minSpeed a second
+func watchStall(minSpeed int64, window time.Duration, cancel context.CancelCauseFunc) *stallWatch {
+	w := &stallWatch{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				if moved := w.moved.Swap(0); float64(moved) < float64(minSpeed)*window.Seconds() {
+					cancel(fmt.Errorf("%w: %s in %s", errStalled, formatBytes(moved), window))
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+// stop ends the watch; it may be called on a nil watch
+func (w *stallWatch) stop() {
+	if w != nil {
+		w.stopOnce.Do(func() { close(w.done) })
+	}
+}
+
+// countingBody counts the bytes read from it towards a stall watch
+type countingBody struct {
+	io.ReadCloser
+	watch *stallWatch
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.watch.moved.Add(int64(n))
+	return n, err
+}
+
+// cancelBody releases a request's timeout and stall watch once its response
+// is read
+type cancelBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+	watch  *stallWatch
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.watch != nil {
+		b.watch.moved.Add(int64(n))
+	}
+	if err != nil && err != io.EOF {
+		err = stallError(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	b.watch.stop()
+	return b.ReadCloser.Close()
+}
+
+// gdriveTransfer reports whether a Drive API request uploads or downloads
+// file content
+func gdriveTransfer(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/upload/") || req.URL.Query().Get("alt") == "media"
+}
+
+// pcloudTransfer reports whether a pCloud request uploads or downloads file
+// content. API calls are POSTs to the API host, except for uploads and zip
+// archives; downloads are GETs from the file hosts it names.
+func pcloudTransfer(req *http.Request) bool {
+	return req.URL.Path == "/uploadfile" || req.URL.Path == "/getzip" || req.Method == http.MethodGet
+}
+
+// runTimeout returns how long uploading one backup to the named provider may
+// take, or zero if unlimited
+func (c Config) runTimeout(provider string) time.Duration {
+	switch provider {
+	case "gdrive":
+		return c.DriveTimeouts.Run
+	case "pcloud":
+		return c.PCloudTimeouts.Run
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A transform is a stage of the pipeline a file's content goes through
+// between the source and the staging directory. The stages applied to a file
+// are recorded in its manifest entry and undone in reverse order on restore
+// and export, so providers only ever see opaque files and a new stage needs
+// no change to them.
+type transform interface {
+	// applies reports whether the stage transforms a file of the source
+	applies(path string, size int64) bool
+	// encode returns a writer that writes the transformed content to w;
+	// closing it flushes the stage but doesn't close w
+	encode(w io.Writer) (io.WriteCloser, error)
+	// decode returns the original content of r
+	decode(r io.Reader) (io.Reader, error)
+}
+
+// transforms are the known stages by the name recorded in the manifest
+var transforms = map[string]transform{
+	encodingGzip: gzipTransform{},
+}
+
+// configuredTransforms returns the stages of the transforms setting, after
+// gzip with compress_text
+func configuredTransforms(names []string, compressText bool) []string {
+	if compressText && !slices.Contains(names, encodingGzip) {
+		return append([]string{encodingGzip}, names...)
+	}
+	return names
+}
+
+// pipeline returns the configured stages that apply to a file, in order
+func (bm *BackupManager) pipeline(path string, size int64) []string {
+	var stages []string
+	for _, name := range configuredTransforms(bm.config.Transforms, bm.config.CompressText) {
+		if t, ok := transforms[name]; ok && t.applies(path, size) {
+			stages = append(stages, name)
+		}
+	}
+	return stages
+}
+
+// pipelineEncoding returns the manifest encoding of a file that went through
+// stages, e.g. "gzip"; it is empty for files stored as they are
+func pipelineEncoding(stages []string) string {
+	return strings.Join(stages, ",")
+}
+
+// encodingStages returns the stages recorded in a manifest encoding, in the
+// order they were applied
+func encodingStages(encoding string) []string {
+	if encoding == "" {
+		return nil
+	}
+	return strings.Split(encoding, ",")
+}
+
+// encodeStages returns a writer that passes what is written through stages
+// into w, and a function closing the stages in order so each flushes into the
+// next
+func encodeStages(w io.Writer, stages []string) (io.Writer, func() error, error) {
+	writers := make([]io.WriteCloser, 0, len(stages))
+	closeAll := func() error {
+		var err error
+		for i := len(writers) - 1; i >= 0; i-- {
+			if closeErr := writers[i].Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+
+	for i := len(stages) - 1; i >= 0; i-- {
+		t, ok := transforms[stages[i]]
+		if !ok {
+			closeAll()
+			return nil, nil, fmt.Errorf("unknown transform %q", stages[i])
+		}
+		stage, err := t.encode(w)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to start %s: %w", stages[i], err)
+		}
+		writers = append(writers, stage)
+		w = stage
+	}
+	return w, closeAll, nil
+}
+
+// decodeStages returns the original content of r, undoing stages last to
+// first
+func decodeStages(r io.Reader, stages []string) (io.Reader, error) {
+	for i := len(stages) - 1; i >= 0; i-- {
+		t, ok := transforms[stages[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q, the backup was made by a newer version", stages[i])
+		}
+		var err error
+		if r, err = t.decode(r); err != nil {
+			return nil, fmt.Errorf("failed to undo %s: %w", stages[i], err)
+		}
+	}
+	return r, nil
+}
+
+// validateTransforms checks the names of the transforms setting
+func validateTransforms(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if _, ok := transforms[name]; !ok {
+			return fmt.Errorf("invalid transform %q: must be gzip", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("transform %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// unknownTransforms returns the stages files went through that this version
+// can't undo, sorted
+func unknownTransforms(files []ManifestEntry) []string {
+	seen := make(map[string]bool)
+	var unknown []string
+	for _, entry := range files {
+		for _, stage := range encodingStages(entry.Encoding) {
+			if _, ok := transforms[stage]; !ok && !seen[stage] {
+				seen[stage] = true
+				unknown = append(unknown, stage)
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runUpgradeBackup rewrites the manifests of backups made by older versions
+// in the current format and adds the readme they lack, on every provider
+// holding them
+func runUpgradeBackup(args []string) error {
+	fs := flag.NewFlagSet("upgrade-backup", flag.ExitOnError)
+	all := fs.Bool("all", false, "Upgrade every backup")
+	provider := fs.String("provider", "", "Only upgrade backups on this provider (gdrive or pcloud)")
+
+	config, _, positional, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) == 0 && !*all {
+		return fmt.Errorf("usage: datavault upgrade-backup [OPTIONS] <backup_name>... | -all")
+	}
+
+	config.Provider = *provider
+	bm := NewBackupManager(config)
+	providers := bm.providers()
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage available")
+	}
+
+	ctx := context.Background()
+	failed := 0
+	for _, p := range providers {
+		names := positional
+		if *all {
+			backups, err := p.ListBackups(ctx)
+			if err != nil {
+				fmt.Printf("%s: %v\n", providerLabel(p.Name()), err)
+				failed++
+				continue
+			}
+			names = nil
+			for _, backup := range backups {
+				names = append(names, backup.Name)
+			}
+		}
+
+		listings := make(map[string]map[string]RemoteFile)
+		for _, name := range names {
+			from, upgraded, err := bm.upgradeBackup(ctx, p, name, listings)
+			switch {
+			case err != nil:
+				fmt.Printf("%s: %s: %v\n", providerLabel(p.Name()), name, err)
+				failed++
+			case upgraded:
+				fmt.Printf("%s: upgraded %s from format %d to %d\n", providerLabel(p.Name()), name, from, currentManifestFormat)
+			default:
+				fmt.Printf("%s: %s is up to date\n", providerLabel(p.Name()), name)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d backups failed to upgrade", failed)
+	}
+	return nil
+}
+
+// upgradeBackup uploads the manifest of a backup on p in the current format
+// along with a readme, unless both are there already. It returns the format
+// the manifest was in and whether anything was uploaded. A delta manifest
+// stays a delta.
+func (bm *BackupManager) upgradeBackup(ctx context.Context, p Provider, backupName string, listings map[string]map[string]RemoteFile) (int, bool, error) {
+	files, err := bm.storedFiles(ctx, p, backupName, listings)
+	if err != nil {
+		return 0, false, err
+	}
+	file, ok := files[manifestFileName]
+	if !ok {
+		return 0, false, fmt.Errorf("no manifest, use datavault adopt to make one")
+	}
+
+	var buf bytes.Buffer
+	if err := p.DownloadFile(ctx, file, &buf); err != nil {
+		return 0, false, fmt.Errorf("failed to download manifest: %w", err)
+	}
+	manifest, err := parseManifest(buf.Bytes())
+	if err != nil {
+		return 0, false, err
+	}
+	if _, ok := files[readmeFileName]; ok && manifest.Format == currentManifestFormat {
+		return manifest.Format, false, nil
+	}
+
+	// The readme lists every file, so it needs the full manifest
+	full := manifest
+	if manifest.Base != "" {
+		if full, err = bm.remoteManifest(ctx, p, backupName, listings); err != nil {
+			return 0, false, err
+		}
+	}
+
+	dir, err := os.MkdirTemp(bm.tempDir, "upgrade-")
+	if err != nil {
+		return 0, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := saveManifest(manifest, filepath.Join(dir, manifestFileName)); err != nil {
+		return 0, false, err
+	}
+	if err := writeReadme(full, filepath.Join(dir, readmeFileName)); err != nil {
+		return 0, false, err
+	}
+	if err := p.UploadFiles(ctx, dir, backupName, []string{readmeFileName, manifestFileName}); err != nil {
+		return 0, false, err
+	}
+	return manifest.Format, true, nil
+}
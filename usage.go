@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Approximate per-GB prices derived from the providers' flat-rate 2TB plans.
+// Override them with the "cost" section of the config file.
+var defaultPricing = map[string]ProviderPricing{
+	"gdrive": {StoragePerGBMonth: 0.005, EgressPerGB: 0},
+	"pcloud": {StoragePerGBMonth: 0.0042, EgressPerGB: 0},
+}
+
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	showCost := fs.Bool("cost", false, "Estimate monthly storage and egress costs")
+
+	config, configFile, _, err := loadCommandConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if config.SourceFolder == "" {
+		return fmt.Errorf("source folder must be specified")
+	}
+
+	source := expandTemplate(config.SourceFolder, config.Job, time.Now())
+	size, files, err := dirSize(localSource(config.StateDir, source))
+	if err != nil {
+		return fmt.Errorf("failed to measure source folder: %w", err)
+	}
+
+	fmt.Printf("Source folder:    %s\n", source)
+	fmt.Printf("Backup size:      %s (%d files)\n", formatBytes(size), files)
+
+	// Nothing deletes old backups, so the storage is whatever the providers
+	// hold now and grows with every backup
+	bm := NewBackupManager(config)
+	stored := make(map[string]int64)
+	for _, p := range bm.providers() {
+		bytes, backups, err := storedSize(context.Background(), p)
+		if err != nil {
+			fmt.Printf("Stored on %s: unknown, %v\n", providerLabel(p.Name()), err)
+			continue
+		}
+		stored[p.Name()] = bytes
+		fmt.Printf("Stored on %s: %s in %d backups\n", providerLabel(p.Name()), formatBytes(bytes), backups)
+	}
+	if config.MaxBackups > 0 {
+		fmt.Printf("Note: max_backups (%d) is a retention target that isn't enforced, old backups are kept\n", config.MaxBackups)
+	}
+
+	if !*showCost {
+		return nil
+	}
+
+	providers := configuredProviders(config)
+	if len(providers) == 0 {
+		return fmt.Errorf("no cloud storage configured")
+	}
+
+	restores := 1.0
+	pricing := make(map[string]ProviderPricing)
+	for name, p := range defaultPricing {
+		pricing[name] = p
+	}
+	if configFile.Cost != nil {
+		if configFile.Cost.RestoresPerMonth > 0 {
+			restores = configFile.Cost.RestoresPerMonth
+		}
+		for name, p := range configFile.Cost.Providers {
+			pricing[name] = p
+		}
+	}
+
+	egressGB := float64(size) / (1 << 30) * restores
+
+	fmt.Printf("\nEstimated monthly cost of what is stored now (%.1f full restores/month):\n", restores)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "PROVIDER\tSTORAGE\tEGRESS\tTOTAL\n")
+
+	var total float64
+	for _, name := range providers {
+		p := pricing[name]
+		storedBytes, ok := stored[name]
+		if !ok {
+			// At least the next backup will be stored there
+			storedBytes = size
+		}
+		storage := float64(storedBytes) / (1 << 30) * p.StoragePerGBMonth
+		egress := egressGB * p.EgressPerGB
+		total += storage + egress
+		fmt.Fprintf(w, "%s\t$%.2f\t$%.2f\t$%.2f\n", name, storage, egress, storage+egress)
+	}
+	fmt.Fprintf(w, "all\t\t\t$%.2f\n", total)
+
+	return w.Flush()
+}
+
+// storedSize returns the bytes stored in the backups on p and their number
+func storedSize(ctx context.Context, p Provider) (int64, int, error) {
+	backups, err := p.ListBackups(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, backup := range backups {
+		files, err := p.ListBackupFiles(ctx, backup.Name)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to list %s: %w", backup.Name, err)
+		}
+		for _, file := range files {
+			total += file.Size
+		}
+	}
+	return total, len(backups), nil
+}
+
+// configuredProviders returns the names of the providers with credentials set
+func configuredProviders(config Config) []string {
+	var providers []string
+	if config.GoogleDriveAuth != "" {
+		providers = append(providers, "gdrive")
+	}
+	if config.PCloudAuth != "" {
+		providers = append(providers, "pcloud")
+	}
+	return providers
+}
+
+// dirSize returns the total size and number of regular files under root
+func dirSize(root string) (int64, int, error) {
+	var size int64
+	var files int
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+
+	return size, files, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseBytes parses a size such as "500MB", "10GiB" or "2T". Units are
+// powers of 1024 with or without the "i"; a bare number is bytes.
+func parseBytes(s string) (int64, error) {
+	value := strings.TrimSpace(s)
+	upper := strings.ToUpper(value)
+
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T", "P"} {
+		for _, suffix := range []string{unit + "IB", unit + "B", unit} {
+			if strings.HasSuffix(upper, suffix) {
+				multiplier = int64(1) << (10 * (i + 1))
+				value = strings.TrimSpace(value[:len(value)-len(suffix)])
+				break
+			}
+		}
+		if multiplier > 1 {
+			break
+		}
+	}
+	if multiplier == 1 {
+		value = strings.TrimSpace(strings.TrimSuffix(upper, "B"))
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
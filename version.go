@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// buildVersion returns the DataVault version, falling back to the module
+// version recorded by "go install"
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// BackupInfo records how and by what a backup was produced, so a restore
+// years later knows what to expect
+type BackupInfo struct {
+	Version   string         `json:"version"`
+	GoVersion string         `json:"go_version"`
+	Platform  string         `json:"platform"` // GOOS/GOARCH
+	Host      string         `json:"host"`
+	User      string         `json:"user"`
+	Source    string         `json:"source"` // Source folder with template variables expanded
+	Config    ConfigSnapshot `json:"config"`
+
+	Filesystem string `json:"filesystem,omitempty"` // Network share type holding the source, e.g. "nfs"
+}
+
+// ConfigSnapshot is the effective configuration of a backup run. Credentials
+// are left out; only the names of the configured providers are kept.
+type ConfigSnapshot struct {
+	Job            string   `json:"job,omitempty"`
+	SourceFolder   string   `json:"source_folder"`
+	RemoteRoot     string   `json:"remote_root"`
+	BackupName     string   `json:"backup_name,omitempty"`
+	BackupInterval string   `json:"backup_interval"`
+	Providers      []string `json:"providers"`
+	FanOut         string   `json:"fan_out,omitempty"`
+	Incremental    bool     `json:"incremental,omitempty"`
+	Watch          bool     `json:"watch,omitempty"`
+	CompressText   bool     `json:"compress_text,omitempty"`
+	Transforms     []string `json:"transforms,omitempty"`
+	OneFileSystem  bool     `json:"one_file_system,omitempty"`
+	MaxDepth       int      `json:"max_depth,omitempty"`
+	Strict         bool     `json:"strict,omitempty"`
+	MaxBackups     int      `json:"max_backups,omitempty"`
+}
+
+// backupInfo describes a backup of source started now
+func (bm *BackupManager) backupInfo(source string, now time.Time) *BackupInfo {
+	hostname, _ := os.Hostname()
+	username, _ := templateVar("user", "", bm.config.Job, now)
+
+	var providers []string
+	for _, p := range bm.providers() {
+		providers = append(providers, p.Name())
+	}
+
+	return &BackupInfo{
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Host:      hostname,
+		User:      username,
+		Source:    source,
+		Config: ConfigSnapshot{
+			Job:            bm.config.Job,
+			SourceFolder:   bm.config.SourceFolder,
+			RemoteRoot:     bm.config.RemoteRoot,
+			BackupName:     bm.config.BackupName,
+			BackupInterval: bm.config.BackupInterval.String(),
+			Providers:      providers,
+			FanOut:         bm.config.FanOut,
+			Incremental:    bm.config.Incremental,
+			Watch:          bm.config.Watch,
+			CompressText:   bm.config.CompressText,
+			Transforms:     bm.config.Transforms,
+			OneFileSystem:  bm.config.OneFileSystem,
+			MaxDepth:       bm.config.MaxDepth,
+			Strict:         bm.config.Strict,
+			MaxBackups:     bm.config.MaxBackups,
+		},
+		Filesystem: shareType(source),
+	}
+}
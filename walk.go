@@ -0,0 +1,244 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// sourceFilter decides which directories below the source are walked when
+// staging and watching. Each walk needs its own filter, since it remembers the
+// directories it has seen.
+type sourceFilter struct {
+	root          string
+	rootDev       uint64
+	oneFileSystem bool // Only set when the source's device is known
+	maxDepth      int
+	visited       map[fileKey]string
+	own           map[string]bool       // DataVault's own files and directories below root
+	gitignores    map[string]*gitignore // By directory; nil without gitignore or a .gitignore file
+	excludes      *gitignore            // From excludes and exclude_presets
+}
+
+// fileKey identifies a file independently of the path it was reached by
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+func (bm *BackupManager) newSourceFilter(source string) *sourceFilter {
+	filter := &sourceFilter{
+		root:     source,
+		maxDepth: bm.config.MaxDepth,
+		visited:  make(map[fileKey]string),
+		own:      make(map[string]bool),
+		excludes: excludeRules(bm.config.Excludes, bm.config.ExcludePresets),
+	}
+
+	// Paths are compared as reached from the source, which may be a symlink
+	realSource := realPath(source)
+	for _, path := range bm.ownPaths() {
+		rel, err := filepath.Rel(realSource, realPath(path))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			filter.own[filepath.Join(source, rel)] = true
+		}
+	}
+
+	if bm.config.Gitignore {
+		filter.gitignores = make(map[string]*gitignore)
+	}
+
+	if bm.config.OneFileSystem {
+		info, err := os.Stat(source)
+		if err == nil {
+			filter.rootDev, filter.oneFileSystem = deviceID(info)
+		}
+		if !filter.oneFileSystem {
+			log.Printf("Warning: one_file_system is not supported for %s", source)
+		}
+	}
+
+	return filter
+}
+
+// ownPaths returns the files and directories DataVault itself writes or
+// reads secrets from: the staging and state directories, the config file and
+// the Google Drive credentials. They are never backed up, which would leak
+// credentials and make backups of the staging directory grow without end.
+func (bm *BackupManager) ownPaths() []string {
+	paths := []string{bm.tempDir, bm.config.StateDir, bm.config.ConfigFile, gdriveTokenFile}
+	if bm.config.GoogleDriveAuth != "" {
+		paths = append(paths, bm.config.GoogleDriveAuth)
+	}
+	return paths
+}
+
+// skipFile reports whether the file at path must not be backed up
+func (f *sourceFilter) skipFile(path string) bool {
+	if f.own[path] {
+		log.Printf("Skipping %s, it belongs to DataVault", path)
+		return true
+	}
+	return f.excluded(path, false) || (f.gitignores != nil && f.ignored(path, false))
+}
+
+// skipDir reports whether the directory at path must not be descended into
+func (f *sourceFilter) skipDir(path string, info os.FileInfo) bool {
+	if f.own[path] {
+		log.Printf("Skipping %s, it belongs to DataVault", path)
+		return true
+	}
+
+	if f.excluded(path, true) || (f.gitignores != nil && f.ignored(path, true)) {
+		return true
+	}
+
+	if f.oneFileSystem {
+		if dev, ok := deviceID(info); ok && dev != f.rootDev {
+			log.Printf("Skipping %s on another filesystem", path)
+			return true
+		}
+	}
+
+	if f.maxDepth > 0 {
+		if rel, err := filepath.Rel(f.root, path); err == nil && rel != "." {
+			if depth := strings.Count(filepath.ToSlash(rel), "/") + 1; depth > f.maxDepth {
+				log.Printf("Warning: Skipping %s deeper than max_depth %d", path, f.maxDepth)
+				return true
+			}
+		}
+	}
+
+	// A directory reachable twice, e.g. through a bind mount of one of its
+	// parents, would otherwise be walked forever
+	if key, ok := fileIdentity(info); ok {
+		if first, seen := f.visited[key]; seen {
+			log.Printf("Warning: Skipping %s, same directory as %s", path, first)
+			return true
+		}
+		f.visited[key] = path
+	}
+
+	return false
+}
+
+// walkTree walks the tree at root like filepath.Walk, calling fn for the same
+// paths in the same order. With more than one worker, the subdirectories of
+// each directory are listed and their entries stat'ed ahead of the walk, so
+// the round trips of a network share overlap instead of adding up.
+func walkTree(root string, workers int, fn filepath.WalkFunc) error {
+	if workers <= 1 {
+		return filepath.Walk(root, fn)
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		r := &treeReader{slots: make(chan struct{}, workers)}
+		err = r.walk(root, info, nil, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// treeReader lists directories for walkTree with a limited number of
+// concurrent system calls
+type treeReader struct {
+	slots chan struct{}
+}
+
+// dirListing is a directory read ahead, complete once done is closed
+type dirListing struct {
+	done    chan struct{}
+	entries []dirEntry // Sorted by name
+	err     error
+}
+
+type dirEntry struct {
+	name string
+	info os.FileInfo
+	err  error
+}
+
+// read starts listing dir and stat'ing its entries in the background
+func (r *treeReader) read(dir string) *dirListing {
+	listing := &dirListing{done: make(chan struct{})}
+	go func() {
+		defer close(listing.done)
+
+		r.slots <- struct{}{}
+		file, err := os.Open(dir)
+		var names []string
+		if err == nil {
+			names, err = file.Readdirnames(-1)
+			file.Close()
+		}
+		<-r.slots
+		if err != nil {
+			listing.err = err
+			return
+		}
+		slices.Sort(names)
+
+		listing.entries = make([]dirEntry, len(names))
+		var wg sync.WaitGroup
+		for i, name := range names {
+			r.slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-r.slots }()
+				info, err := os.Lstat(filepath.Join(dir, name))
+				listing.entries[i] = dirEntry{name: name, info: info, err: err}
+			}()
+		}
+		wg.Wait()
+	}()
+	return listing
+}
+
+// walk follows filepath.Walk for path, using its listing if it was read
+// ahead
+func (r *treeReader) walk(path string, info os.FileInfo, listing *dirListing, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	if listing == nil {
+		listing = r.read(path)
+	}
+	<-listing.done
+	err := fn(path, info, listing.err)
+	if listing.err != nil || err != nil {
+		return err
+	}
+
+	ahead := make([]*dirListing, len(listing.entries))
+	for i, entry := range listing.entries {
+		if entry.err == nil && entry.info.IsDir() {
+			ahead[i] = r.read(filepath.Join(path, entry.name))
+		}
+	}
+
+	for i, entry := range listing.entries {
+		name := filepath.Join(path, entry.name)
+		if entry.err != nil {
+			if err := fn(name, entry.info, entry.err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := r.walk(name, entry.info, ahead[i], fn); err != nil {
+			if !entry.info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
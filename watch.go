@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultWatchDebounce is how long the source must be quiet before a burst
+// of changes is uploaded
+const defaultWatchDebounce = 5 * time.Second
+
+// Watch uploads changes in the source folder as they happen. Each burst of
+// changes is appended to the current backup as a micro-incremental instead of
+// running a full backup.
+func (bm *BackupManager) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// The watched tree is fixed, so time-based variables use the start time
+	source := bm.sourceFolder(bm.now())
+	if err := bm.watchTree(watcher, source, source); err != nil {
+		return fmt.Errorf("failed to watch source folder: %w", err)
+	}
+
+	log.Printf("Watching %s for changes", source)
+
+	pending := make(map[string]struct{})
+	var flush <-chan time.Time
+	var lastUpload time.Time
+
+	// scheduleFlush waits for the debounce window, or not at all for a full
+	// batch, but never uploads sooner than min_interval after the last upload
+	// or while backups aren't allowed
+	scheduleFlush := func() {
+		wait := bm.config.WatchDebounce
+		if bm.config.WatchMaxBatch > 0 && len(pending) >= bm.config.WatchMaxBatch {
+			wait = 0
+		}
+		if next := time.Until(lastUpload.Add(bm.config.WatchMinInterval)); next > wait {
+			wait = next
+		}
+		if start := bm.NextBackupTime(time.Now().Add(wait)); time.Until(start) > wait {
+			wait = time.Until(start)
+		}
+		flush = time.After(wait)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			// fsnotify is not recursive, so new directories need their own watch
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := bm.watchTree(watcher, source, event.Name); err != nil {
+						log.Printf("Warning: Failed to watch %s: %v", event.Name, err)
+					}
+				}
+			}
+
+			pending[event.Name] = struct{}{}
+			scheduleFlush()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Watcher error: %v", err)
+
+		case <-flush:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				if bm.config.WatchMaxBatch > 0 && len(paths) == bm.config.WatchMaxBatch {
+					break
+				}
+				paths = append(paths, path)
+				delete(pending, path)
+			}
+			flush = nil
+
+			if err := bm.UploadChanges(ctx, paths); err != nil {
+				log.Printf("Failed to upload changes: %v", err)
+			}
+			lastUpload = time.Now()
+
+			// Whatever didn't fit in the batch goes out next
+			if len(pending) > 0 {
+				scheduleFlush()
+			}
+		}
+	}
+}
+
+// watchTree adds watches for root and the directories below it, which are
+// part of the tree at source
+func (bm *BackupManager) watchTree(watcher *fsnotify.Watcher, source, root string) error {
+	filter := bm.newSourceFilter(source)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filter.skipDir(path, info) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// UploadChanges appends the changed paths to the current backup, which is the
+// one recorded in the last manifest. Deleted paths are dropped from the
+// manifest. Without a complete backup yet, a full backup is run instead.
+func (bm *BackupManager) UploadChanges(ctx context.Context, paths []string) error {
+	bm.runMu.Lock()
+	defer bm.runMu.Unlock()
+
+	release, err := bm.acquireSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	manifest, err := loadLastManifest(bm.config.StateDir)
+	if err != nil {
+		return fmt.Errorf("failed to load last manifest: %w", err)
+	}
+	if manifest == nil {
+		log.Printf("No complete backup to append to, running full backup")
+		return bm.runBackup(ctx)
+	}
+
+	stagePath := filepath.Join(bm.tempDir, manifest.BackupName+"_changes")
+	bm.stages.add(stagePath)
+	defer bm.stages.remove(stagePath)
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer bm.cleanup(stagePath)
+
+	entries := manifest.index()
+	var changed []string
+	removed := 0
+	src := bm.sourceFolder(bm.now())
+	filter := bm.newSourceFilter(src)
+
+	for _, path := range paths {
+		relPath, err := filepath.Rel(src, path)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			continue
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			// Removed: drop the path and anything below it
+			for entryPath := range entries {
+				if entryPath == relPath || strings.HasPrefix(entryPath, relPath+"/") {
+					delete(entries, entryPath)
+					removed++
+				}
+			}
+			continue
+		}
+
+		// Directories are walked since files may predate their watch
+		err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if filter.skipDir(filePath, info) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filter.skipFile(filePath) {
+				return nil
+			}
+
+			fileRel, err := filepath.Rel(src, filePath)
+			if err != nil {
+				return err
+			}
+			fileRel = filepath.ToSlash(fileRel)
+
+			if !info.Mode().IsRegular() {
+				if kind := specialFileKind(info.Mode()); kind != "" {
+					return bm.skipSpecialFile(fileRel, kind)
+				}
+				return nil
+			}
+
+			if old, ok := entries[fileRel]; ok && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+				return nil
+			}
+
+			entry := ManifestEntry{
+				Path:    fileRel,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Backup:  manifest.BackupName,
+			}
+			if stored := escapePath(fileRel); stored != fileRel {
+				entry.Stored = stored
+			}
+
+			stages := bm.pipeline(filePath, info.Size())
+			stagedPath := filepath.Join(stagePath, filepath.FromSlash(entry.storedPath()))
+			if entry.Checksum, err = bm.copyFile(filePath, stagedPath, info.Mode(), stages, bm.config.Checksum); err != nil {
+				return err
+			}
+			entry.Encoding = pipelineEncoding(stages)
+
+			entries[fileRel] = entry
+			changed = append(changed, entry.storedPath())
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to stage %s: %v", relPath, err)
+		}
+	}
+
+	if len(changed) == 0 && removed == 0 {
+		return nil
+	}
+
+	manifest.Files = manifest.Files[:0]
+	for _, entry := range entries {
+		manifest.Files = append(manifest.Files, entry)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+
+	log.Printf("Uploading %d changed files to %s (%d removed)", len(changed), manifest.BackupName, removed)
+
+	if bm.config.DryRun {
+		log.Printf("Dry run: Would upload %v", changed)
+		return nil
+	}
+
+	// The backup's manifest is replaced by a full one, so a new delta chain
+	// starts here
+	manifest.Chain = 0
+	if err := saveManifest(manifest, filepath.Join(stagePath, manifestFileName)); err != nil {
+		return err
+	}
+	if err := writeReadme(manifest, filepath.Join(stagePath, readmeFileName)); err != nil {
+		return err
+	}
+	changed = append(changed, readmeFileName, manifestFileName)
+
+	failed := 0
+	for _, p := range bm.providers() {
+		cb := bm.breaker(p.Name())
+		if !cb.Allow(time.Now()) {
+			log.Printf("Skipping %s after repeated failures", providerLabel(p.Name()))
+			failed++
+			continue
+		}
+
+		err := p.UploadFiles(ctx, stagePath, manifest.BackupName, changed)
+		cb.Record(err)
+		if err != nil {
+			log.Printf("%s upload of changes failed: %v", providerLabel(p.Name()), err)
+			failed++
+		}
+	}
+
+	// Keep the old baseline so the next scheduled backup picks the changes up
+	if failed > 0 {
+		return fmt.Errorf("%d providers failed", failed)
+	}
+
+	return saveManifest(manifest, lastManifestPath(bm.config.StateDir))
+}